@@ -32,6 +32,15 @@ func main() {
 		fmt.Println(version.Print("loki"))
 		os.Exit(0)
 	}
+	if config.PrintSchema {
+		schema, err := config.GenerateJSONSchema()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed generating config schema: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(schema))
+		os.Exit(0)
+	}
 
 	// This global is set to the config passed into the last call to `NewOverrides`. If we don't
 	// call it atleast once, the defaults are set to an empty struct.
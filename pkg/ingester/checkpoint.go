@@ -526,20 +526,30 @@ type Checkpointer struct {
 	writer  CheckpointWriter
 	metrics *ingesterMetrics
 
+	// On demand checkpoint requests, each answered with the outcome of the checkpoint.
+	requests <-chan chan error
+
 	quit <-chan struct{}
 }
 
-func NewCheckpointer(dur time.Duration, iter SeriesIter, writer CheckpointWriter, metrics *ingesterMetrics, quit <-chan struct{}) *Checkpointer {
+func NewCheckpointer(dur time.Duration, iter SeriesIter, writer CheckpointWriter, metrics *ingesterMetrics, requests <-chan chan error, quit <-chan struct{}) *Checkpointer {
 	return &Checkpointer{
-		dur:     dur,
-		iter:    iter,
-		writer:  writer,
-		metrics: metrics,
-		quit:    quit,
+		dur:      dur,
+		iter:     iter,
+		writer:   writer,
+		metrics:  metrics,
+		requests: requests,
+		quit:     quit,
 	}
 }
 
 func (c *Checkpointer) PerformCheckpoint() (err error) {
+	return c.performCheckpoint(false)
+}
+
+// performCheckpoint writes a checkpoint, spreading the writes over the checkpoint duration
+// unless burst is set.
+func (c *Checkpointer) performCheckpoint(burst bool) (err error) {
 	noop, err := c.writer.Advance()
 	if err != nil {
 		return err
@@ -580,6 +590,10 @@ func (c *Checkpointer) PerformCheckpoint() (err error) {
 			return err
 		}
 
+		if burst {
+			continue
+		}
+
 		if !immediate {
 			if time.Since(start) > c.dur {
 				// This indicates the checkpoint is taking too long; stop waiting
@@ -617,6 +631,15 @@ func (c *Checkpointer) Run() {
 				level.Error(util_log.Logger).Log("msg", "error checkpointing series", "err", err)
 				continue
 			}
+		case done := <-c.requests:
+			level.Info(util_log.Logger).Log("msg", "starting checkpoint on demand")
+			err := c.performCheckpoint(true)
+			if err != nil {
+				level.Error(util_log.Logger).Log("msg", "error checkpointing series", "err", err)
+			}
+			done <- err
+			// The next periodic checkpoint is a full duration away again.
+			ticker.Reset(c.dur)
 		case <-c.quit:
 			return
 		}
@@ -4,12 +4,16 @@ import (
 	"context"
 	fmt "fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/wal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/weaveworks/common/user"
@@ -133,6 +137,82 @@ func TestIngesterWAL(t *testing.T) {
 	ensureIngesterData(ctx, t, start, end, i)
 }
 
+func TestIngesterWALCheckpointOnDemand(t *testing.T) {
+	walDir := t.TempDir()
+
+	ingesterConfig := defaultIngesterTestConfigWithWAL(t, walDir)
+	// No periodic checkpoint during the test.
+	ingesterConfig.WAL.CheckpointDuration = time.Hour
+
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+
+	newIngester := func() *Ingester {
+		i, err := New(ingesterConfig, client.Config{}, &mockStore{chunks: map[string][]chunk.Chunk{}}, limits, runtime.DefaultTenantConfigs(), nil)
+		require.NoError(t, err)
+		require.Nil(t, services.StartAndAwaitRunning(context.Background(), i))
+		return i
+	}
+
+	i := newIngester()
+	defer services.StopAndAwaitTerminated(context.Background(), i) //nolint:errcheck
+
+	start := time.Now()
+	steps := 10
+	end := start.Add(time.Second * time.Duration(steps))
+	req := logproto.PushRequest{
+		Streams: []logproto.Stream{
+			{Labels: `{foo="bar",bar="baz1"}`},
+			{Labels: `{foo="bar",bar="baz2"}`},
+		},
+	}
+	for j := 0; j < steps; j++ {
+		for k := range req.Streams {
+			req.Streams[k].Entries = append(req.Streams[k].Entries, logproto.Entry{
+				Timestamp: start.Add(time.Duration(j) * time.Second),
+				Line:      fmt.Sprintf("line %d", j),
+			})
+		}
+	}
+	ctx := user.InjectOrgID(context.Background(), "test")
+	_, err = i.Push(ctx, &req)
+	require.NoError(t, err)
+	require.Nil(t, services.StopAndAwaitTerminated(context.Background(), i))
+
+	// Without a checkpoint, every entry is replayed from the WAL segments.
+	i = newIngester()
+	defer services.StopAndAwaitTerminated(context.Background(), i) //nolint:errcheck
+	ensureIngesterData(ctx, t, start, end, i)
+	require.Equal(t, float64(2*steps), testutil.ToFloat64(i.metrics.recoveredEntriesTotal))
+	require.Equal(t, float64(0), testutil.ToFloat64(i.metrics.recoveredChunksTotal))
+
+	_, lastSegment, err := wal.Segments(walDir)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	i.CheckpointHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/wal/checkpoint", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	expectCheckpoint(t, walDir, true, time.Second)
+	require.Nil(t, services.StopAndAwaitTerminated(context.Background(), i))
+
+	// The segments holding the entries are covered by the checkpoint and aren't replayed anymore,
+	// the chunks are recovered from the checkpoint instead.
+	firstSegment, _, err := wal.Segments(walDir)
+	require.NoError(t, err)
+	require.Greater(t, firstSegment, lastSegment)
+	i = newIngester()
+	defer services.StopAndAwaitTerminated(context.Background(), i) //nolint:errcheck
+	ensureIngesterData(ctx, t, start, end, i)
+	require.Equal(t, float64(2), testutil.ToFloat64(i.metrics.recoveredChunksTotal))
+	require.Equal(t, float64(0), testutil.ToFloat64(i.metrics.duplicateEntriesTotal))
+
+	// Nothing to checkpoint when the WAL is disabled.
+	_, noWAL := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), noWAL) //nolint:errcheck
+	w = httptest.NewRecorder()
+	noWAL.CheckpointHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/wal/checkpoint", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestIngesterWALIgnoresStreamLimits(t *testing.T) {
 	walDir := t.TempDir()
 
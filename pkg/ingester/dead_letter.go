@@ -0,0 +1,80 @@
+package ingester
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// deadLetterRecord describes a chunk which could not be flushed to the store.
+// It carries enough metadata to reconcile the missing data once the store is healthy again.
+type deadLetterRecord struct {
+	Timestamp   time.Time `json:"ts"`
+	Tenant      string    `json:"tenant"`
+	Fingerprint string    `json:"fingerprint"`
+	Labels      string    `json:"labels"`
+	From        time.Time `json:"from"`
+	Through     time.Time `json:"through"`
+	Bytes       int       `json:"bytes"`
+	Error       string    `json:"error"`
+}
+
+// deadLetterLog appends failed flush records as newline delimited JSON to a file.
+// A nil *deadLetterLog is valid and discards every record.
+type deadLetterLog struct {
+	mtx  sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newDeadLetterLog(path string) (*deadLetterLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterLog{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record writes one record per chunk that failed to flush.
+func (d *deadLetterLog) Record(userID string, fp model.Fingerprint, lbs labels.Labels, cs []*chunkDesc, flushErr error) error {
+	if d == nil {
+		return nil
+	}
+
+	now := time.Now()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, c := range cs {
+		from, through := c.chunk.Bounds()
+		if err := d.enc.Encode(deadLetterRecord{
+			Timestamp:   now,
+			Tenant:      userID,
+			Fingerprint: fp.String(),
+			Labels:      lbs.String(),
+			From:        from,
+			Through:     through,
+			Bytes:       c.chunk.BytesSize(),
+			Error:       flushErr.Error(),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deadLetterLog) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.file.Close()
+}
@@ -0,0 +1,71 @@
+package ingester
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/ring"
+
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// DrainHandler starts draining the ingester, e.g. during rolling restarts. A draining ingester is
+// LEAVING the ring, so that the distributors send the writes to the other ingesters, rejects the
+// pushes still reaching it and gradually flushes its in-memory chunks, see drainSweep, while it
+// keeps serving queries until it is removed from the read path. The lifecycler doesn't allow a
+// LEAVING ingester to become ACTIVE again, so draining lasts until the ingester restarts.
+func (i *Ingester) DrainHandler(w http.ResponseWriter, r *http.Request) {
+	if i.cfg.ReadOnly {
+		http.Error(w, "nothing is flushed in read-only mode", http.StatusBadRequest)
+		return
+	}
+	if i.lifecycler.GetState() == ring.ACTIVE {
+		if err := i.lifecycler.ChangeState(r.Context(), ring.LEAVING); err != nil {
+			http.Error(w, fmt.Sprintf("failed to leave the ring: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !i.draining.Swap(true) {
+		level.Info(util_log.Logger).Log("msg", "draining the ingester")
+	}
+	i.drainSweep()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// drainSweep enqueues immediate flushes of up to DrainStreamsPerSweep streams holding unflushed
+// chunks while the ingester is draining. The next streams are only enqueued once the flush queues
+// are empty again, to spread the flushes over the following flush check periods.
+func (i *Ingester) drainSweep() {
+	if !i.draining.Load() || i.flushQueueDepth() > 0 {
+		return
+	}
+
+	var enqueued int
+	for _, instance := range i.getInstances() {
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			var unflushed bool
+			s.chunkMtx.RLock()
+			for _, c := range s.chunks {
+				if c.flushed.IsZero() {
+					unflushed = true
+					break
+				}
+			}
+			s.chunkMtx.RUnlock()
+			if !unflushed {
+				return true, nil
+			}
+
+			i.sweepStream(instance, s, true)
+			enqueued++
+			return i.cfg.DrainStreamsPerSweep <= 0 || enqueued < i.cfg.DrainStreamsPerSweep, nil
+		})
+		if i.cfg.DrainStreamsPerSweep > 0 && enqueued >= i.cfg.DrainStreamsPerSweep {
+			break
+		}
+	}
+	if enqueued > 0 {
+		level.Info(util_log.Logger).Log("msg", "enqueued streams for draining", "streams", enqueued)
+	}
+}
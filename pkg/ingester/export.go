@@ -0,0 +1,94 @@
+package ingester
+
+import (
+	"archive/tar"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/grafana/loki/pkg/chunkenc"
+	"github.com/grafana/loki/pkg/storage/chunk"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// ExportChunksHandler writes every unflushed in-memory chunk as a tar archive, encoded as it would
+// be stored, without flushing anything. Mainly used for disaster recovery testing.
+// Every chunk is an entry named after its tenant and chunk key, like in the flush spool, so that
+// it can be decoded again.
+func (i *Ingester) ExportChunksHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+
+	now := time.Now()
+	var exported int
+	for _, instance := range i.getInstances() {
+		err := instance.streams.ForEach(func(s *stream) (bool, error) {
+			chunks, err := i.exportStreamChunks(instance.instanceID, s)
+			if err != nil {
+				return false, err
+			}
+			for _, c := range chunks {
+				buf, err := c.Encoded()
+				if err != nil {
+					return false, err
+				}
+				if err := tw.WriteHeader(&tar.Header{
+					Name:    path.Join(c.UserID, spoolFileName(c.ChunkRef)),
+					Mode:    0o644,
+					Size:    int64(len(buf)),
+					ModTime: now,
+				}); err != nil {
+					return false, err
+				}
+				if _, err := tw.Write(buf); err != nil {
+					return false, err
+				}
+				exported++
+			}
+			return true, nil
+		})
+		if err != nil {
+			// The archive is already partially written, it is left truncated.
+			level.Error(util_log.Logger).Log("msg", "failed to export in-memory chunks", "err", err)
+			return
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		level.Error(util_log.Logger).Log("msg", "failed to export in-memory chunks", "err", err)
+		return
+	}
+	level.Info(util_log.Logger).Log("msg", "exported in-memory chunks", "chunks", exported)
+}
+
+// exportStreamChunks encodes copies of the unflushed chunks of a stream. Copies are encoded as
+// the head block of a chunk is only encoded once the chunk is closed, which mustn't happen here.
+func (i *Ingester) exportStreamChunks(userID string, s *stream) ([]chunk.Chunk, error) {
+	s.chunkMtx.RLock()
+	defer s.chunkMtx.RUnlock()
+
+	metric := i.chunkMetric(s.labels)
+	var chunks []chunk.Chunk
+	for _, c := range s.chunks {
+		if !c.flushed.IsZero() {
+			continue
+		}
+		from, through := c.chunk.Bounds()
+		cp, err := c.chunk.Rebound(from, through)
+		if errors.Is(err, chunk.ErrSliceNoDataInRange) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ch, err := i.encodeChunk(userID, s.fp, metric, cp.(*chunkenc.MemChunk))
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, ch)
+	}
+	return chunks, nil
+}
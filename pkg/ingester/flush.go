@@ -2,54 +2,85 @@ package ingester
 
 import (
 	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/weaveworks/common/httpgrpc"
 	"github.com/weaveworks/common/user"
 	"golang.org/x/net/context"
-
-	"github.com/grafana/dskit/tenant"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/grafana/loki/pkg/chunkenc"
 	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/storage/config"
 	"github.com/grafana/loki/pkg/usagestats"
 	"github.com/grafana/loki/pkg/util"
 	loki_util "github.com/grafana/loki/pkg/util"
 	util_log "github.com/grafana/loki/pkg/util/log"
+	"github.com/grafana/loki/pkg/validation"
 )
 
 var (
-	chunkUtilization = promauto.NewHistogram(prometheus.HistogramOpts{
+	chunkUtilization = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "loki",
 		Name:      "ingester_chunk_utilization",
 		Help:      "Distribution of stored chunk utilization (when stored).",
 		Buckets:   prometheus.LinearBuckets(0, 0.2, 6),
 	})
+	chunkUtilizationPerTenant = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunk_utilization_per_tenant",
+		Help:      "Distribution of stored chunk utilization (when stored) per tenant. Only recorded when enabled.",
+		Buckets:   prometheus.LinearBuckets(0, 0.2, 6),
+	}, []string{"tenant"})
+	flushLagPerTenant = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "loki",
+		Name:      "ingester_flush_lag_seconds",
+		Help:      "Age of the newest data of the oldest unflushed chunk per tenant, as of the last sweep, 0 when everything is flushed. Only recorded when enabled.",
+	}, []string{"tenant"})
 	memoryChunks = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: "loki",
 		Name:      "ingester_memory_chunks",
 		Help:      "The total number of chunks in memory.",
 	})
-	chunkEntries = promauto.NewHistogram(prometheus.HistogramOpts{
+	chunksGarbageCollected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunks_gc_total",
+		Help:      "Total number of flushed chunks released from memory once past their retain period.",
+	})
+	chunkEntries = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "loki",
 		Name:      "ingester_chunk_entries",
 		Help:      "Distribution of stored lines per chunk (when stored).",
 		Buckets:   prometheus.ExponentialBuckets(200, 2, 9), // biggest bucket is 200*2^(9-1) = 51200
 	})
-	chunkSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	chunkSize = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "loki",
 		Name:      "ingester_chunk_size_bytes",
 		Help:      "Distribution of stored chunk sizes (when stored).",
 		Buckets:   prometheus.ExponentialBuckets(20000, 2, 10), // biggest bucket is 20000*2^(10-1) = 10,240,000 (~10.2MB)
 	})
-	chunkCompressionRatio = promauto.NewHistogram(prometheus.HistogramOpts{
+	chunkCompressionRatio = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "loki",
 		Name:      "ingester_chunk_compression_ratio",
 		Help:      "Compression ratio of chunks (when stored).",
@@ -65,7 +96,17 @@ var (
 		Name:      "ingester_chunk_stored_bytes_total",
 		Help:      "Total bytes stored in chunks per tenant.",
 	}, []string{"tenant"})
-	chunkAge = promauto.NewHistogram(prometheus.HistogramOpts{
+	chunksPerBackend = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunks_stored_per_backend_total",
+		Help:      "Total stored chunks per storage backend, following the schema period of the chunks.",
+	}, []string{"backend"})
+	chunkSizePerBackend = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunk_stored_bytes_per_backend_total",
+		Help:      "Total bytes stored in chunks per storage backend, following the schema period of the chunks.",
+	}, []string{"backend"})
+	chunkAge = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "loki",
 		Name:      "ingester_chunk_age_seconds",
 		Help:      "Distribution of chunk ages (when stored).",
@@ -73,7 +114,7 @@ var (
 		// so buckets at 1min, 5min, 10min, 30min, 1hr, 2hr, 4hr, 10hr, 12hr, 16hr
 		Buckets: []float64{60, 300, 600, 1800, 3600, 7200, 14400, 36000, 43200, 57600},
 	})
-	chunkEncodeTime = promauto.NewHistogram(prometheus.HistogramOpts{
+	chunkEncodeTime = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "loki",
 		Name:      "ingester_chunk_encode_time_seconds",
 		Help:      "Distribution of chunk encode times.",
@@ -85,19 +126,79 @@ var (
 		Name:      "ingester_chunks_flushed_total",
 		Help:      "Total flushed chunks per reason.",
 	}, []string{"reason"})
-	chunkLifespan = promauto.NewHistogram(prometheus.HistogramOpts{
+	undersizedChunks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_undersized_chunks_total",
+		Help:      "Total flushed chunks whose utilization is below the undersized chunk utilization, per flush reason. Only recorded when enabled.",
+	}, []string{"reason"})
+	chunkBytesFlushedPerReason = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunks_flushed_bytes_by_reason_total",
+		Help:      "Total compressed bytes of the flushed chunks per reason.",
+	}, []string{"reason"})
+	flushLabelLimitViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_flush_label_limit_violations_total",
+		Help:      "Total flushes of streams whose labels violate the label limits of their tenant, per violated limit and action taken.",
+	}, []string{"reason", "action"})
+	chunksDiscardedOnLabelLimits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunks_discarded_on_label_limits_total",
+		Help:      "Total chunks discarded instead of flushed because the labels of their stream violate the label limits of their tenant.",
+	})
+	chunkBytesDiscardedOnLabelLimits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunks_discarded_on_label_limits_bytes_total",
+		Help:      "Total uncompressed bytes of the chunks discarded instead of flushed because the labels of their stream violate the label limits of their tenant.",
+	})
+	chunksDiscardedOnCloseError = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunks_discarded_on_close_error_total",
+		Help:      "Total chunks discarded instead of flushed because they failed to be closed, per policy.",
+	}, []string{"policy"})
+	chunksFlushSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunks_flush_skipped_total",
+		Help:      "Total chunks due for flushing which were skipped, per reason: already_flushed for the chunks retained in memory after their flush, counted at every sweep, and empty for the closed chunks without entries.",
+	}, []string{"reason"})
+	chunksOutsideSchema = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "loki",
+		Name:      "ingester_chunks_outside_schema_total",
+		Help:      "Total chunks discarded instead of being flushed because they fall outside of the configured schema periods.",
+	})
+	flushBatchChunks = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "loki",
+		Name:      "ingester_flush_batch_chunks",
+		Help:      "Distribution of the number of chunks persisted per stream flush.",
+		// 1 -> 2048
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	chunkLifespan = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "loki",
 		Name:      "ingester_chunk_bounds_hours",
 		Help:      "Distribution of chunk end-start durations.",
 		// 1h -> 8hr
 		Buckets: prometheus.LinearBuckets(1, 1, 8),
 	})
+	// optionalFlushMetrics are the flush metrics which can be disabled with disabled_flush_metrics,
+	// by their name. They are registered when the ingester is created.
+	optionalFlushMetrics = map[string]prometheus.Collector{
+		"loki_ingester_chunk_utilization":         chunkUtilization,
+		"loki_ingester_chunk_entries":             chunkEntries,
+		"loki_ingester_chunk_size_bytes":          chunkSize,
+		"loki_ingester_chunk_compression_ratio":   chunkCompressionRatio,
+		"loki_ingester_chunk_age_seconds":         chunkAge,
+		"loki_ingester_chunk_encode_time_seconds": chunkEncodeTime,
+		"loki_ingester_chunk_bounds_hours":        chunkLifespan,
+	}
 	flushedChunksStats            = usagestats.NewCounter("ingester_flushed_chunks")
 	flushedChunksBytesStats       = usagestats.NewStatistics("ingester_flushed_chunks_bytes")
 	flushedChunksLinesStats       = usagestats.NewStatistics("ingester_flushed_chunks_lines")
 	flushedChunksAgeStats         = usagestats.NewStatistics("ingester_flushed_chunks_age_seconds")
 	flushedChunksLifespanStats    = usagestats.NewStatistics("ingester_flushed_chunks_lifespan_seconds")
 	flushedChunksUtilizationStats = usagestats.NewStatistics("ingester_flushed_chunks_utilization")
+	// The size of the flushed chunks per flush reason, which also counts them.
+	flushedChunksBytesPerReasonStats = newFlushReasonStatistics("ingester_flushed_chunks_bytes_reason_")
 )
 
 const (
@@ -105,76 +206,583 @@ const (
 	// position, not wallclock time.
 	flushBackoff = 1 * time.Second
 
+	// 4kB should be enough room for the cortex chunk header.
+	defaultChunkHeaderSizeEstimate = 4 * 1024
+
 	nameLabel = "__name__"
 	logsValue = "logs"
 
-	flushReasonIdle   = "idle"
-	flushReasonMaxAge = "max_age"
-	flushReasonForced = "forced"
-	flushReasonFull   = "full"
-	flushReasonSynced = "synced"
+	flushReasonIdle     = "idle"
+	flushReasonMaxAge   = "max_age"
+	flushReasonForced   = "forced"
+	flushReasonFull     = "full"
+	flushReasonSynced   = "synced"
+	flushReasonPressure = "memory_pressure"
+	flushReasonCutoff   = "cutoff"
+
+	chunkCloseErrorRetry      = "retry"
+	chunkCloseErrorDrop       = "drop"
+	chunkCloseErrorQuarantine = "quarantine"
+
+	flushLabelLimitsIgnore   = "ignore"
+	flushLabelLimitsReject   = "reject"
+	flushLabelLimitsTruncate = "truncate"
+
+	pressureFlushOrderBiggest = "biggest"
+	pressureFlushOrderOldest  = "oldest"
+
+	flushQueueHashModulo = "modulo"
+	flushQueueHashXXHash = "xxhash"
 )
 
+var flushReasons = []string{
+	flushReasonIdle,
+	flushReasonMaxAge,
+	flushReasonForced,
+	flushReasonFull,
+	flushReasonSynced,
+	flushReasonPressure,
+	flushReasonCutoff,
+}
+
+// newFlushReasonStatistics returns the usage statistics named after the prefix and every flush reason.
+func newFlushReasonStatistics(prefix string) map[string]*usagestats.Statistics {
+	stats := make(map[string]*usagestats.Statistics, len(flushReasons))
+	for _, reason := range flushReasons {
+		stats[reason] = usagestats.NewStatistics(prefix + reason)
+	}
+	return stats
+}
+
+// registerFlushMetrics registers the optional flush metrics which aren't disabled.
+// They are shared by all the ingesters of the process, so they may already be registered.
+func registerFlushMetrics(registerer prometheus.Registerer, disabled []string) error {
+	if registerer == nil {
+		return nil
+	}
+	for name, c := range optionalFlushMetrics {
+		if util.StringsContain(disabled, name) {
+			continue
+		}
+		if err := registerer.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Note: this is called both during the WAL replay (zero or more times)
 // and then after replay as well.
 func (i *Ingester) InitFlushQueues() {
+	i.flushQueuesMtx.Lock()
+	defer i.flushQueuesMtx.Unlock()
+
+	i.flushQueuesClosed = false
 	i.flushQueuesDone.Add(i.cfg.ConcurrentFlushes)
 	for j := 0; j < i.cfg.ConcurrentFlushes; j++ {
 		i.flushQueues[j] = util.NewPriorityQueue(flushQueueLength)
-		go i.flushLoop(j)
+		go i.flushLoop(j, i.flushQueues[j], i.flushStats[j])
+	}
+}
+
+// closeFlushQueues closes the flush queues, so that the flush loops exit once they are empty, or
+// right away when discarding the queued operations.
+func (i *Ingester) closeFlushQueues(discard bool) {
+	i.flushQueuesMtx.Lock()
+	defer i.flushQueuesMtx.Unlock()
+
+	i.flushQueuesClosed = true
+	for _, flushQueue := range i.flushQueues {
+		if discard {
+			flushQueue.DiscardAndClose()
+		} else {
+			flushQueue.Close()
+		}
 	}
 }
 
+// flushQueuesSnapshot returns the current flush queues along with their activity.
+func (i *Ingester) flushQueuesSnapshot() ([]*util.PriorityQueue, []*flushQueueStats) {
+	i.flushQueuesMtx.RLock()
+	defer i.flushQueuesMtx.RUnlock()
+	return append([]*util.PriorityQueue(nil), i.flushQueues...), append([]*flushQueueStats(nil), i.flushStats...)
+}
+
+// enqueueFlushOpIn enqueues a flush operation in the given flush queue, tagging it for fair
+// queueing if enabled. It returns false if the operation was already queued.
+func (i *Ingester) enqueueFlushOpIn(queue *util.PriorityQueue, op *flushOp) bool {
+	if i.flushFair == nil {
+		return queue.Enqueue(op)
+	}
+	return i.flushFair.tag(op, i.limits().FlushWeight(op.userID), func() bool {
+		return queue.Enqueue(op)
+	})
+}
+
+// enqueueFlushOp enqueues a flush operation in the flush queue of its stream.
+func (i *Ingester) enqueueFlushOp(op *flushOp) {
+	i.flushQueuesMtx.RLock()
+	defer i.flushQueuesMtx.RUnlock()
+	i.enqueueFlushOpIn(i.flushQueues[i.flushQueueIndex(op.userID, op.fp)], op)
+}
+
 // Flush triggers a flush of all the chunks and closes the flush queues.
 // Called from the Lifecycler as part of the ingester shutdown.
+//
+// The Lifecycler calls Flush while the ingester is LEAVING, and only removes the ingester from the
+// ring once Flush returned. Flush returns once the flush queues drained, so every chunk got
+// flushed, or failed to be, before the ingester leaves the ring and the queriers stop asking it
+// for the data which isn't in the store yet.
 func (i *Ingester) Flush() {
+	if i.cfg.FlushShutdownGracePeriod > 0 {
+		grace := time.AfterFunc(i.cfg.FlushShutdownGracePeriod, func() {
+			level.Warn(util_log.Logger).Log("msg", "flush shutdown grace period elapsed, cancelling outstanding flushes", "grace_period", i.cfg.FlushShutdownGracePeriod)
+			i.cancelFlushes()
+		})
+		defer grace.Stop()
+	}
 	i.flush(true)
+
+	level.Info(util_log.Logger).Log("msg", "flushed the in-memory chunks before leaving the ring")
+	if i.onShutdownFlushed != nil {
+		i.onShutdownFlushed()
+	}
 }
 
 func (i *Ingester) flush(mayRemoveStreams bool) {
 	i.sweepUsers(true, mayRemoveStreams)
 
 	// Close the flush queues, to unblock waiting workers.
-	for _, flushQueue := range i.flushQueues {
-		flushQueue.Close()
+	i.closeFlushQueues(false)
+
+	if i.cfg.FlushProgressLogInterval > 0 {
+		stop := i.logFlushProgress(i.cfg.FlushProgressLogInterval)
+		defer stop()
 	}
 
 	i.flushQueuesDone.Wait()
 	level.Debug(util_log.Logger).Log("msg", "flush queues have drained")
 }
 
+// logFlushProgress periodically logs the remaining flush work until the returned function is called.
+func (i *Ingester) logFlushProgress(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				stats := i.flushStatsSnapshot()
+				level.Info(util_log.Logger).Log("msg", "waiting for flush queues to drain", "queued_flush_ops", stats.QueueDepth, "in_flight_flush_ops", stats.InFlight, "memory_chunks", stats.MemoryChunks)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
 // FlushHandler triggers a flush of all in memory chunks.  Mainly used for
 // local testing.
-func (i *Ingester) FlushHandler(w http.ResponseWriter, _ *http.Request) {
-	i.sweepUsers(true, true)
+// The optional from and to query parameters, as RFC3339 or unix timestamps, restrict the
+// flush to the streams whose head chunk overlaps that time range, for targeted reconciliation.
+// The number of streams scheduled for flushing is returned in that case.
+func (i *Ingester) FlushHandler(w http.ResponseWriter, r *http.Request) {
+	fromParam, toParam := r.FormValue("from"), r.FormValue("to")
+	if fromParam == "" && toParam == "" {
+		i.sweepUsers(true, true)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	from, through := model.Earliest, model.Latest
+	for _, p := range []struct {
+		value string
+		t     *model.Time
+	}{{fromParam, &from}, {toParam, &through}} {
+		if p.value == "" {
+			continue
+		}
+		ms, err := util.ParseTime(p.value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*p.t = model.Time(ms)
+	}
+	if through.Before(from) {
+		http.Error(w, "the to timestamp must not be before the from timestamp", http.StatusBadRequest)
+		return
+	}
+
+	flushed := i.sweepUsersInRange(from, through)
+	util.WriteJSONResponse(w, struct {
+		Streams int `json:"streams"`
+	}{flushed})
+}
+
+// sweepUsersInRange schedules an immediate flush of the streams whose head chunk overlaps
+// the from-through range and returns how many streams were scheduled.
+func (i *Ingester) sweepUsersInRange(from, through model.Time) int {
+	var flushed int
+	for _, instance := range i.getInstances() {
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			s.chunkMtx.RLock()
+			var overlaps bool
+			if len(s.chunks) > 0 {
+				start, end := s.chunks[len(s.chunks)-1].chunk.Bounds()
+				overlaps = !model.TimeFromUnixNano(start.UnixNano()).After(through) &&
+					!model.TimeFromUnixNano(end.UnixNano()).Before(from)
+			}
+			s.chunkMtx.RUnlock()
+
+			if overlaps {
+				i.sweepStream(instance, s, true)
+				flushed++
+			}
+			return true, nil
+		})
+	}
+	return flushed
+}
+
+// FlushBeforeHandler flushes every chunk whose newest data is older than the cutoff query
+// parameter, as a RFC3339 or unix timestamp, regardless of the idle and age rules, so that nothing
+// older than the cutoff stays only in memory, e.g. before the retention deletes it from the store.
+// It returns the number of streams scheduled for flushing.
+func (i *Ingester) FlushBeforeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("cutoff") == "" {
+		http.Error(w, "missing cutoff", http.StatusBadRequest)
+		return
+	}
+	ms, err := util.ParseTime(r.FormValue("cutoff"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flushed := i.sweepUsersBefore(model.Time(ms).Time())
+	util.WriteJSONResponse(w, struct {
+		Streams int `json:"streams"`
+	}{flushed})
+}
+
+// sweepUsersBefore schedules the flush of the streams holding unflushed chunks whose newest data
+// is older than the cutoff and returns how many streams were scheduled.
+func (i *Ingester) sweepUsersBefore(cutoff time.Time) int {
+	if i.cfg.ReadOnly {
+		return 0
+	}
+
+	var flushed int
+	for _, instance := range i.getInstances() {
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			s.chunkMtx.RLock()
+			defer s.chunkMtx.RUnlock()
+
+			for _, c := range s.chunks {
+				if _, through := c.chunk.Bounds(); c.flushed.IsZero() && through.Before(cutoff) {
+					firstTime, _ := s.chunks[0].chunk.Bounds()
+					i.enqueueFlushOp(&flushOp{
+						from:   model.TimeFromUnixNano(firstTime.UnixNano()),
+						userID: instance.instanceID,
+						fp:     s.fp,
+						cutoff: cutoff,
+					})
+					flushed++
+					break
+				}
+			}
+			return true, nil
+		})
+	}
+	return flushed
+}
+
+// flushQueueDepth returns the number of operations pending across all flush queues.
+func (i *Ingester) flushQueueDepth() int {
+	var depth int
+	queues, _ := i.flushQueuesSnapshot()
+	for _, q := range queues {
+		if q != nil {
+			depth += q.Length()
+		}
+	}
+	return depth
+}
+
+// updateFlushPushback puts the ingester into the pushback state once the flush queues
+// have been deeper than FlushQueuePushbackThreshold for at least FlushQueuePushbackPeriod,
+// and takes it out again as soon as they drain below the threshold.
+// While pushing back, CheckReady fails and Push returns ErrFlushPushback, so that writes are shed
+// before the ingester runs out of memory.
+func (i *Ingester) updateFlushPushback(now time.Time) {
+	if i.cfg.FlushQueuePushbackThreshold <= 0 {
+		return
+	}
+
+	if i.flushQueueDepth() <= i.cfg.FlushQueuePushbackThreshold {
+		i.flushPushbackSince = time.Time{}
+		if i.flushPushback.CAS(true, false) {
+			level.Info(util_log.Logger).Log("msg", "flush queues drained, stopping pushback")
+		}
+		i.metrics.flushPushback.Set(0)
+		return
+	}
+
+	if i.flushPushbackSince.IsZero() {
+		i.flushPushbackSince = now
+	}
+	if now.Sub(i.flushPushbackSince) >= i.cfg.FlushQueuePushbackPeriod {
+		if i.flushPushback.CAS(false, true) {
+			level.Warn(util_log.Logger).Log("msg", "flush queues saturated, pushing back", "threshold", i.cfg.FlushQueuePushbackThreshold)
+		}
+		i.metrics.flushPushback.Set(1)
+	}
+}
+
+// CloseAllChunksHandler closes the head chunk of every in memory stream without flushing them,
+// so that they get flushed by the next sweep. Mainly used for debugging controlled shutdowns.
+func (i *Ingester) CloseAllChunksHandler(w http.ResponseWriter, _ *http.Request) {
+	closed := i.closeAllChunks()
+	level.Info(util_log.Logger).Log("msg", "closed all head chunks", "chunks", closed)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// EvictFlushedChunksHandler removes every flushed chunk from memory at once, regardless of the retain
+// period, e.g. to reclaim memory during a memory emergency. The chunks are all persisted already.
+// The streams left empty are removed by the next flush check, as usual.
+func (i *Ingester) EvictFlushedChunksHandler(w http.ResponseWriter, _ *http.Request) {
+	evicted := i.evictFlushedChunks()
+	level.Info(util_log.Logger).Log("msg", "evicted flushed chunks", "chunks", evicted)
+	util.WriteJSONResponse(w, struct {
+		Chunks int `json:"chunks"`
+	}{Chunks: evicted})
+}
+
+// evictFlushedChunks removes every flushed chunk, ignoring the retain period, and returns how many
+// were removed.
+func (i *Ingester) evictFlushedChunks() int {
+	var evicted int
+	for _, instance := range i.getInstances() {
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			evicted += i.removeFlushedChunksRetained(instance, s, false, 0)
+			return true, nil
+		})
+	}
+	return evicted
+}
+
+// closeAllChunks closes the head chunk of every stream and returns how many chunks were closed.
+func (i *Ingester) closeAllChunks() int {
+	var closed int
+	for _, instance := range i.getInstances() {
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			s.chunkMtx.Lock()
+			defer s.chunkMtx.Unlock()
+			if len(s.chunks) == 0 {
+				return true, nil
+			}
+			if head := &s.chunks[len(s.chunks)-1]; !head.closed {
+				head.closed = true
+				closed++
+			}
+			return true, nil
+		})
+	}
+	return closed
+}
+
 type flushOp struct {
 	from      model.Time
 	userID    string
 	fp        model.Fingerprint
 	immediate bool
+	attempts  int
+	// priorityClass is the flush priority class of the tenant, only set for immediate flushes.
+	priorityClass int
+	// cutoff forces the flush of the chunks whose newest data is older, see FlushBeforeHandler.
+	cutoff time.Time
+	// fairStart and fairFinish are the virtual time tags of the op with fair queueing, see flushFairClock.
+	fairStart, fairFinish int64
 }
 
 func (o *flushOp) Key() string {
+	if !o.cutoff.IsZero() {
+		// Don't let a pending periodic flush of the stream swallow the cutoff.
+		return fmt.Sprintf("%s-%s-%v-%d", o.userID, o.fp, o.immediate, o.cutoff.UnixNano())
+	}
 	return fmt.Sprintf("%s-%s-%v", o.userID, o.fp, o.immediate)
 }
 
+const (
+	// flushPriorityClassShift leaves room for the millisecond timestamps below the priority class.
+	flushPriorityClassShift = 44
+	// flushImmediatePriority is above any priority class, up to validation.MaxFlushPriorityClass.
+	flushImmediatePriority = int64(1) << 62
+)
+
 func (o *flushOp) Priority() int64 {
-	return -int64(o.from)
+	// Immediate ops come first so that shutdowns drain fast, then the ones of tenants in a higher
+	// priority class, then the ones with the oldest data, or the lowest tag with fair queueing.
+	priority := int64(o.priorityClass)<<flushPriorityClassShift - int64(o.from)
+	if o.fairFinish > 0 {
+		priority = int64(o.priorityClass)<<flushPriorityClassShift - o.fairFinish
+	}
+	if o.immediate {
+		priority += flushImmediatePriority
+	}
+	return priority
 }
 
 // sweepUsers periodically schedules series for flushing and garbage collects users with no series
 func (i *Ingester) sweepUsers(immediate, mayRemoveStreams bool) {
+	// Nothing is ever flushed in read-only mode.
+	if i.cfg.ReadOnly {
+		return
+	}
+	if i.flushFair != nil {
+		i.flushFair.prune()
+	}
+
 	instances := i.getInstances()
 
+	if !immediate {
+		i.closeChunksUnderPressure(instances)
+	} else {
+		// Enqueue the tenants in a higher flush priority class first.
+		sort.SliceStable(instances, func(a, b int) bool {
+			return i.flushPriorityClass(instances[a].instanceID) > i.flushPriorityClass(instances[b].instanceID)
+		})
+	}
+
+	if i.cfg.SweepConcurrency <= 1 {
+		for _, instance := range instances {
+			i.sweepInstance(instance, immediate, mayRemoveStreams)
+		}
+		return
+	}
+
+	// The streams of every instance are independent, so that a tenant with many streams doesn't
+	// delay the others.
+	_ = concurrency.ForEachJob(context.Background(), len(instances), i.cfg.SweepConcurrency, func(_ context.Context, idx int) error {
+		i.sweepInstance(instances[idx], immediate, mayRemoveStreams)
+		return nil
+	})
+}
+
+// pressureCandidate is a stream whose open head chunk may be closed to relieve memory pressure.
+type pressureCandidate struct {
+	stream *stream
+	size   int
+	from   time.Time
+}
+
+// oldestChunksHeap orders pressure candidates across all the streams by the oldest entry of their head chunk.
+type oldestChunksHeap []pressureCandidate
+
+func (h oldestChunksHeap) Len() int            { return len(h) }
+func (h oldestChunksHeap) Less(a, b int) bool  { return h[a].from.Before(h[b].from) }
+func (h oldestChunksHeap) Swap(a, b int)       { h[a], h[b] = h[b], h[a] }
+func (h *oldestChunksHeap) Push(x interface{}) { *h = append(*h, x.(pressureCandidate)) }
+func (h *oldestChunksHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	*h = old[:n-1]
+	return c
+}
+
+// closeChunksUnderPressure enforces MaxMemoryChunks. When more chunks are held in memory than allowed,
+// it closes the open head chunks of the biggest streams first, or of the ones holding the oldest data
+// depending on MemoryPressureFlushOrder, so that the ongoing sweep flushes them, until the chunks not
+// already on their way out of memory fit under the limit.
+func (i *Ingester) closeChunksUnderPressure(instances []*instance) {
+	if i.cfg.MaxMemoryChunks <= 0 {
+		return
+	}
+
+	var (
+		total      int
+		candidates []pressureCandidate
+	)
 	for _, instance := range instances {
-		i.sweepInstance(instance, immediate, mayRemoveStreams)
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			s.chunkMtx.RLock()
+			defer s.chunkMtx.RUnlock()
+			total += len(s.chunks)
+			// Closed or flushed chunks are released by the regular sweep, only the head chunk can still be open.
+			if n := len(s.chunks); n > 0 && !s.chunks[n-1].closed && s.chunks[n-1].flushed.IsZero() {
+				head := s.chunks[n-1].chunk
+				from, _ := head.Bounds()
+				candidates = append(candidates, pressureCandidate{stream: s, size: head.UncompressedSize(), from: from})
+			}
+			return true, nil
+		})
+	}
+
+	if total <= i.cfg.MaxMemoryChunks {
+		return
+	}
+	excess := len(candidates) - i.cfg.MaxMemoryChunks
+	if excess <= 0 {
+		return
 	}
+
+	var selected []pressureCandidate
+	if i.cfg.MemoryPressureFlushOrder == pressureFlushOrderOldest {
+		// Only the oldest chunks are needed, no need to sort all of them.
+		h := oldestChunksHeap(candidates)
+		heap.Init(&h)
+		for len(selected) < excess {
+			selected = append(selected, heap.Pop(&h).(pressureCandidate))
+		}
+	} else {
+		sort.Slice(candidates, func(a, b int) bool {
+			return candidates[a].size > candidates[b].size
+		})
+		selected = candidates[:excess]
+	}
+
+	var closed int
+	for _, c := range selected {
+		c.stream.chunkMtx.Lock()
+		if n := len(c.stream.chunks); n > 0 {
+			if head := &c.stream.chunks[n-1]; !head.closed {
+				head.closed = true
+				head.pressure = true
+				closed++
+			}
+		}
+		c.stream.chunkMtx.Unlock()
+	}
+	level.Warn(util_log.Logger).Log("msg", "too many chunks in memory, flushing streams", "order", i.pressureFlushOrder(), "chunks", total, "limit", i.cfg.MaxMemoryChunks, "closed", closed)
+}
+
+func (i *Ingester) pressureFlushOrder() string {
+	if i.cfg.MemoryPressureFlushOrder == "" {
+		return pressureFlushOrderBiggest
+	}
+	return i.cfg.MemoryPressureFlushOrder
 }
 
 func (i *Ingester) sweepInstance(instance *instance, immediate, mayRemoveStreams bool) {
+	if i.cfg.PerTenantFlushLag {
+		flushLagPerTenant.WithLabelValues(instance.instanceID).Set(flushLag(instance, time.Now()).Seconds())
+	}
+	if !immediate && i.overTenantMemoryLimit(instance) {
+		immediate = true
+	}
 	_ = instance.streams.ForEach(func(s *stream) (bool, error) {
 		i.sweepStream(instance, s, immediate)
 		i.removeFlushedChunks(instance, s, mayRemoveStreams)
@@ -183,6 +791,10 @@ func (i *Ingester) sweepInstance(instance *instance, immediate, mayRemoveStreams
 }
 
 func (i *Ingester) sweepStream(instance *instance, stream *stream, immediate bool) {
+	if i.cfg.ReadOnly {
+		return
+	}
+
 	stream.chunkMtx.RLock()
 	defer stream.chunkMtx.RUnlock()
 	if len(stream.chunks) == 0 {
@@ -190,77 +802,221 @@ func (i *Ingester) sweepStream(instance *instance, stream *stream, immediate boo
 	}
 
 	lastChunk := stream.chunks[len(stream.chunks)-1]
-	shouldFlush, _ := i.shouldFlushChunk(&lastChunk)
+	shouldFlush, _ := i.shouldFlushChunk(instance.instanceID, &lastChunk)
 	if len(stream.chunks) == 1 && !immediate && !shouldFlush {
 		return
 	}
+	if !immediate && !i.flushPacer.allow() {
+		return
+	}
 
-	flushQueueIndex := int(uint64(stream.fp) % uint64(i.cfg.ConcurrentFlushes))
 	firstTime, _ := stream.chunks[0].chunk.Bounds()
-	i.flushQueues[flushQueueIndex].Enqueue(&flushOp{
-		model.TimeFromUnixNano(firstTime.UnixNano()), instance.instanceID,
-		stream.fp, immediate,
-	})
+	op := &flushOp{
+		from:      model.TimeFromUnixNano(firstTime.UnixNano()),
+		userID:    instance.instanceID,
+		fp:        stream.fp,
+		immediate: immediate,
+	}
+	if immediate {
+		op.priorityClass = i.flushPriorityClass(instance.instanceID)
+	}
+	i.enqueueFlushOp(op)
+}
+
+// flushQueueIndex returns the flush queue of a stream, the one it was moved to by the last
+// rebalance if any, see rebalanceFlushQueues. flushQueuesMtx must be held.
+func (i *Ingester) flushQueueIndex(userID string, fp model.Fingerprint) int {
+	if j, ok := i.flushQueueOverrides[flushStreamKey{userID: userID, fp: fp}]; ok {
+		return j
+	}
+	return i.schedulerQueueIndex(fp, len(i.flushQueues))
+}
+
+// flushQueueIndex spreads the fingerprints over n flush queues. The fingerprint modulo n is skewed
+// when the fingerprints cluster, hashing the fingerprint first spreads them evenly.
+func flushQueueIndex(hash string, fp model.Fingerprint, n int) int {
+	h := uint64(fp)
+	if hash == flushQueueHashXXHash {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(fp))
+		h = xxhash.Sum64(buf[:])
+	}
+	return int(h % uint64(n))
 }
 
-func (i *Ingester) flushLoop(j int) {
+func (i *Ingester) flushLoop(j int, queue *util.PriorityQueue, stats *flushQueueStats) {
+	i.flushWorkers.Inc()
 	defer func() {
 		level.Debug(util_log.Logger).Log("msg", "Ingester.flushLoop() exited")
+		i.forgetRemovedFlushQueue(j)
+		i.flushWorkers.Dec()
 		i.flushQueuesDone.Done()
 	}()
 
+	if i.cfg.FlushWorkerCPUAffinity {
+		if cpu, err := pinFlushWorker(j); err != nil {
+			level.Warn(util_log.Logger).Log("msg", "failed to pin flush loop to a CPU", "queue", j, "err", err)
+		} else {
+			level.Debug(util_log.Logger).Log("msg", "pinned flush loop to a CPU", "queue", j, "cpu", cpu)
+		}
+	}
+
 	for {
-		o := i.flushQueues[j].Dequeue()
+		// The operations stay queued while flushing is paused. An operation dequeued before the pause
+		// waits for the resume too, its context is only created when it runs, so it doesn't time out.
+		i.flushPause.wait()
+		o := queue.Dequeue()
 		if o == nil {
 			return
 		}
+		i.flushPause.wait()
 		op := o.(*flushOp)
+		if i.flushFair != nil {
+			i.flushFair.serve(op)
+		}
 
 		level.Debug(util_log.Logger).Log("msg", "flushing stream", "userid", op.userID, "fp", op.fp, "immediate", op.immediate)
 
-		err := i.flushUserSeries(op.userID, op.fp, op.immediate)
+		op.attempts++
+		now := time.Now()
+		stats.start(now)
+		err := i.runFlushOp(op)
+		now = time.Now()
+		stats.done(now, err)
 		if err != nil {
 			level.Error(util_log.WithUserID(op.userID, util_log.Logger)).Log("msg", "failed to flush user", "err", err)
+		} else {
+			i.metrics.flushLastSuccess.WithLabelValues(strconv.Itoa(j)).Set(float64(now.Unix()))
+		}
+		if i.cfg.OnFlushResult != nil {
+			i.cfg.OnFlushResult(op.userID, err)
 		}
 
 		// If we're exiting & we failed to flush, put the failed operation
-		// back in the queue at a later point.
-		if op.immediate && err != nil {
+		// back in the queue at a later point, unless the flushes got cancelled
+		// or it panicked, as it would likely panic again.
+		if op.immediate && err != nil && i.flushCtx.Err() == nil && !errors.Is(err, errFlushPanic) {
 			op.from = op.from.Add(flushBackoff)
-			i.flushQueues[j].Enqueue(op)
+			if i.requeueFlushOp(op, queue) {
+				continue
+			}
 		}
+		// The operation either succeeded or is dropped, to be rescheduled by a later sweep.
+		i.metrics.flushAttempts.Observe(float64(op.attempts))
 	}
 }
 
+// requeueFlushOp puts a failed immediate flush operation back in the flush queue it came from. If
+// the queue got removed by a flush concurrency change meanwhile, the operation goes to the current
+// queue of its stream instead, as the removed queue is closed once its loop drained it. It returns
+// false if the operation is dropped because all the flush queues are closed, to be rescheduled by
+// a later sweep.
+func (i *Ingester) requeueFlushOp(op *flushOp, from *util.PriorityQueue) bool {
+	i.flushQueuesMtx.RLock()
+	defer i.flushQueuesMtx.RUnlock()
+
+	for _, queue := range i.flushQueues {
+		if queue == from {
+			i.enqueueFlushOpIn(queue, op)
+			return true
+		}
+	}
+	if i.flushQueuesClosed {
+		return false
+	}
+	i.enqueueFlushOpIn(i.flushQueues[i.flushQueueIndex(op.userID, op.fp)], op)
+	return true
+}
+
+var errFlushPanic = errors.New("flush panicked")
+
+// runFlushOp runs a flush operation, recovering from a panic so that it doesn't take the ingester down.
+func (i *Ingester) runFlushOp(op *flushOp) (err error) {
+	defer i.recoverFlushPanic(&err, util_log.WithUserID(op.userID, util_log.Logger), "fp", op.fp, "immediate", op.immediate, "attempts", op.attempts)
+	return i.flushUserSeriesBefore(op.userID, op.fp, op.immediate, op.cutoff)
+}
+
+// recoverFlushPanic is deferred to recover from a panic of a flush, e.g. in the store client,
+// setting err to an errFlushPanic error instead of taking the ingester down.
+func (i *Ingester) recoverFlushPanic(err *error, logger log.Logger, keyvals ...interface{}) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	i.metrics.flushPanics.Inc()
+	level.Error(logger).Log(append([]interface{}{"msg", "flush panicked", "panic", p, "stack", string(debug.Stack())}, keyvals...)...)
+	*err = fmt.Errorf("%w: %v", errFlushPanic, p)
+}
+
 func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediate bool) error {
+	return i.flushUserSeriesBefore(userID, fp, immediate, time.Time{})
+}
+
+// flushUserSeriesBefore flushes the chunks of a stream like flushUserSeries, and also the chunks
+// whose newest data is older than the cutoff, unless it is zero.
+func (i *Ingester) flushUserSeriesBefore(userID string, fp model.Fingerprint, immediate bool, cutoff time.Time) error {
 	instance, ok := i.getInstanceByID(userID)
 	if !ok {
 		return nil
 	}
 
-	chunks, labels, chunkMtx := i.collectChunksToFlush(instance, fp, immediate)
+	chunks, stream := i.collectChunksToFlush(instance, fp, immediate, cutoff)
 	if len(chunks) < 1 {
 		return nil
 	}
 
-	ctx := user.InjectOrgID(context.Background(), userID)
-	ctx, cancel := context.WithTimeout(ctx, i.cfg.FlushOpTimeout)
-	defer cancel()
-	err := i.flushChunks(ctx, fp, labels, chunks, chunkMtx)
+	stream.chunkMtx.RLock()
+	pushSpan := stream.lastPushSpan
+	stream.chunkMtx.RUnlock()
+	sp, ctx := i.startFlushUserSeriesSpan(i.flushCtx, userID, fp, len(chunks), pushSpan)
+	defer sp.Finish()
+
+	err := i.flushChunksWithRetries(ctx, userID, fp, stream.labels, chunks, &stream.chunkMtx)
+	if err != nil {
+		ext.Error.Set(sp, true)
+		sp.LogFields(otlog.Error(err))
+	}
+
+	// Even partially failed flushes stored some chunks.
+	stream.chunkMtx.Lock()
+	for _, c := range chunks {
+		if c.flushed.After(stream.lastFlushed) {
+			stream.lastFlushed = c.flushed
+		}
+	}
+	stream.chunkMtx.Unlock()
+
 	if err != nil {
+		stream.chunkMtx.RLock()
+		dlErr := i.deadLetters.Record(userID, fp, stream.labels, pendingChunks(chunks), err)
+		stream.chunkMtx.RUnlock()
+		if dlErr != nil {
+			level.Error(util_log.WithUserID(userID, util_log.Logger)).Log("msg", "failed to write flush dead-letter record", "err", dlErr)
+		}
 		return err
 	}
 
 	return nil
 }
 
-func (i *Ingester) collectChunksToFlush(instance *instance, fp model.Fingerprint, immediate bool) ([]*chunkDesc, labels.Labels, *sync.RWMutex) {
+// pendingChunks returns the chunks which haven't been flushed, e.g. after a partially failed flush.
+func pendingChunks(cs []*chunkDesc) []*chunkDesc {
+	var result []*chunkDesc
+	for _, c := range cs {
+		if c.flushed.IsZero() {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func (i *Ingester) collectChunksToFlush(instance *instance, fp model.Fingerprint, immediate bool, cutoff time.Time) ([]*chunkDesc, *stream) {
 	var stream *stream
 	var ok bool
 	stream, ok = instance.streams.LoadByFP(fp)
 
 	if !ok {
-		return nil, nil, nil
+		return nil, nil
 	}
 
 	stream.chunkMtx.Lock()
@@ -268,46 +1024,160 @@ func (i *Ingester) collectChunksToFlush(instance *instance, fp model.Fingerprint
 
 	var result []*chunkDesc
 	for j := range stream.chunks {
-		shouldFlush, reason := i.shouldFlushChunk(&stream.chunks[j])
+		shouldFlush, reason := i.shouldFlushChunk(instance.instanceID, &stream.chunks[j])
+		if !shouldFlush && !cutoff.IsZero() {
+			if _, through := stream.chunks[j].chunk.Bounds(); through.Before(cutoff) {
+				shouldFlush, reason = true, flushReasonCutoff
+			}
+		}
 		if immediate || shouldFlush {
 			// Ensure no more writes happen to this chunk.
 			if !stream.chunks[j].closed {
 				stream.chunks[j].closed = true
 			}
 			// Flush this chunk if it hasn't already been successfully flushed.
-			if stream.chunks[j].flushed.IsZero() {
-				result = append(result, &stream.chunks[j])
-				if immediate {
-					reason = flushReasonForced
-				}
-				chunksFlushedPerReason.WithLabelValues(reason).Add(1)
+			if !stream.chunks[j].flushed.IsZero() {
+				i.skipChunkFlush(instance.instanceID, fp, flushSkipAlreadyFlushed)
+				continue
+			}
+			// Empty chunks hold nothing to store, they are released from memory instead.
+			if stream.chunks[j].chunk.Size() == 0 {
+				stream.chunks[j].flushed = time.Now()
+				i.skipChunkFlush(instance.instanceID, fp, flushSkipEmpty)
+				continue
 			}
+			result = append(result, &stream.chunks[j])
+			if immediate {
+				reason = flushReasonForced
+			}
+			chunksFlushedPerReason.WithLabelValues(reason).Add(1)
+			i.countFlushReason(reason)
+			stream.chunks[j].flushReason = reason
 		}
 	}
-	return result, stream.labels, &stream.chunkMtx
+	return result, stream
 }
 
-func (i *Ingester) shouldFlushChunk(chunk *chunkDesc) (bool, string) {
-	// Append should close the chunk when the a new one is added.
-	if chunk.closed {
-		if chunk.synced {
-			return true, flushReasonSynced
-		}
-		return true, flushReasonFull
+const (
+	flushSkipAlreadyFlushed = "already_flushed"
+	flushSkipEmpty          = "empty"
+)
+
+// skipChunkFlush accounts for a chunk due for flushing which isn't flushed: either it was
+// already flushed and is only retained in memory, or it's closed but holds no entries.
+func (i *Ingester) skipChunkFlush(userID string, fp model.Fingerprint, reason string) {
+	chunksFlushSkipped.WithLabelValues(reason).Inc()
+	level.Debug(util_log.WithUserID(userID, util_log.Logger)).Log("msg", "skipped chunk flush", "fp", fp, "reason", reason)
+}
+
+// shouldFlushChunk reports whether the chunk should be flushed, and why, as decided by the flush scheduler.
+func (i *Ingester) shouldFlushChunk(userID string, chunk *chunkDesc) (bool, string) {
+	return i.scheduler().ShouldFlush(userID, FlushChunk{desc: chunk})
+}
+
+// deferIdleFlush reports whether the idle flush of a chunk is deferred because it's still under the
+// target size and compresses poorly, so that it can still grow. The flush isn't deferred any more
+// once the chunk hasn't been written to for the max chunk age.
+func (i *Ingester) deferIdleFlush(userID string, chunk *chunkDesc) bool {
+	if i.cfg.IdleFlushMinCompressionRatio <= 0 || time.Since(chunk.lastUpdated) > i.maxChunkAge(userID) {
+		return false
 	}
+	compressed := chunk.chunk.CompressedSize()
+	if compressed == 0 || (i.cfg.TargetChunkSize > 0 && compressed >= i.cfg.TargetChunkSize) {
+		return false
+	}
+	return float64(chunk.chunk.UncompressedSize())/float64(compressed) < i.cfg.IdleFlushMinCompressionRatio
+}
 
-	if time.Since(chunk.lastUpdated) > i.cfg.MaxChunkIdle {
-		return true, flushReasonIdle
+// limits returns the per tenant overrides, or the default limits when the ingester has none.
+// Every flush setting is read through it, so that a runtime reload of the overrides applies on the next sweep.
+func (i *Ingester) limits() *validation.Overrides {
+	if i.limiter == nil {
+		return overridesOrDefaults(nil)
 	}
+	return overridesOrDefaults(i.limiter.limits)
+}
+
+// flushPriorityClass returns the priority class of the tenant when flushing all the in-memory chunks.
+func (i *Ingester) flushPriorityClass(userID string) int {
+	return i.scheduler().Priority(userID)
+}
 
-	if from, to := chunk.chunk.Bounds(); to.Sub(from) > i.cfg.MaxChunkAge {
-		return true, flushReasonMaxAge
+// maxChunkIdle returns how long the chunks of the tenant may stay idle before being flushed.
+func (i *Ingester) maxChunkIdle(userID string) time.Duration {
+	if d := i.limits().ChunkIdlePeriod(userID); d > 0 {
+		return d
 	}
+	return i.cfg.MaxChunkIdle
+}
 
-	return false, ""
+// maxChunkAge returns the maximum age of the chunks of the tenant before being flushed.
+func (i *Ingester) maxChunkAge(userID string) time.Duration {
+	if d := i.limits().MaxChunkAge(userID); d > 0 {
+		return d
+	}
+	return i.cfg.MaxChunkAge
+}
+
+// flushLag returns the age of the newest data of the oldest unflushed chunk of the tenant, i.e. how
+// much data would be lost with the ingester, 0 if everything is flushed.
+func flushLag(instance *instance, now time.Time) time.Duration {
+	var oldestFrom, oldestThrough time.Time
+	_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+		s.chunkMtx.RLock()
+		defer s.chunkMtx.RUnlock()
+		// The chunks of a stream are in order, only the first unflushed one matters.
+		for _, c := range s.chunks {
+			if !c.flushed.IsZero() || c.chunk.Size() == 0 {
+				continue
+			}
+			if from, through := c.chunk.Bounds(); oldestFrom.IsZero() || from.Before(oldestFrom) {
+				oldestFrom, oldestThrough = from, through
+			}
+			break
+		}
+		return true, nil
+	})
+	if oldestThrough.IsZero() || now.Before(oldestThrough) {
+		return 0
+	}
+	return now.Sub(oldestThrough)
+}
+
+// overTenantMemoryLimit returns whether the tenant holds more unflushed bytes in memory than its
+// MaxTenantMemoryBytes limit, in which case all its streams are flushed to cap its footprint.
+func (i *Ingester) overTenantMemoryLimit(instance *instance) bool {
+	limit := i.limits().MaxTenantMemoryBytes(instance.instanceID)
+	if limit <= 0 {
+		return false
+	}
+	unflushed := instance.updateUnflushedBytes()
+	if unflushed <= limit {
+		return false
+	}
+	level.Warn(util_log.WithUserID(instance.instanceID, util_log.Logger)).Log("msg", "tenant over its memory limit, flushing all its streams", "bytes", unflushed, "limit", limit)
+	return true
+}
+
+// retainPeriod returns how long the flushed chunks of the tenant are kept in memory.
+func (i *Ingester) retainPeriod(userID string) time.Duration {
+	// The retain period is ignored during WAL replay, see starting.
+	if i.limiter != nil && i.limiter.Disabled() {
+		return 0
+	}
+	if d := i.limits().ChunkRetainPeriod(userID); d > 0 {
+		return d
+	}
+	return i.cfg.RetainPeriod
 }
 
 func (i *Ingester) removeFlushedChunks(instance *instance, stream *stream, mayRemoveStream bool) {
+	i.removeFlushedChunksRetained(instance, stream, mayRemoveStream, i.retainPeriod(instance.instanceID))
+}
+
+// removeFlushedChunksRetained removes the chunks of a stream flushed for longer than the retain
+// period, and returns how many were removed.
+func (i *Ingester) removeFlushedChunksRetained(instance *instance, stream *stream, mayRemoveStream bool, retainPeriod time.Duration) int {
 	now := time.Now()
 
 	stream.chunkMtx.Lock()
@@ -315,15 +1185,17 @@ func (i *Ingester) removeFlushedChunks(instance *instance, stream *stream, mayRe
 	prevNumChunks := len(stream.chunks)
 	var subtracted int
 	for len(stream.chunks) > 0 {
-		if stream.chunks[0].flushed.IsZero() || now.Sub(stream.chunks[0].flushed) < i.cfg.RetainPeriod {
+		if stream.chunks[0].flushed.IsZero() || now.Sub(stream.chunks[0].flushed) < retainPeriod {
 			break
 		}
 
 		subtracted += stream.chunks[0].chunk.UncompressedSize()
 		stream.chunks[0].chunk = nil // erase reference so the chunk can be garbage-collected
 		stream.chunks = stream.chunks[1:]
+		chunksGarbageCollected.Inc()
 	}
-	memoryChunks.Sub(float64(prevNumChunks - len(stream.chunks)))
+	removed := prevNumChunks - len(stream.chunks)
+	memoryChunks.Sub(float64(removed))
 
 	// Signal how much data has been flushed to lessen any WAL replay pressure.
 	i.replayController.Sub(int64(subtracted))
@@ -331,75 +1203,296 @@ func (i *Ingester) removeFlushedChunks(instance *instance, stream *stream, mayRe
 	if mayRemoveStream && len(stream.chunks) == 0 {
 		// Unlock first, then lock inside streams' lock to prevent deadlock
 		stream.chunkMtx.Unlock()
+		if i.beforeStreamRemoval != nil {
+			i.beforeStreamRemoval(stream)
+		}
 		// Only lock streamsMap when it's needed to remove a stream
 		instance.streams.WithLock(func() {
 			stream.chunkMtx.Lock()
-			// Double check length
-			if len(stream.chunks) == 0 {
-				instance.removeStream(stream)
+			// A write may have added chunks while the stream was unlocked, it must then stay.
+			// Writes lock the stream under the streams' lock, so none can race with the removal.
+			if len(stream.chunks) > 0 {
+				return
 			}
+			instance.removeStream(stream)
 		})
 	}
+	return removed
 }
 
-func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, labelPairs labels.Labels, cs []*chunkDesc, chunkMtx sync.Locker) error {
-	userID, err := tenant.TenantID(ctx)
-	if err != nil {
-		return err
+// flushChunksWithRetries flushes the chunks of a stream, retrying the ones not stored yet up to
+// FlushOpRetries times with a backoff, as long as the failures are retryable. Every attempt is
+// bounded by the flush op timeout. The chunks still not stored once the retries are exhausted are
+// written to the flush spool, if enabled.
+func (i *Ingester) flushChunksWithRetries(ctx context.Context, userID string, fp model.Fingerprint, labels labels.Labels, chunks []*chunkDesc, chunkMtx *sync.RWMutex) error {
+	var b *backoff.Backoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(ctx, i.cfg.FlushOpTimeout)
+		err := i.flushChunks(ctx, userID, fp, labels, chunks, chunkMtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= i.cfg.FlushOpRetries || !isRetryableFlushError(err) {
+			if i.spool != nil {
+				err = i.spoolChunks(userID, fp, labels, chunks, chunkMtx, err)
+			}
+			return err
+		}
+
+		if b == nil {
+			b = backoff.New(i.flushCtx, backoff.Config{
+				MinBackoff: i.cfg.FlushOpRetryMinBackoff,
+				MaxBackoff: i.cfg.FlushOpRetryMaxBackoff,
+			})
+		}
+		level.Warn(util_log.WithUserID(userID, util_log.Logger)).Log("msg", "retrying failed flush", "fp", fp, "attempt", attempt+1, "err", err)
+		b.Wait()
+		if i.flushCtx.Err() != nil {
+			return err
+		}
+
+		chunkMtx.RLock()
+		chunks = pendingChunks(chunks)
+		chunkMtx.RUnlock()
+		if len(chunks) == 0 {
+			return nil
+		}
 	}
+}
 
+// isRetryableFlushError tells whether a failed flush may succeed when retried. Cancelled flushes,
+// flushes short-circuited by the flush circuit breaker, panicking flushes and client errors
+// reported by the store, other than rate limiting, are permanent.
+func isRetryableFlushError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errFlushCircuitOpen) || errors.Is(err, errFlushPanic) {
+		return false
+	}
+	if resp, ok := httpgrpc.HTTPResponseFromError(err); ok {
+		return resp.Code/100 != 4 || resp.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// chunkMetric returns the labels of the stored chunks of a stream: its labels, which include the
+// extra flush labels, and the metric name.
+func (i *Ingester) chunkMetric(labelPairs labels.Labels) labels.Labels {
 	labelsBuilder := labels.NewBuilder(labelPairs)
 	labelsBuilder.Set(nameLabel, logsValue)
-	metric := labelsBuilder.Labels()
+	return labelsBuilder.Labels()
+}
+
+// withExtraFlushLabels returns the labels of a stream along with the extra flush labels which it
+// doesn't have, as the labels of a stream take precedence.
+func withExtraFlushLabels(ls labels.Labels, extra map[string]string) labels.Labels {
+	if len(extra) == 0 {
+		return ls
+	}
+	b := labels.NewBuilder(ls)
+	for name, value := range extra {
+		if !ls.Has(name) {
+			b.Set(name, value)
+		}
+	}
+	return b.Labels()
+}
+
+// applyFlushLabelLimits checks the labels of the chunks of a stream against the label limits of the
+// tenant according to the FlushLabelLimits policy. It returns the labels to store, possibly with
+// truncated values, and false if the chunks must be discarded.
+// Truncation only applies to the label values, chunks with too many labels or too long label names
+// are discarded.
+func (i *Ingester) applyFlushLabelLimits(userID string, metric labels.Labels) (labels.Labels, bool) {
+	policy := i.cfg.FlushLabelLimits
+	if policy == "" || policy == flushLabelLimitsIgnore {
+		return metric, true
+	}
+	limits := i.limits()
+	logger := util_log.WithUserID(userID, util_log.Logger)
+
+	reject := func(reason string) (labels.Labels, bool) {
+		flushLabelLimitViolations.WithLabelValues(reason, "rejected").Inc()
+		level.Warn(logger).Log("msg", "discarding chunks whose labels violate the label limits", "labels", metric, "reason", reason)
+		return nil, false
+	}
+
+	// The metric name isn't one of the stream labels.
+	if len(metric)-1 > limits.MaxLabelNamesPerSeries(userID) {
+		return reject(validation.MaxLabelNamesPerSeries)
+	}
+	maxValueLength := limits.MaxLabelValueLength(userID)
+	var truncated labels.Labels
+	for j, l := range metric {
+		if len(l.Name) > limits.MaxLabelNameLength(userID) {
+			return reject(validation.LabelNameTooLong)
+		}
+		if len(l.Value) <= maxValueLength {
+			continue
+		}
+		if policy == flushLabelLimitsReject {
+			return reject(validation.LabelValueTooLong)
+		}
+		if truncated == nil {
+			truncated = metric.Copy()
+		}
+		// Don't split a multi-byte rune.
+		n := maxValueLength
+		for n > 0 && !utf8.RuneStart(l.Value[n]) {
+			n--
+		}
+		truncated[j].Value = l.Value[:n]
+	}
+	if truncated == nil {
+		return metric, true
+	}
+	flushLabelLimitViolations.WithLabelValues(validation.LabelValueTooLong, "truncated").Inc()
+	level.Warn(logger).Log("msg", "truncating label values violating the label limits", "labels", metric)
+	return truncated, true
+}
+
+// encodeChunk builds and encodes the chunk stored for a closed in-memory chunk of a stream.
+func (i *Ingester) encodeChunk(userID string, fp model.Fingerprint, metric labels.Labels, c *chunkenc.MemChunk) (chunk.Chunk, error) {
+	firstTime, lastTime := loki_util.RoundToMilliseconds(c.Bounds())
+	ch := chunk.NewChunk(
+		userID, fp, metric,
+		chunkenc.NewFacade(c, i.cfg.BlockSize, i.cfg.TargetChunkSize),
+		firstTime,
+		lastTime,
+	)
+
+	chunkSize := c.BytesSize() + i.cfg.ChunkHeaderSizeEstimate
+	if err := ch.EncodeTo(bytes.NewBuffer(make([]byte, 0, chunkSize))); err != nil {
+		return chunk.Chunk{}, err
+	}
+	return ch, nil
+}
+
+// flushChunks stores the given chunks of the stream of a tenant. The tenant is injected in the
+// context passed to the store, so callers don't need to.
+func (i *Ingester) flushChunks(ctx context.Context, userID string, fp model.Fingerprint, labelPairs labels.Labels, cs []*chunkDesc, chunkMtx sync.Locker) (err error) {
+	ctx = user.InjectOrgID(ctx, userID)
+
+	logger := util_log.WithUserID(userID, util_log.Logger)
+	flushStart := time.Now()
+	numChunks := len(cs)
+	var storedChunks, storedBytes int
+	level.Debug(logger).Log("msg", "flushing chunks", "fp", fp, "chunks", numChunks)
+	defer func() {
+		level.Debug(logger).Log("msg", "flushed chunks", "fp", fp, "chunks", numChunks, "stored_chunks", storedChunks, "stored_bytes", storedBytes, "duration", time.Since(flushStart), "err", err)
+	}()
 
-	wireChunks := make([]chunk.Chunk, len(cs))
+	metric, ok := i.applyFlushLabelLimits(userID, i.chunkMetric(labelPairs))
+	if !ok {
+		// Queries would reject the chunks anyway, they are released from memory instead of being retried.
+		chunkMtx.Lock()
+		defer chunkMtx.Unlock()
+		for _, c := range cs {
+			c.flushed = time.Now()
+			chunksDiscardedOnLabelLimits.Inc()
+			chunkBytesDiscardedOnLabelLimits.Add(float64(c.chunk.UncompressedSize()))
+		}
+		return nil
+	}
+	wireChunks := make([]chunk.Chunk, 0, len(cs))
 
+	encodeSpan, _ := i.startFlushSpan(ctx, "encodeChunks")
 	// use anonymous function to make lock releasing simpler.
 	err = func() error {
 		chunkMtx.Lock()
 		defer chunkMtx.Unlock()
 
-		for j, c := range cs {
+		kept := make([]*chunkDesc, 0, len(cs))
+		for _, c := range cs {
 			// Ensure that new blocks are cut before flushing as data in the head block is not included otherwise.
-			if err := c.chunk.Close(); err != nil {
-				return err
+			if err := i.closeChunk(c.chunk); err != nil {
+				if !i.discardUnclosableChunk(userID, fp, labelPairs, c, err) {
+					return err
+				}
+				continue
 			}
-			firstTime, lastTime := loki_util.RoundToMilliseconds(c.chunk.Bounds())
-			ch := chunk.NewChunk(
-				userID, fp, metric,
-				chunkenc.NewFacade(c.chunk, i.cfg.BlockSize, i.cfg.TargetChunkSize),
-				firstTime,
-				lastTime,
-			)
-
-			chunkSize := c.chunk.BytesSize() + 4*1024 // size + 4kB should be enough room for cortex header
 			start := time.Now()
-			if err := ch.EncodeTo(bytes.NewBuffer(make([]byte, 0, chunkSize))); err != nil {
+			ch, err := i.encodeChunk(userID, fp, metric, c.chunk)
+			if err != nil {
 				return err
 			}
 			chunkEncodeTime.Observe(time.Since(start).Seconds())
-			wireChunks[j] = ch
+			if err := i.checkChunkSchema(ch.From); err != nil {
+				i.discardChunkOutsideSchema(userID, fp, labelPairs, c, err)
+				continue
+			}
+			wireChunks = append(wireChunks, ch)
+			kept = append(kept, c)
 		}
+		cs = kept
 		return nil
 	}()
+	encodeSpan.SetTag("chunks", len(wireChunks))
+	encodeSpan.SetTag("bytes", encodedSize(wireChunks))
+	encodeSpan.Finish()
 
 	if err != nil {
 		return err
 	}
+	if len(wireChunks) == 0 {
+		return nil
+	}
+	flushBatchChunks.Observe(float64(len(wireChunks)))
 
-	if err := i.store.Put(ctx, wireChunks); err != nil {
-		return err
+	// The chunks stored before a failure, e.g. when the flush op timeout expires midway, are still
+	// marked as flushed so that only the remaining ones are retried, see putChunks.
+	putSpan, putCtx := i.startFlushSpan(ctx, "putChunks")
+	stored, refs, putErr := i.putChunks(putCtx, wireChunks)
+	putSpan.SetTag("chunks", len(wireChunks))
+	putSpan.SetTag("bytes", encodedSize(wireChunks))
+	if putErr != nil {
+		ext.Error.Set(putSpan, true)
+		putSpan.LogFields(otlog.Error(putErr))
+	}
+	putSpan.Finish()
+	if i.cfg.OnFlushReceipts != nil {
+		if receipts := i.flushReceipts(userID, fp, wireChunks, refs, stored); len(receipts) > 0 {
+			i.cfg.OnFlushReceipts(receipts)
+		}
 	}
-	flushedChunksStats.Inc(int64(len(wireChunks)))
+	var numStored int
+	for _, ok := range stored {
+		if ok {
+			numStored++
+		}
+	}
+	storedChunks = numStored
+	if numStored == 0 {
+		return putErr
+	}
+	flushedChunksStats.Inc(int64(numStored))
 
-	// Record statistics only when actual put request did not return error.
-	sizePerTenant := chunkSizePerTenant.WithLabelValues(userID)
-	countPerTenant := chunksPerTenant.WithLabelValues(userID)
+	// Record statistics only for the chunks actually stored.
+	// Per tenant statistics are skipped for tenants, e.g. synthetic ones, which shouldn't show up in them.
+	var (
+		sizePerTenant, countPerTenant prometheus.Counter
+		utilizationPerTenant          prometheus.Observer
+	)
+	if !i.limits().SkipFlushMetrics(userID) {
+		sizePerTenant = chunkSizePerTenant.WithLabelValues(userID)
+		countPerTenant = chunksPerTenant.WithLabelValues(userID)
+		// Opt-in, as it adds a histogram per tenant.
+		if i.cfg.PerTenantChunkUtilization {
+			utilizationPerTenant = chunkUtilizationPerTenant.WithLabelValues(userID)
+		}
+	}
+
+	undersizedUtilization := i.cfg.UndersizedChunkUtilization
+	chunkBackend := i.chunkBackend
+	flushEvents := i.flushEvents
+	var events []FlushEvent
 
 	chunkMtx.Lock()
 	defer chunkMtx.Unlock()
 
 	for i, wc := range wireChunks {
+		if !stored[i] {
+			continue
+		}
 
 		// flush successful, write while we have lock
 		cs[i].flushed = time.Now()
@@ -411,6 +1504,7 @@ func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, labelP
 		}
 
 		compressedSize := float64(len(byt))
+		storedBytes += len(byt)
 		uncompressedSize, ok := chunkenc.UncompressedSize(wc.Data)
 
 		if ok && compressedSize > 0 {
@@ -419,10 +1513,29 @@ func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, labelP
 
 		utilization := wc.Data.Utilization()
 		chunkUtilization.Observe(utilization)
+		if utilizationPerTenant != nil {
+			utilizationPerTenant.Observe(utilization)
+		}
+		if utilization < undersizedUtilization {
+			// Likely flushed prematurely, e.g. because of a too short idle period.
+			undersizedChunks.WithLabelValues(cs[i].flushReason).Inc()
+			level.Debug(util_log.WithUserID(userID, util_log.Logger)).Log("msg", "flushed undersized chunk", "fp", fp, "reason", cs[i].flushReason, "utilization", utilization, "compressed_bytes", compressedSize)
+		}
 		chunkEntries.Observe(float64(numEntries))
 		chunkSize.Observe(compressedSize)
-		sizePerTenant.Add(compressedSize)
-		countPerTenant.Inc()
+		if reason := cs[i].flushReason; reason != "" {
+			chunkBytesFlushedPerReason.WithLabelValues(reason).Add(compressedSize)
+			if stats, ok := flushedChunksBytesPerReasonStats[reason]; ok {
+				stats.Record(compressedSize)
+			}
+		}
+		if sizePerTenant != nil {
+			sizePerTenant.Add(compressedSize)
+			countPerTenant.Inc()
+		}
+		backend := chunkBackend(wc.From)
+		chunksPerBackend.WithLabelValues(backend).Inc()
+		chunkSizePerBackend.WithLabelValues(backend).Add(compressedSize)
 		firstTime, lastTime := cs[i].chunk.Bounds()
 		chunkAge.Observe(time.Since(firstTime).Seconds())
 		chunkLifespan.Observe(lastTime.Sub(firstTime).Hours())
@@ -432,7 +1545,252 @@ func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, labelP
 		flushedChunksUtilizationStats.Record(utilization)
 		flushedChunksAgeStats.Record(time.Since(firstTime).Seconds())
 		flushedChunksLifespanStats.Record(lastTime.Sub(firstTime).Hours())
+
+		if flushEvents != nil {
+			events = addFlushEvent(events, userID, fp, cs[i].flushReason, len(byt))
+		}
+	}
+
+	for _, event := range events {
+		flushEvents.publish(event)
+	}
+	return putErr
+}
+
+// addFlushEvent accounts for a stored chunk in the event of its flush reason.
+func addFlushEvent(events []FlushEvent, userID string, fp model.Fingerprint, reason string, bytes int) []FlushEvent {
+	for j := range events {
+		if events[j].Reason == reason {
+			events[j].Chunks++
+			events[j].Bytes += bytes
+			return events
+		}
 	}
+	return append(events, FlushEvent{Tenant: userID, Fingerprint: fp, Reason: reason, Chunks: 1, Bytes: bytes})
+}
+
+// chunkBackend returns the object store receiving a chunk starting at the given time, following
+// the schema period of the chunk.
+func (i *Ingester) chunkBackend(from model.Time) string {
+	period, err := config.SchemaConfig{Configs: i.periodicConfigs}.SchemaForTime(from)
+	if err != nil {
+		return "unknown"
+	}
+	if period.ObjectType != "" {
+		return period.ObjectType
+	}
+	return period.IndexType
+}
+
+var errChunkOutsideSchema = errors.New("chunk outside of the configured schema periods")
 
+// checkChunkSchema returns an error if a chunk starting at from falls outside of the schema periods,
+// as the store couldn't route it. Checking the start is enough, as the last period has no end.
+// Stores without schema periods accept any chunk.
+func (i *Ingester) checkChunkSchema(from model.Time) error {
+	if len(i.periodicConfigs) == 0 {
+		return nil
+	}
+	_, err := config.SchemaConfig{Configs: i.periodicConfigs}.SchemaForTime(from)
+	return err
+}
+
+// discardChunkOutsideSchema releases a chunk which the store would never accept, recording it in the
+// flush dead-letter log if configured. It is marked as flushed, so that it is discarded once instead
+// of failing every flush of its stream.
+func (i *Ingester) discardChunkOutsideSchema(userID string, fp model.Fingerprint, lbs labels.Labels, c *chunkDesc, schemaErr error) {
+	logger := util_log.WithUserID(userID, util_log.Logger)
+	err := fmt.Errorf("%w: %v", errChunkOutsideSchema, schemaErr)
+	if dlErr := i.deadLetters.Record(userID, fp, lbs, []*chunkDesc{c}, err); dlErr != nil {
+		level.Error(logger).Log("msg", "failed to write flush dead-letter record", "err", dlErr)
+	}
+	from, through := c.chunk.Bounds()
+	level.Warn(logger).Log("msg", "discarding chunk outside of the schema periods", "fp", fp, "from", from.UTC(), "through", through.UTC(), "err", schemaErr)
+	chunksOutsideSchema.Inc()
+	c.flushed = time.Now()
+}
+
+// discardUnclosableChunk applies the OnChunkCloseError policy to a chunk which failed to be closed,
+// and reports whether the chunk got discarded. Discarded chunks are marked as flushed, so that they
+// are released from memory instead of failing every flush of their stream.
+func (i *Ingester) discardUnclosableChunk(userID string, fp model.Fingerprint, lbs labels.Labels, c *chunkDesc, closeErr error) bool {
+	logger := util_log.WithUserID(userID, util_log.Logger)
+	switch i.cfg.OnChunkCloseError {
+	case chunkCloseErrorDrop:
+	case chunkCloseErrorQuarantine:
+		if err := i.deadLetters.Record(userID, fp, lbs, []*chunkDesc{c}, closeErr); err != nil {
+			level.Error(logger).Log("msg", "failed to quarantine chunk", "fp", fp, "err", err)
+			return false
+		}
+	default:
+		return false
+	}
+
+	level.Warn(logger).Log("msg", "discarding chunk which failed to be closed", "fp", fp, "policy", i.cfg.OnChunkCloseError, "err", closeErr)
+	chunksDiscardedOnCloseError.WithLabelValues(i.cfg.OnChunkCloseError).Inc()
+	c.flushed = time.Now()
+	return true
+}
+
+// spoolChunks writes the chunks of a stream which failed to be stored, even after the retries, to
+// the flush spool, marking them as flushed if it succeeds so that they are released from memory.
+// It returns the error to report for the flush.
+func (i *Ingester) spoolChunks(userID string, fp model.Fingerprint, labelPairs labels.Labels, cs []*chunkDesc, chunkMtx sync.Locker, flushErr error) error {
+	metric, ok := i.applyFlushLabelLimits(userID, i.chunkMetric(labelPairs))
+	if !ok {
+		return flushErr
+	}
+
+	chunkMtx.Lock()
+	defer chunkMtx.Unlock()
+
+	pending := pendingChunks(cs)
+	wireChunks := make([]chunk.Chunk, 0, len(pending))
+	for _, c := range pending {
+		if err := i.closeChunk(c.chunk); err != nil {
+			return flushErr
+		}
+		ch, err := i.encodeChunk(userID, fp, metric, c.chunk)
+		if err != nil {
+			return flushErr
+		}
+		wireChunks = append(wireChunks, ch)
+	}
+	if err := i.spool.Write(wireChunks); err != nil {
+		level.Warn(util_log.Logger).Log("msg", "failed to spool chunks which failed to flush", "user", userID, "chunks", len(wireChunks), "err", err)
+		return flushErr
+	}
+	level.Warn(util_log.Logger).Log("msg", "spooled chunks which failed to flush", "user", userID, "chunks", len(wireChunks), "err", flushErr)
+	now := time.Now()
+	for _, c := range pending {
+		c.flushed = now
+	}
 	return nil
 }
+
+// flushSpoolReplayLoop periodically replays the flush spool, see replayFlushSpool. It runs apart
+// from the sweeps, which a slow store would otherwise hold back.
+func (i *Ingester) flushSpoolReplayLoop() {
+	defer i.loopDone.Done()
+
+	ticker := time.NewTicker(i.cfg.FlushSpool.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			i.replayFlushSpool()
+		case <-i.loopQuit:
+			return
+		}
+	}
+}
+
+// replayFlushSpool puts the spooled chunks to the store, through the flush circuit breaker and
+// pacer like the flushes.
+func (i *Ingester) replayFlushSpool() {
+	ctx, cancel := context.WithTimeout(i.flushCtx, i.cfg.FlushOpTimeout)
+	defer cancel()
+	n, err := i.spool.Replay(ctx, i.timedPut, i.recordReplayedChunk)
+	if err != nil {
+		level.Warn(util_log.Logger).Log("msg", "failed to replay the flush spool", "replayed", n, "err", err)
+		return
+	}
+	if n > 0 {
+		level.Info(util_log.Logger).Log("msg", "replayed the flush spool", "replayed", n)
+	}
+}
+
+// recordReplayedChunk counts a spooled chunk as flushed once replayed to the store, as it isn't
+// when spooled.
+func (i *Ingester) recordReplayedChunk(userID string, c chunk.Chunk, size int) {
+	flushedChunksStats.Inc(1)
+	flushedChunksBytesStats.Record(float64(size))
+	if !i.limits().SkipFlushMetrics(userID) {
+		chunksPerTenant.WithLabelValues(userID).Inc()
+		chunkSizePerTenant.WithLabelValues(userID).Add(float64(size))
+	}
+	backend := i.chunkBackend(c.From)
+	chunksPerBackend.WithLabelValues(backend).Inc()
+	chunkSizePerBackend.WithLabelValues(backend).Add(float64(size))
+}
+
+// timedPut puts chunks to the store through the flush circuit breaker, feeding the latency to the
+// flush pacer.
+func (i *Ingester) timedPut(ctx context.Context, chunks []chunk.Chunk) error {
+	_, err := i.timedPutWithRefs(ctx, chunks)
+	return err
+}
+
+// timedPutWithRefs is timedPut also returning the object references of the chunks, see storePut.
+// A panicking put fails with errFlushPanic, and counts as a failure of the store.
+func (i *Ingester) timedPutWithRefs(ctx context.Context, chunks []chunk.Chunk) (refs []string, err error) {
+	if !i.flushBreaker.allow() {
+		return nil, errFlushCircuitOpen
+	}
+	start := time.Now()
+	defer func() {
+		i.flushPacer.observe(time.Since(start))
+		i.flushBreaker.done(err)
+	}()
+	defer i.recoverFlushPanic(&err, util_log.Logger, "chunks", len(chunks))
+	return i.storePut(ctx, chunks)
+}
+
+// putChunks writes the chunks to the store and reports which ones got stored along with their
+// object references, see storePut.
+// The chunks are written one per request, with at most StorePutConcurrency requests in flight at
+// once, so that the chunks stored before a failure, e.g. when the flush op timeout expires, stay
+// stored.
+// With a flush batching window, the chunks are put along with the ones of other streams instead,
+// see flushBatcher.
+func (i *Ingester) putChunks(ctx context.Context, chunks []chunk.Chunk) ([]bool, []string, error) {
+	if i.flushBatcher != nil {
+		return i.flushBatcher.add(ctx, chunks)
+	}
+
+	stored := make([]bool, len(chunks))
+	refs := make([]string, len(chunks))
+
+	put := func(ctx context.Context, j int) error {
+		r, err := i.timedPutWithRefs(ctx, chunks[j:j+1])
+		if err != nil {
+			return err
+		}
+		if len(r) > 0 {
+			refs[j] = r[0]
+		}
+		stored[j] = true
+		return nil
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	concurrency := i.cfg.StorePutConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	inFlight := make(chan struct{}, concurrency)
+schedule:
+	for j := range chunks {
+		select {
+		case inFlight <- struct{}{}:
+		case <-gctx.Done():
+			// A put failed, no need to schedule the remaining ones.
+			break schedule
+		}
+		if gctx.Err() != nil {
+			break schedule
+		}
+		j := j
+		g.Go(func() (err error) {
+			defer func() { <-inFlight }()
+			// Not covered by the recovery of the flush loop, which runs in another goroutine.
+			defer i.recoverFlushPanic(&err, util_log.Logger, "chunk", j)
+			return put(gctx, j)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return stored, refs, err
+	}
+	return stored, refs, ctx.Err()
+}
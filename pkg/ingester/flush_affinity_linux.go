@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package ingester
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// pinFlushWorker pins the calling goroutine to a CPU for the rest of its life, spreading the flush
+// loops round-robin over the first GOMAXPROCS CPUs the process may run on, and returns that CPU.
+// The goroutine stays locked to its OS thread, which is destroyed once the goroutine exits, so that
+// no other goroutine inherits the affinity.
+func pinFlushWorker(j int) (int, error) {
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &allowed); err != nil {
+		return 0, err
+	}
+	cpus := make([]int, 0, allowed.Count())
+	for cpu := 0; len(cpus) < allowed.Count() && len(cpus) < runtime.GOMAXPROCS(0); cpu++ {
+		if allowed.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	cpu := cpus[j%len(cpus)]
+
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(cpu)
+	// With pid 0, only the calling thread is pinned.
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		runtime.UnlockOSThread()
+		return 0, err
+	}
+	return cpu, nil
+}
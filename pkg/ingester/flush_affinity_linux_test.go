@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+package ingester
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestPinFlushWorker(t *testing.T) {
+	for j := 0; j < 2*runtime.GOMAXPROCS(0); j++ {
+		var (
+			cpu       int
+			pinErr    error
+			affinity  unix.CPUSet
+			getAffErr error
+		)
+		// Pin its own goroutine, whose thread is destroyed once it exits.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if cpu, pinErr = pinFlushWorker(j); pinErr == nil {
+				getAffErr = unix.SchedGetaffinity(0, &affinity)
+			}
+		}()
+		<-done
+
+		require.NoError(t, pinErr)
+		require.NoError(t, getAffErr)
+		require.Equal(t, 1, affinity.Count())
+		require.True(t, affinity.IsSet(cpu))
+	}
+}
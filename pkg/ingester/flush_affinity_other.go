@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package ingester
+
+import "errors"
+
+// pinFlushWorker is only supported on Linux.
+func pinFlushWorker(int) (int, error) {
+	return 0, errors.New("CPU affinity is not supported on this platform")
+}
@@ -0,0 +1,142 @@
+package ingester
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+// flushBatcher accumulates the chunks of the streams of a tenant flushed within a short window, to
+// put them to the store in a single request, e.g. for object stores with a per request overhead.
+// As every flush loop flushes one stream at a time and waits for its batch to be put, the batches
+// combine the streams flushed concurrently by the flush loops, at most one per loop.
+type flushBatcher struct {
+	window time.Duration
+	// Returns the max number of chunks of a batch, which may change with the flush concurrency.
+	maxChunks func() int
+	timeout   time.Duration
+	parent    context.Context
+	put       func(ctx context.Context, chunks []chunk.Chunk) ([]string, error)
+
+	mtx sync.Mutex
+	// The open batch of every tenant.
+	batches map[string]*flushBatch
+}
+
+type flushBatch struct {
+	userID string
+	chunks []chunk.Chunk
+	timer  *time.Timer
+
+	// Set before done is closed.
+	refs []string
+	err  error
+	done chan struct{}
+}
+
+func newFlushBatcher(parent context.Context, window time.Duration, maxChunks func() int, timeout time.Duration, put func(ctx context.Context, chunks []chunk.Chunk) ([]string, error)) *flushBatcher {
+	return &flushBatcher{
+		window:    window,
+		maxChunks: maxChunks,
+		timeout:   timeout,
+		parent:    parent,
+		put:       put,
+		batches:   map[string]*flushBatch{},
+	}
+}
+
+// add adds the chunks of a stream to the open batch of their tenant, opening one if needed, and
+// waits for the batch to be put. The batch is put once it holds the max number of chunks, or
+// when its window closes. Like putChunks, it reports which chunks got stored and their object
+// references.
+func (b *flushBatcher) add(ctx context.Context, chunks []chunk.Chunk) ([]bool, []string, error) {
+	stored, refs := make([]bool, len(chunks)), make([]string, len(chunks))
+	if len(chunks) == 0 {
+		return stored, refs, nil
+	}
+	userID := chunks[0].UserID
+
+	maxChunks := b.maxChunks()
+	b.mtx.Lock()
+	batch, ok := b.batches[userID]
+	if !ok {
+		batch = &flushBatch{userID: userID, done: make(chan struct{})}
+		b.batches[userID] = batch
+		batch.timer = time.AfterFunc(b.window, func() { b.close(batch) })
+	}
+	offset := len(batch.chunks)
+	batch.chunks = append(batch.chunks, chunks...)
+	full := len(batch.chunks) >= maxChunks
+	if full {
+		delete(b.batches, userID)
+		batch.timer.Stop()
+	}
+	b.mtx.Unlock()
+
+	if full {
+		b.do(batch)
+	}
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		// The chunks may still be stored by the batch, in which case they're flushed again.
+		return stored, refs, ctx.Err()
+	}
+	if batch.err != nil {
+		return stored, refs, batch.err
+	}
+	for j := range stored {
+		stored[j] = true
+	}
+	if len(batch.refs) == len(batch.chunks) {
+		copy(refs, batch.refs[offset:])
+	}
+	return stored, refs, nil
+}
+
+// close puts a batch when its window closes, unless it got full meanwhile.
+func (b *flushBatcher) close(batch *flushBatch) {
+	b.mtx.Lock()
+	open := b.batches[batch.userID] == batch
+	if open {
+		delete(b.batches, batch.userID)
+	}
+	b.mtx.Unlock()
+
+	if open {
+		b.do(batch)
+	}
+}
+
+// do puts a batch, from the flush loop which filled it or from the timer of its window. A panicking
+// put fails the batch with errFlushPanic rather than crashing the timer goroutine, and leaving the
+// flush loops waiting for it.
+func (b *flushBatcher) do(batch *flushBatch) {
+	ctx, cancel := context.WithTimeout(user.InjectOrgID(b.parent, batch.userID), b.timeout)
+	defer cancel()
+	defer close(batch.done)
+	defer func() {
+		if p := recover(); p != nil {
+			batch.refs, batch.err = nil, fmt.Errorf("%w: %v", errFlushPanic, p)
+		}
+	}()
+	batch.refs, batch.err = b.put(ctx, batch.chunks)
+}
+
+// flushBatchMaxChunks returns the max number of chunks of a flush batch, the number of running flush
+// loops unless configured.
+func (i *Ingester) flushBatchMaxChunks() int {
+	if i.cfg.FlushBatchMaxChunks > 0 {
+		return i.cfg.FlushBatchMaxChunks
+	}
+	if n := int(i.flushWorkers.Load()); n > 1 {
+		return n
+	}
+	return 1
+}
@@ -0,0 +1,124 @@
+package ingester
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+var errFlushCircuitOpen = errors.New("flush circuit breaker is open, the store is failing")
+
+type circuitState int
+
+// The values are exported by the loki_ingester_flush_circuit_breaker_state metric.
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// flushBreaker is a circuit breaker around the store puts. It opens after consecutive failed puts,
+// failing the following ones right away for a cooldown period instead of waiting for a down store.
+// It then lets a single probe put through: the breaker closes if it succeeds, and opens again
+// otherwise.
+// A nil *flushBreaker is valid and never opens.
+type flushBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+	metrics     *ingesterMetrics
+	now         func() time.Time
+
+	mtx      sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newFlushBreaker(maxFailures int, cooldown time.Duration, metrics *ingesterMetrics) *flushBreaker {
+	metrics.flushCircuitBreakerState.Set(float64(circuitClosed))
+	return &flushBreaker{maxFailures: maxFailures, cooldown: cooldown, metrics: metrics, now: time.Now}
+}
+
+// allow tells whether a put may be attempted. Every allowed put must be followed by a call to done.
+func (b *flushBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		fallthrough
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// done records the outcome of an allowed put. Failures not caused by the store being unavailable,
+// e.g. rejected chunks, don't count, unlike panics.
+func (b *flushBreaker) done(err error) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	failed := err != nil && (isRetryableFlushError(err) || errors.Is(err, errFlushPanic))
+	if b.state == circuitHalfOpen {
+		b.probing = false
+		if failed {
+			b.open()
+		} else if err == nil {
+			b.failures = 0
+			b.setState(circuitClosed)
+		}
+		return
+	}
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitClosed && b.failures >= b.maxFailures {
+		b.open()
+	}
+}
+
+func (b *flushBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(circuitOpen)
+}
+
+func (b *flushBreaker) setState(s circuitState) {
+	if s != b.state {
+		level.Warn(util_log.Logger).Log("msg", "flush circuit breaker state changed", "from", b.state, "to", s, "consecutive_failures", b.failures)
+	}
+	b.state = s
+	b.metrics.flushCircuitBreakerState.Set(float64(s))
+}
@@ -0,0 +1,81 @@
+package ingester
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+
+	"github.com/grafana/loki/pkg/util"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+var errFlushQueuesClosed = errors.New("the flush queues are closed")
+
+// FlushConcurrencyHandler changes the number of flush loops to the n query parameter at runtime,
+// without restarting the ingester. It returns 503 while the ingester isn't running.
+func (i *Ingester) FlushConcurrencyHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n <= 0 {
+		http.Error(w, fmt.Sprintf("invalid flush concurrency %q, it must be at least 1", r.FormValue("n")), http.StatusBadRequest)
+		return
+	}
+	if i.State() != services.Running {
+		http.Error(w, "the ingester isn't running", http.StatusServiceUnavailable)
+		return
+	}
+	if err := i.setConcurrentFlushes(n); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setConcurrentFlushes grows or shrinks the flush queues, and their flush loops, to n. The streams
+// are spread over the new number of queues right away. The removed queues are closed, their loops
+// exit once they flushed the operations already queued, so a stream may be flushed by two loops
+// during the transition, which only results in the same chunks being put to the store twice.
+func (i *Ingester) setConcurrentFlushes(n int) error {
+	i.flushQueuesMtx.Lock()
+	defer i.flushQueuesMtx.Unlock()
+
+	if i.flushQueuesClosed {
+		return errFlushQueuesClosed
+	}
+	prev := len(i.flushQueues)
+	switch {
+	case n > prev:
+		i.flushQueuesDone.Add(n - prev)
+		for j := prev; j < n; j++ {
+			queue, stats := util.NewPriorityQueue(flushQueueLength), newFlushQueueStats(1)[0]
+			i.flushQueues = append(i.flushQueues, queue)
+			i.flushStats = append(i.flushStats, stats)
+			go i.flushLoop(j, queue, stats)
+		}
+	case n < prev:
+		for _, queue := range i.flushQueues[n:] {
+			queue.Close()
+		}
+		i.flushQueues = i.flushQueues[:n:n]
+		i.flushStats = i.flushStats[:n:n]
+	default:
+		return nil
+	}
+	// The streams are spread over the new number of queues, including the rebalanced ones.
+	i.flushQueueOverrides = nil
+	level.Info(util_log.Logger).Log("msg", "changed the flush concurrency", "from", prev, "to", n)
+	return nil
+}
+
+// forgetRemovedFlushQueue deletes the series of the j-th flush queue once its loop exited, if the
+// queue was removed by shrinking the flush concurrency and not added back since.
+func (i *Ingester) forgetRemovedFlushQueue(j int) {
+	i.flushQueuesMtx.Lock()
+	defer i.flushQueuesMtx.Unlock()
+	if j >= len(i.flushQueues) {
+		i.metrics.flushLastSuccess.DeleteLabelValues(strconv.Itoa(j))
+	}
+}
@@ -0,0 +1,79 @@
+package ingester
+
+import (
+	"sync"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// FlushEvent describes the chunks of a stream stored by a flush for the same reason.
+type FlushEvent struct {
+	Tenant      string
+	Fingerprint model.Fingerprint
+	Reason      string
+	Chunks      int
+	// Encoded size of the chunks.
+	Bytes int
+}
+
+// FlushEventSink receives an event for every successful flush, e.g. to publish them to a message
+// bus for auditing or downstream indexing. Events are published by a single goroutine, in order.
+type FlushEventSink interface {
+	Publish(event FlushEvent) error
+}
+
+// flushEventPublisher buffers the flush events and publishes them to the sink in the background,
+// so that a slow sink doesn't hold back the flushes. Events are dropped while the buffer is full.
+// A nil *flushEventPublisher is valid and publishes nothing.
+type flushEventPublisher struct {
+	sink    FlushEventSink
+	metrics *ingesterMetrics
+
+	events chan FlushEvent
+	done   sync.WaitGroup
+}
+
+func newFlushEventPublisher(sink FlushEventSink, bufferSize int, metrics *ingesterMetrics) *flushEventPublisher {
+	p := &flushEventPublisher{
+		sink:    sink,
+		metrics: metrics,
+		events:  make(chan FlushEvent, bufferSize),
+	}
+	p.done.Add(1)
+	go p.run()
+	return p
+}
+
+func (p *flushEventPublisher) run() {
+	defer p.done.Done()
+	for event := range p.events {
+		if err := p.sink.Publish(event); err != nil {
+			p.metrics.flushEventsDropped.WithLabelValues("publish_failed").Inc()
+			level.Warn(util_log.WithUserID(event.Tenant, util_log.Logger)).Log("msg", "failed to publish flush event", "fp", event.Fingerprint, "reason", event.Reason, "err", err)
+		}
+	}
+}
+
+// publish enqueues an event without blocking.
+func (p *flushEventPublisher) publish(event FlushEvent) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.events <- event:
+	default:
+		p.metrics.flushEventsDropped.WithLabelValues("buffer_full").Inc()
+	}
+}
+
+// Close publishes the buffered events, and stops the publisher. Nothing may be published afterwards.
+func (p *flushEventPublisher) Close() {
+	if p == nil {
+		return
+	}
+	close(p.events)
+	p.done.Wait()
+}
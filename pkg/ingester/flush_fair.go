@@ -0,0 +1,78 @@
+package ingester
+
+import (
+	"sync"
+
+	"github.com/grafana/loki/pkg/validation"
+)
+
+// flushFairClock shares the flush loops between the tenants in proportion to their flush weight,
+// by weighted fair queueing: every flush operation is tagged with a virtual finish time, and the
+// flush loops flush the operations with the lowest tag first. The operations of a tenant are
+// tagged one after the other, each costing the inverse of the weight of the tenant, so that under
+// contention a tenant of weight 3 gets three operations flushed for every operation of a tenant of
+// weight 1. A tenant with no operation pending starts at the virtual time, the start tag of the
+// last flushed operation, so that it can't catch up on the time it was idle.
+// The clock is shared by the flush queues, so the shares hold over the flush loops as a whole.
+type flushFairClock struct {
+	mtx   sync.Mutex
+	vtime int64
+	// The finish tag of the last operation of every tenant.
+	last map[string]int64
+}
+
+func newFlushFairClock() *flushFairClock {
+	return &flushFairClock{last: map[string]int64{}}
+}
+
+// tag sets the start and finish tags of an operation of a tenant of the given weight, then calls
+// enqueue. The tags only count for the tenant if enqueue reports that the operation got queued,
+// so that a duplicate of an operation already queued, e.g. at every sweep of a tenant with a
+// backlog, doesn't push the tenant further behind. It returns what enqueue returned.
+func (c *flushFairClock) tag(op *flushOp, weight int, enqueue func() bool) bool {
+	if weight < 1 {
+		weight = 1
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	start := c.vtime
+	if last := c.last[op.userID]; last > start {
+		start = last
+	}
+	op.fairStart = start
+	op.fairFinish = start + int64(validation.MaxFlushWeight/weight)
+	if !enqueue() {
+		return false
+	}
+	c.last[op.userID] = op.fairFinish
+	return true
+}
+
+// serve advances the virtual time to the start tag of an operation being flushed.
+func (c *flushFairClock) serve(op *flushOp) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if op.fairStart > c.vtime {
+		c.vtime = op.fairStart
+	}
+}
+
+// prune forgets the tenants which are behind the virtual time, which would start at the virtual
+// time anyway.
+func (c *flushFairClock) prune() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for userID, last := range c.last {
+		if last <= c.vtime {
+			delete(c.last, userID)
+		}
+	}
+}
+
+// forget drops the tag of a tenant, e.g. once it is removed from the ingester.
+func (c *flushFairClock) forget(userID string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.last, userID)
+}
@@ -0,0 +1,77 @@
+package ingester
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Weight of the latest store put latency in the moving average.
+	flushPacingLatencyWeight = 0.2
+	// Some flushes are always enqueued, otherwise memory would only be reclaimed by immediate flushes.
+	flushPacingMinFactor = 0.1
+)
+
+// flushPacer slows down the sweeps enqueueing chunks for flushing while the store is slower
+// than the target put latency, to avoid piling on a struggling backend.
+// The pacing factor is the fraction of the streams due for a flush which are enqueued: the
+// target latency divided by a moving average of the put latencies, between flushPacingMinFactor
+// and 1. Skipped streams are enqueued again by the next sweeps.
+// A nil *flushPacer is valid and paces nothing.
+type flushPacer struct {
+	target  time.Duration
+	metrics *ingesterMetrics
+
+	mtx     sync.Mutex
+	latency float64 // Moving average of the put latencies, in seconds.
+	factor  float64
+	credit  float64
+}
+
+func newFlushPacer(target time.Duration, metrics *ingesterMetrics) *flushPacer {
+	metrics.flushPacingFactor.Set(1)
+	return &flushPacer{target: target, metrics: metrics, factor: 1}
+}
+
+// observe records the latency of a store put.
+func (p *flushPacer) observe(d time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.latency == 0 {
+		p.latency = d.Seconds()
+	} else {
+		p.latency += flushPacingLatencyWeight * (d.Seconds() - p.latency)
+	}
+
+	p.factor = 1
+	if p.latency > 0 {
+		p.factor = p.target.Seconds() / p.latency
+	}
+	if p.factor > 1 {
+		p.factor = 1
+	} else if p.factor < flushPacingMinFactor {
+		p.factor = flushPacingMinFactor
+	}
+	p.metrics.flushPacingFactor.Set(p.factor)
+}
+
+// allow tells whether a stream due for a flush may be enqueued by a sweep. It allows the pacing
+// factor of the calls, evenly spread.
+func (p *flushPacer) allow() bool {
+	if p == nil {
+		return true
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.credit += p.factor
+	if p.credit < 1 {
+		return false
+	}
+	p.credit--
+	return true
+}
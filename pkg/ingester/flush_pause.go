@@ -0,0 +1,120 @@
+package ingester
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+var errFlushPauseStopped = errors.New("flushing can't be paused once the ingester is stopping")
+
+// flushPause holds back the flush loops while flushing is paused, e.g. during storage maintenance
+// windows. The flush operations keep being enqueued, and are run once flushing resumes.
+type flushPause struct {
+	metrics *ingesterMetrics
+
+	mtx sync.Mutex
+	// Closed on resume, nil while flushing isn't paused.
+	resumed chan struct{}
+	// When flushing was last resumed, zero if it never was.
+	resumedAt time.Time
+	// Set once the ingester is stopping, after which flushing can't be paused anymore.
+	stopped bool
+}
+
+func newFlushPause(metrics *ingesterMetrics) *flushPause {
+	metrics.flushPaused.Set(0)
+	return &flushPause{metrics: metrics}
+}
+
+// pause pauses flushing, returning whether it wasn't already paused. It fails with
+// errFlushPauseStopped once stop was called, as the flush on shutdown would never complete.
+func (p *flushPause) pause() (bool, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.stopped {
+		return false, errFlushPauseStopped
+	}
+	if p.resumed != nil {
+		return false, nil
+	}
+	p.resumed = make(chan struct{})
+	p.metrics.flushPaused.Set(1)
+	return true, nil
+}
+
+// resume resumes flushing, returning whether it was paused.
+func (p *flushPause) resume() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.resumeLocked()
+}
+
+// stop resumes flushing for good, returning whether it was paused.
+func (p *flushPause) stop() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.stopped = true
+	return p.resumeLocked()
+}
+
+func (p *flushPause) resumeLocked() bool {
+	if p.resumed == nil {
+		return false
+	}
+	close(p.resumed)
+	p.resumed = nil
+	p.resumedAt = time.Now()
+	p.metrics.flushPaused.Set(0)
+	return true
+}
+
+// status returns whether flushing is paused, and when it was last resumed.
+func (p *flushPause) status() (paused bool, resumedAt time.Time) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.resumed != nil, p.resumedAt
+}
+
+// wait blocks until flushing isn't paused.
+func (p *flushPause) wait() {
+	p.mtx.Lock()
+	resumed := p.resumed
+	p.mtx.Unlock()
+
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// FlushPauseHandler pauses flushing: the flush loops stop running flush operations, which keep
+// being enqueued until flushing is resumed by FlushResumeHandler. Flushing is resumed on shutdown,
+// after which it responds with 503.
+func (i *Ingester) FlushPauseHandler(w http.ResponseWriter, _ *http.Request) {
+	paused, err := i.flushPause.pause()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if paused {
+		level.Info(util_log.Logger).Log("msg", "paused flushing", "queued_ops", i.flushQueueDepth())
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// FlushResumeHandler resumes flushing paused by FlushPauseHandler.
+func (i *Ingester) FlushResumeHandler(w http.ResponseWriter, _ *http.Request) {
+	if i.flushPause.resume() {
+		level.Info(util_log.Logger).Log("msg", "resumed flushing", "queued_ops", i.flushQueueDepth())
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
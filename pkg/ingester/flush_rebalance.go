@@ -0,0 +1,76 @@
+package ingester
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/util"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// FlushRebalanceHandler spreads the pending flush operations evenly over the flush queues, e.g.
+// when a few queues got most of the streams. It returns 503 while the ingester isn't running.
+func (i *Ingester) FlushRebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if i.State() != services.Running {
+		http.Error(w, "the ingester isn't running", http.StatusServiceUnavailable)
+		return
+	}
+	if err := i.rebalanceFlushQueues(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// flushStreamKey identifies the stream of a flush operation.
+type flushStreamKey struct {
+	userID string
+	fp     model.Fingerprint
+}
+
+// rebalanceFlushQueues takes the pending operations out of every flush queue and deals their
+// streams over the queues in priority order, so that every queue ends up with about the same number
+// of streams of every priority. Every stream is then pinned to the queue it was dealt to, so that
+// its operations enqueued later go to that queue too instead of being flushed by two loops, until
+// the next rebalance or flush concurrency change. No operation is lost: the flush queues can't be
+// enqueued to or resized meanwhile, and the flush loops keep the operations they dequeue
+// concurrently. Only an operation in flight while rebalancing may run along with a moved operation
+// of the same stream, which results in the same chunks being put to the store twice.
+func (i *Ingester) rebalanceFlushQueues() error {
+	i.flushQueuesMtx.Lock()
+	defer i.flushQueuesMtx.Unlock()
+
+	if i.flushQueuesClosed {
+		return errFlushQueuesClosed
+	}
+	if len(i.flushQueues) < 2 {
+		return nil
+	}
+
+	var ops []util.Op
+	for _, queue := range i.flushQueues {
+		ops = append(ops, queue.Drain()...)
+	}
+	// Every queue is drained in priority order, merge them before dealing.
+	sort.SliceStable(ops, func(a, b int) bool { return ops[a].Priority() > ops[b].Priority() })
+
+	// The operations of a stream stay together, in the queue its highest priority one is dealt to.
+	overrides := make(map[flushStreamKey]int, len(ops))
+	for _, o := range ops {
+		op := o.(*flushOp)
+		key := flushStreamKey{userID: op.userID, fp: op.fp}
+		j, ok := overrides[key]
+		if !ok {
+			j = len(overrides) % len(i.flushQueues)
+			overrides[key] = j
+		}
+		i.flushQueues[j].Enqueue(op)
+	}
+	i.flushQueueOverrides = overrides
+	level.Info(util_log.Logger).Log("msg", "rebalanced the flush queues", "queues", len(i.flushQueues), "ops", len(ops), "streams", len(overrides))
+	return nil
+}
@@ -0,0 +1,68 @@
+package ingester
+
+import (
+	"context"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/storage/config"
+)
+
+// FlushReceipt records that a chunk got persisted by the store, so that external systems can
+// verify it, e.g. for exactly-once reconciliation.
+type FlushReceipt struct {
+	Tenant      string
+	Fingerprint model.Fingerprint
+	From        model.Time
+	Through     model.Time
+	Checksum    uint32
+	// External key of the chunk, like the ones returned by GetChunkIDs.
+	ChunkKey string
+	// Where the store persisted the chunk as reported by an ObjectRefStore, the chunk key
+	// otherwise, which the object stores name the chunk objects after.
+	ObjectRef string
+}
+
+// ObjectRefStore is optionally implemented by a ChunkStore which reports where every chunk got
+// persisted, e.g. including the object version, to fill in the flush receipts.
+type ObjectRefStore interface {
+	// PutWithObjectRefs stores the chunks like Put and returns the object reference of every chunk.
+	PutWithObjectRefs(ctx context.Context, chunks []chunk.Chunk) ([]string, error)
+}
+
+// storePut puts chunks to the store, returning their object references if receipts are wanted
+// and the store reports them.
+func (i *Ingester) storePut(ctx context.Context, chunks []chunk.Chunk) ([]string, error) {
+	if s, ok := i.store.(ObjectRefStore); ok && i.cfg.OnFlushReceipts != nil {
+		return s.PutWithObjectRefs(ctx, chunks)
+	}
+	return nil, i.store.Put(ctx, chunks)
+}
+
+// flushReceipts returns the receipts of the chunks put to the store. refs holds the object
+// reference of every chunk, if any, and put whether it was stored.
+func (i *Ingester) flushReceipts(userID string, fp model.Fingerprint, chunks []chunk.Chunk, refs []string, put []bool) []FlushReceipt {
+	schema := config.SchemaConfig{Configs: i.periodicConfigs}
+	receipts := make([]FlushReceipt, 0, len(chunks))
+	for j, c := range chunks {
+		if !put[j] {
+			continue
+		}
+		key := schema.ExternalKey(c.ChunkRef)
+		ref := refs[j]
+		if ref == "" {
+			ref = key
+		}
+		receipts = append(receipts, FlushReceipt{
+			Tenant:      userID,
+			Fingerprint: fp,
+			From:        c.From,
+			Through:     c.Through,
+			Checksum:    c.Checksum,
+			ChunkKey:    key,
+			ObjectRef:   ref,
+		})
+	}
+	return receipts
+}
@@ -0,0 +1,194 @@
+package ingester
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// cronSchedule is a parsed standard cron expression made of five fields: minute, hour, day of the
+// month, month and day of the week. Every field is a bitset of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Whether the day of the month and the day of the week are restricted, in which case a day
+	// matching either of them matches, like cron does.
+	domRestricted, dowRestricted bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronSchedule parses a cron expression like "0 * * * *". Fields are lists of values, ranges
+// like 1-5 and wildcards, optionally followed by a step like */15. Sunday is 0 or 7.
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("expected %d fields in cron expression %q, got %d", len(cronFields), expr, len(fields))
+	}
+
+	bits := make([]uint64, len(fields))
+	for j, field := range fields {
+		b, err := parseCronField(field, cronFields[j])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+		bits[j] = b
+	}
+
+	s := &cronSchedule{
+		minute:        bits[0],
+		hour:          bits[1],
+		dom:           bits[2],
+		month:         bits[3],
+		dow:           bits[4],
+		domRestricted: !strings.HasPrefix(fields[2], "*"),
+		dowRestricted: !strings.HasPrefix(fields[4], "*"),
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if k := strings.Index(part, "/"); k >= 0 {
+			var err error
+			rng = part[:k]
+			if step, err = strconv.Atoi(part[k+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid %s step: %s", f.name, part)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid %s: %s", f.name, part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid %s: %s", f.name, part)
+				}
+			} else if step > 1 {
+				// Like cron, a single value with a step starts a range ending at the maximum.
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("%s out of range [%d, %d]: %s", f.name, f.min, f.max, part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time strictly after t matched by the schedule, in UTC, or the zero time
+// if there is none within the next five years, e.g. for February 30th.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// flushCron triggers sweeps at the times matched by a cron schedule, e.g. to flush everything
+// at the top of each hour so that the stored chunks line up with object store lifecycle policies.
+type flushCron struct {
+	schedule *cronSchedule
+
+	// Overridable in tests.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+func newFlushCron(schedule *cronSchedule) *flushCron {
+	return &flushCron{
+		schedule: schedule,
+		now:      time.Now,
+		after:    time.After,
+	}
+}
+
+// run calls sweep at every scheduled time until quit is closed.
+func (s *flushCron) run(quit <-chan struct{}, sweep func()) {
+	var last time.Time
+	for {
+		from := s.now()
+		if from.Before(last) {
+			// Don't sweep twice for the same scheduled time if the timer fired a bit early.
+			from = last
+		}
+		next := s.schedule.next(from)
+		if next.IsZero() {
+			return
+		}
+		select {
+		case <-s.after(next.Sub(s.now())):
+			last = next
+			sweep()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// flushScheduleLoop enqueues immediate flushes of every stream at the times of the flush schedule.
+func (i *Ingester) flushScheduleLoop() {
+	defer i.loopDone.Done()
+
+	i.flushCron.run(i.loopQuit, func() {
+		level.Info(util_log.Logger).Log("msg", "running scheduled flush", "schedule", i.cfg.FlushSchedule)
+		i.sweepUsers(true, true)
+	})
+}
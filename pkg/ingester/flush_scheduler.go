@@ -0,0 +1,107 @@
+package ingester
+
+import (
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// FlushScheduler decides which in-memory chunks the sweeps flush and how their flush operations are
+// queued, so that alternative strategies, e.g. size based or fair ones, can replace the default.
+// It is called concurrently by the sweeps and the flush loops.
+type FlushScheduler interface {
+	// ShouldFlush reports whether a chunk of the tenant should be flushed, and the flush reason.
+	ShouldFlush(tenant string, chunk FlushChunk) (bool, string)
+	// Priority returns the priority class of the tenant when flushing all the in-memory chunks,
+	// the chunks of the tenants in a higher class are flushed first.
+	Priority(tenant string) int
+	// QueueIndex returns which of the n flush queues flushes the stream with the given fingerprint.
+	QueueIndex(fp model.Fingerprint, n int) int
+}
+
+// FlushChunk is an in-memory chunk considered for flushing by a FlushScheduler.
+type FlushChunk struct {
+	desc *chunkDesc
+}
+
+// Bounds returns the timestamps of the oldest and newest entries of the chunk.
+func (c FlushChunk) Bounds() (time.Time, time.Time) { return c.desc.chunk.Bounds() }
+
+// LastUpdated returns when an entry was last appended to the chunk.
+func (c FlushChunk) LastUpdated() time.Time { return c.desc.lastUpdated }
+
+// Closed reports whether the chunk accepts no more entries, because it's full or got closed by a
+// sync or under memory pressure.
+func (c FlushChunk) Closed() bool { return c.desc.closed }
+
+// Synced reports whether the chunk got closed by a sync.
+func (c FlushChunk) Synced() bool { return c.desc.synced }
+
+// Pressure reports whether the chunk got closed to relieve memory pressure.
+func (c FlushChunk) Pressure() bool { return c.desc.pressure }
+
+// CompressedSize returns the size of the chunk once compressed.
+func (c FlushChunk) CompressedSize() int { return c.desc.chunk.CompressedSize() }
+
+// UncompressedSize returns the size of the entries of the chunk.
+func (c FlushChunk) UncompressedSize() int { return c.desc.chunk.UncompressedSize() }
+
+// scheduler returns the configured flush scheduler, or the default one.
+func (i *Ingester) scheduler() FlushScheduler {
+	if i.flushScheduler != nil {
+		return i.flushScheduler
+	}
+	return defaultFlushScheduler{i: i}
+}
+
+// schedulerQueueIndex returns which of the n flush queues flushes a stream, as decided by the flush
+// scheduler. An index out of range falls back to the queue of the default flush scheduler.
+func (i *Ingester) schedulerQueueIndex(fp model.Fingerprint, n int) int {
+	j := i.scheduler().QueueIndex(fp, n)
+	if j < 0 || j >= n {
+		level.Warn(util_log.Logger).Log("msg", "flush scheduler returned an invalid flush queue, using the default one", "fp", fp, "queue", j, "queues", n)
+		return flushQueueIndex(i.cfg.FlushQueueHash, fp, n)
+	}
+	return j
+}
+
+// defaultFlushScheduler flushes the chunks once they are closed, idle or too old, following the
+// ingester config and the tenant overrides.
+type defaultFlushScheduler struct {
+	i *Ingester
+}
+
+func (s defaultFlushScheduler) ShouldFlush(userID string, chunk FlushChunk) (bool, string) {
+	// Append should close the chunk when the a new one is added.
+	if chunk.Closed() {
+		if chunk.Synced() {
+			return true, flushReasonSynced
+		}
+		if chunk.Pressure() {
+			return true, flushReasonPressure
+		}
+		return true, flushReasonFull
+	}
+
+	from, to := chunk.Bounds()
+	if time.Since(chunk.LastUpdated()) > s.i.maxChunkIdle(userID) && time.Since(from) >= s.i.cfg.MinChunkAge && !s.i.deferIdleFlush(userID, chunk.desc) {
+		return true, flushReasonIdle
+	}
+
+	if to.Sub(from) > s.i.maxChunkAge(userID) {
+		return true, flushReasonMaxAge
+	}
+
+	return false, ""
+}
+
+func (s defaultFlushScheduler) Priority(userID string) int {
+	return s.i.limits().FlushPriorityClass(userID)
+}
+
+func (s defaultFlushScheduler) QueueIndex(fp model.Fingerprint, n int) int {
+	return flushQueueIndex(s.i.cfg.FlushQueueHash, fp, n)
+}
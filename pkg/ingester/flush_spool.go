@@ -0,0 +1,259 @@
+package ingester
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/util/flagext"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+const spoolTmpSuffix = ".tmp"
+
+var errFlushSpoolFull = errors.New("flush spool is full")
+
+// FlushSpoolConfig configures the local directory to which chunks failing to flush are
+// spooled until the store recovers.
+type FlushSpoolConfig struct {
+	Dir            string           `yaml:"dir"`
+	MaxSizeBytes   flagext.ByteSize `yaml:"max_size_bytes"`
+	ReplayInterval time.Duration    `yaml:"replay_interval"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *FlushSpoolConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Dir, "ingester.flush-spool.dir", "", "Directory to which chunks failing to be flushed to the store are written, to free memory during store outages. They are replayed to the store once it recovers. Disabled when empty.")
+	cfg.MaxSizeBytes = flagext.ByteSize(1 << 30)
+	f.Var(&cfg.MaxSizeBytes, "ingester.flush-spool.max-size-bytes", "Maximum size of the chunks held in the flush spool. Chunks failing to flush are kept in memory and retried once it is full.")
+	f.DurationVar(&cfg.ReplayInterval, "ingester.flush-spool.replay-interval", time.Minute, "How often the spooled chunks are replayed to the store.")
+}
+
+func (cfg *FlushSpoolConfig) Validate() error {
+	if cfg.Dir != "" && cfg.ReplayInterval <= 0 {
+		return fmt.Errorf("invalid flush spool replay interval: %v", cfg.ReplayInterval)
+	}
+	return nil
+}
+
+// flushSpool stores encoded chunks as one file per chunk, in a directory per tenant.
+// The file name holds the chunk key needed to decode it again.
+// A nil *flushSpool is valid and spools nothing.
+type flushSpool struct {
+	dir     string
+	maxSize int64
+	metrics *ingesterMetrics
+
+	// Serialises replays.
+	replayMtx sync.Mutex
+
+	// Guards the files and size, but isn't held while replaying the chunks to the store.
+	mtx  sync.Mutex
+	size int64
+}
+
+func newFlushSpool(cfg FlushSpoolConfig, metrics *ingesterMetrics) (*flushSpool, error) {
+	if err := os.MkdirAll(cfg.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	s := &flushSpool{dir: cfg.Dir, maxSize: int64(cfg.MaxSizeBytes), metrics: metrics}
+
+	// Account for the chunks spooled before a restart, and drop the partially written ones.
+	err := filepath.Walk(cfg.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, spoolTmpSuffix) {
+			return os.Remove(path)
+		}
+		s.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics.flushSpoolBytes.Set(float64(s.size))
+	return s, nil
+}
+
+func spoolFileName(ref logproto.ChunkRef) string {
+	return fmt.Sprintf("%x-%x-%x-%x", ref.Fingerprint, int64(ref.From), int64(ref.Through), ref.Checksum)
+}
+
+func parseSpoolFileName(userID, name string) (chunk.Chunk, error) {
+	var (
+		fp            uint64
+		from, through int64
+		checksum      uint32
+	)
+	if _, err := fmt.Sscanf(name, "%x-%x-%x-%x", &fp, &from, &through, &checksum); err != nil {
+		return chunk.Chunk{}, fmt.Errorf("invalid spooled chunk name %q: %w", name, err)
+	}
+	return chunk.Chunk{
+		ChunkRef: logproto.ChunkRef{
+			Fingerprint: fp,
+			UserID:      userID,
+			From:        model.Time(from),
+			Through:     model.Time(through),
+			Checksum:    checksum,
+		},
+	}, nil
+}
+
+// Write spools the given encoded chunks. Either all of them are spooled, or none.
+func (s *flushSpool) Write(chunks []chunk.Chunk) error {
+	if s == nil {
+		return errors.New("flush spool is disabled")
+	}
+
+	encoded := make([][]byte, 0, len(chunks))
+	var size int64
+	for _, c := range chunks {
+		buf, err := c.Encoded()
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, buf)
+		size += int64(len(buf))
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.size+size > s.maxSize {
+		return errFlushSpoolFull
+	}
+
+	written := make([]string, 0, len(chunks))
+	for j, c := range chunks {
+		path, err := s.writeChunk(c.ChunkRef, encoded[j])
+		if err != nil {
+			for _, p := range written {
+				_ = os.Remove(p)
+			}
+			return err
+		}
+		written = append(written, path)
+	}
+	s.size += size
+	s.metrics.flushSpoolBytes.Set(float64(s.size))
+	s.metrics.flushSpoolChunksWritten.Add(float64(len(chunks)))
+	return nil
+}
+
+func (s *flushSpool) writeChunk(ref logproto.ChunkRef, buf []byte) (string, error) {
+	dir := filepath.Join(s.dir, ref.UserID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, spoolFileName(ref))
+	tmp := path + spoolTmpSuffix
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// Replay puts the spooled chunks to the store through put, removing them once stored, and calls
+// onStored with each chunk stored along with its encoded size.
+// It stops at the first failure, as the store is likely still unavailable. The spool isn't locked
+// while putting, so that chunks can still be spooled meanwhile, from under the lock of their stream.
+func (s *flushSpool) Replay(ctx context.Context, put func(context.Context, []chunk.Chunk) error, onStored func(userID string, c chunk.Chunk, size int)) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	s.replayMtx.Lock()
+	defer s.replayMtx.Unlock()
+
+	paths, err := s.spooledFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	var replayed int
+	decodeContext := chunk.NewDecodeContext()
+	for _, path := range paths {
+		userID, name := filepath.Base(filepath.Dir(path)), filepath.Base(path)
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return replayed, err
+		}
+
+		c, err := parseSpoolFileName(userID, name)
+		if err == nil {
+			err = c.Decode(decodeContext, buf)
+		}
+		if err != nil {
+			// Retrying won't help, drop the file so it doesn't block the others.
+			level.Error(util_log.Logger).Log("msg", "dropping unreadable spooled chunk", "path", path, "err", err)
+		} else if err := put(user.InjectOrgID(ctx, userID), []chunk.Chunk{c}); err != nil {
+			return replayed, err
+		} else {
+			replayed++
+			s.metrics.flushSpoolChunksReplayed.Inc()
+			if onStored != nil {
+				onStored(userID, c, len(buf))
+			}
+		}
+
+		if err := s.remove(path, int64(len(buf))); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// spooledFiles lists the files of the spooled chunks, by tenant.
+func (s *flushSpool) spooledFiles() ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	tenants, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, tenant := range tenants {
+		if !tenant.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.dir, tenant.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(files, func(a, b int) bool { return files[a].Name() < files[b].Name() })
+		for _, f := range files {
+			if f.IsDir() || strings.HasSuffix(f.Name(), spoolTmpSuffix) {
+				continue
+			}
+			paths = append(paths, filepath.Join(s.dir, tenant.Name(), f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// remove removes the file of a replayed chunk.
+func (s *flushSpool) remove(path string, size int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	s.size -= size
+	s.metrics.flushSpoolBytes.Set(float64(s.size))
+	return nil
+}
@@ -0,0 +1,414 @@
+package ingester
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/loki/pkg/util"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// flushQueueStats tracks the activity of a single flush queue worker.
+type flushQueueStats struct {
+	mtx                 sync.Mutex
+	inFlight            bool
+	lastDequeue         time.Time
+	lastFlush           time.Time
+	lastFailure         time.Time
+	failures            int
+	consecutiveFailures int
+}
+
+func newFlushQueueStats(n int) []*flushQueueStats {
+	stats := make([]*flushQueueStats, n)
+	now := time.Now()
+	for j := range stats {
+		// The queues haven't got any chance to stall yet.
+		stats[j] = &flushQueueStats{lastDequeue: now}
+	}
+	return stats
+}
+
+func (s *flushQueueStats) start(now time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.inFlight = true
+	s.lastDequeue = now
+}
+
+func (s *flushQueueStats) done(now time.Time, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.inFlight = false
+	if err != nil {
+		s.lastFailure = now
+		s.failures++
+		s.consecutiveFailures++
+		return
+	}
+	s.lastFlush = now
+	s.consecutiveFailures = 0
+}
+
+// FlushQueueStats is the state of a single flush queue as reported by FlushStatsHandler.
+type FlushQueueStats struct {
+	Queue               int        `json:"queue"`
+	Depth               int        `json:"depth"`
+	Streams             int        `json:"streams"`
+	InFlight            bool       `json:"in_flight"`
+	LastFlush           *time.Time `json:"last_flush,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	Failures            int        `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// FlushStats is a snapshot of the flush subsystem as reported by FlushStatsHandler.
+type FlushStats struct {
+	QueueDepth   int               `json:"queue_depth"`
+	InFlight     int               `json:"in_flight"`
+	MemoryChunks int               `json:"memory_chunks"`
+	Pushback     bool              `json:"pushback"`
+	Queues       []FlushQueueStats `json:"queues"`
+}
+
+// FlushStatsHandler returns a JSON snapshot of the flush queues, giving a consolidated view of the flush health.
+func (i *Ingester) FlushStatsHandler(w http.ResponseWriter, _ *http.Request) {
+	stats := i.flushStatsSnapshot()
+	i.countFlushQueueStreams(stats.Queues)
+	util.WriteJSONResponse(w, stats)
+}
+
+func (i *Ingester) flushStatsSnapshot() FlushStats {
+	queues, queueStats := i.flushQueuesSnapshot()
+	stats := FlushStats{
+		Pushback: i.flushPushback.Load(),
+		Queues:   make([]FlushQueueStats, 0, len(queues)),
+	}
+
+	var m dto.Metric
+	if err := memoryChunks.Write(&m); err == nil {
+		stats.MemoryChunks = int(m.GetGauge().GetValue())
+	}
+
+	for j, q := range queues {
+		qs := FlushQueueStats{Queue: j}
+		if q != nil {
+			qs.Depth = q.Length()
+		}
+		if j < len(queueStats) {
+			s := queueStats[j]
+			s.mtx.Lock()
+			qs.InFlight = s.inFlight
+			qs.Failures = s.failures
+			qs.ConsecutiveFailures = s.consecutiveFailures
+			if !s.lastFlush.IsZero() {
+				t := s.lastFlush
+				qs.LastFlush = &t
+			}
+			if !s.lastFailure.IsZero() {
+				t := s.lastFailure
+				qs.LastFailure = &t
+			}
+			s.mtx.Unlock()
+		}
+
+		stats.QueueDepth += qs.Depth
+		if qs.InFlight {
+			stats.InFlight++
+		}
+		stats.Queues = append(stats.Queues, qs)
+	}
+	return stats
+}
+
+// countFlushQueueStreams sets the number of in-memory streams of every queue, which shows how evenly
+// they are spread. It walks every stream, so it is left out of flushStatsSnapshot, which is also
+// called periodically while shutting down.
+func (i *Ingester) countFlushQueueStreams(queues []FlushQueueStats) {
+	if len(queues) == 0 {
+		return
+	}
+	for _, instance := range i.getInstances() {
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			queues[i.schedulerQueueIndex(s.fp, len(queues))].Streams++
+			return true, nil
+		})
+	}
+}
+
+func (i *Ingester) countFlushReason(reason string) {
+	c, ok := i.flushReasonCounts.Load(reason)
+	if !ok {
+		c, _ = i.flushReasonCounts.LoadOrStore(reason, atomic.NewUint64(0))
+	}
+	c.(*atomic.Uint64).Inc()
+}
+
+// FlushReasonCounts returns the cumulative number of chunks collected for flushing per reason,
+// for embedders and tests which don't want to scrape the metrics.
+func (i *Ingester) FlushReasonCounts() map[string]uint64 {
+	counts := map[string]uint64{}
+	i.flushReasonCounts.Range(func(reason, c interface{}) bool {
+		counts[reason.(string)] = c.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+// UsageSnapshot returns the current values of the flushed chunks usage stats reported by the
+// usage stats reporter, keyed by stat and field name, e.g. ingester_flushed_chunks_bytes_avg.
+// The stats are global to the process, not to this ingester.
+func (i *Ingester) UsageSnapshot() map[string]float64 {
+	snapshot := map[string]float64{}
+	add := func(name string, values map[string]interface{}) {
+		for field, v := range values {
+			switch v := v.(type) {
+			case int64:
+				snapshot[name+"_"+field] = float64(v)
+			case float64:
+				snapshot[name+"_"+field] = v
+			}
+		}
+	}
+	add("ingester_flushed_chunks", flushedChunksStats.Value())
+	add("ingester_flushed_chunks_bytes", flushedChunksBytesStats.Value())
+	add("ingester_flushed_chunks_lines", flushedChunksLinesStats.Value())
+	add("ingester_flushed_chunks_age_seconds", flushedChunksAgeStats.Value())
+	add("ingester_flushed_chunks_lifespan_seconds", flushedChunksLifespanStats.Value())
+	add("ingester_flushed_chunks_utilization", flushedChunksUtilizationStats.Value())
+	return snapshot
+}
+
+// TenantUnflushedData is the data of a tenant at risk of being lost by the ingester, as reported
+// by UnflushedDataHandler.
+type TenantUnflushedData struct {
+	Tenant string `json:"tenant"`
+	// Number of streams holding unflushed chunks.
+	Streams int `json:"streams"`
+	// Since when the data of the tenant is unflushed, and for how long.
+	OldestUnflushed    time.Time `json:"oldest_unflushed"`
+	OldestUnflushedAge float64   `json:"oldest_unflushed_age_seconds"`
+}
+
+// UnflushedDataHandler lists the tenants holding unflushed chunks with the age of their oldest
+// unflushed data, quantifying the window of data lost if the ingester went down without its WAL.
+// The data of a stream is unflushed since the oldest entry of its unflushed chunks, regardless of
+// when it last flushed, as a delayed or partial flush may leave older data behind.
+func (i *Ingester) UnflushedDataHandler(w http.ResponseWriter, _ *http.Request) {
+	util.WriteJSONResponse(w, struct {
+		Tenants []TenantUnflushedData `json:"tenants"`
+	}{Tenants: i.unflushedData(time.Now())})
+}
+
+func (i *Ingester) unflushedData(now time.Time) []TenantUnflushedData {
+	var tenants []TenantUnflushedData
+	for _, instance := range i.getInstances() {
+		td := TenantUnflushedData{Tenant: instance.instanceID}
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			s.chunkMtx.RLock()
+			defer s.chunkMtx.RUnlock()
+
+			var since time.Time
+			for _, c := range s.chunks {
+				if !c.flushed.IsZero() || c.chunk.Size() == 0 {
+					continue
+				}
+				if from, _ := c.chunk.Bounds(); since.IsZero() || from.Before(since) {
+					since = from
+				}
+			}
+			if since.IsZero() {
+				return true, nil
+			}
+			td.Streams++
+			if td.OldestUnflushed.IsZero() || since.Before(td.OldestUnflushed) {
+				td.OldestUnflushed = since
+			}
+			return true, nil
+		})
+		if td.Streams == 0 {
+			continue
+		}
+		td.OldestUnflushedAge = now.Sub(td.OldestUnflushed).Seconds()
+		tenants = append(tenants, td)
+	}
+	sort.Slice(tenants, func(a, b int) bool { return tenants[a].Tenant < tenants[b].Tenant })
+	return tenants
+}
+
+// flushWatchdog periodically checks that the flush queues make progress, see checkFlushStalls.
+func (i *Ingester) flushWatchdog() {
+	defer i.loopDone.Done()
+
+	ticker := time.NewTicker(i.cfg.FlushStallThreshold / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			i.checkFlushStalls(time.Now())
+		case <-i.loopQuit:
+			return
+		}
+	}
+}
+
+// checkFlushStalls warns about the flush queues which have work to do but didn't dequeue any
+// operation for longer than FlushStallThreshold, e.g. because their flush loop is stuck on a
+// store call, and returns how many there are. Queues aren't expected to make progress while
+// flushing is paused, nor before the threshold elapsed since flushing was resumed.
+func (i *Ingester) checkFlushStalls(now time.Time) int {
+	paused, resumedAt := i.flushPause.status()
+	if paused {
+		return 0
+	}
+
+	var stalled int
+	queues, queueStats := i.flushQueuesSnapshot()
+	for j, s := range queueStats {
+		var depth int
+		if q := queues[j]; q != nil {
+			depth = q.Length()
+		}
+		s.mtx.Lock()
+		lastDequeue, inFlight := s.lastDequeue, s.inFlight
+		s.mtx.Unlock()
+
+		since := lastDequeue
+		if resumedAt.After(since) {
+			since = resumedAt
+		}
+		if (depth == 0 && !inFlight) || now.Sub(since) < i.cfg.FlushStallThreshold {
+			continue
+		}
+		stalled++
+		level.Warn(util_log.Logger).Log("msg", "flush queue is not making progress", "queue", j, "depth", depth, "in_flight", inFlight, "last_dequeue", lastDequeue)
+	}
+	return stalled
+}
+
+// ChunkFlushStatus reports whether a chunk held in memory has been flushed, as returned by ChunkFlushStatusHandler.
+type ChunkFlushStatus struct {
+	Flushed   bool       `json:"flushed"`
+	FlushedAt *time.Time `json:"flushed_at,omitempty"`
+}
+
+// ChunkFlushStatusHandler returns the flush status of the in-memory chunk identified by the tenant,
+// fingerprint, from and through query parameters, as in its chunk key, for precise reconciliation.
+// It responds with 404 if the ingester doesn't hold such a chunk.
+func (i *Ingester) ChunkFlushStatusHandler(w http.ResponseWriter, r *http.Request) {
+	tenantID, fp, from, through, ok := parseChunkID(w, r)
+	if !ok {
+		return
+	}
+
+	status, ok := i.chunkFlushStatus(tenantID, fp, from, through)
+	if !ok {
+		http.Error(w, "chunk not found", http.StatusNotFound)
+		return
+	}
+	util.WriteJSONResponse(w, status)
+}
+
+// ResetChunkFlushStatusHandler clears the flushed timestamp of the in-memory chunk identified like
+// in ChunkFlushStatusHandler, so that it is flushed again, e.g. when it is missing from the store
+// despite having been flushed. As it may duplicate data, it requires the force query parameter.
+func (i *Ingester) ResetChunkFlushStatusHandler(w http.ResponseWriter, r *http.Request) {
+	tenantID, fp, from, through, ok := parseChunkID(w, r)
+	if !ok {
+		return
+	}
+	if force, _ := strconv.ParseBool(r.FormValue("force")); !force {
+		http.Error(w, "resetting the flush status of a chunk requires force=true", http.StatusBadRequest)
+		return
+	}
+
+	found := i.withChunk(tenantID, fp, from, through, true, func(c *chunkDesc) {
+		c.flushed = time.Time{}
+	})
+	if !found {
+		http.Error(w, "chunk not found", http.StatusNotFound)
+		return
+	}
+	level.Warn(util_log.Logger).Log("msg", "reset the flush status of a chunk", "tenant", tenantID, "fp", fp, "from", from, "through", through)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseChunkID parses the tenant, fingerprint, from and through query parameters identifying a
+// chunk, responding with 400 when invalid.
+func parseChunkID(w http.ResponseWriter, r *http.Request) (string, model.Fingerprint, model.Time, model.Time, bool) {
+	tenantID := r.FormValue("tenant")
+	if tenantID == "" {
+		http.Error(w, "missing tenant", http.StatusBadRequest)
+		return "", 0, 0, 0, false
+	}
+	fp, err := model.ParseFingerprint(r.FormValue("fingerprint"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid fingerprint: %v", err), http.StatusBadRequest)
+		return "", 0, 0, 0, false
+	}
+	var from, through model.Time
+	for _, p := range []struct {
+		name string
+		t    *model.Time
+	}{{"from", &from}, {"through", &through}} {
+		ms, err := util.ParseTime(r.FormValue(p.name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return "", 0, 0, 0, false
+		}
+		*p.t = model.Time(ms)
+	}
+	return tenantID, fp, from, through, true
+}
+
+func (i *Ingester) chunkFlushStatus(tenantID string, fp model.Fingerprint, from, through model.Time) (ChunkFlushStatus, bool) {
+	var status ChunkFlushStatus
+	found := i.withChunk(tenantID, fp, from, through, false, func(c *chunkDesc) {
+		status.Flushed = !c.flushed.IsZero()
+		if status.Flushed {
+			flushedAt := c.flushed
+			status.FlushedAt = &flushedAt
+		}
+	})
+	return status, found
+}
+
+// withChunk calls fn with the in-memory chunk of a stream matching the bounds, rounded to
+// milliseconds like in the chunk key, while holding the chunk lock of the stream, exclusively if
+// fn modifies the chunk. It returns whether the chunk was found.
+func (i *Ingester) withChunk(tenantID string, fp model.Fingerprint, from, through model.Time, exclusive bool, fn func(*chunkDesc)) bool {
+	instance, ok := i.getInstanceByID(tenantID)
+	if !ok {
+		return false
+	}
+	s, ok := instance.streams.LoadByFP(fp)
+	if !ok {
+		return false
+	}
+
+	if exclusive {
+		s.chunkMtx.Lock()
+		defer s.chunkMtx.Unlock()
+	} else {
+		s.chunkMtx.RLock()
+		defer s.chunkMtx.RUnlock()
+	}
+	for j := range s.chunks {
+		if f, t := util.RoundToMilliseconds(s.chunks[j].chunk.Bounds()); f != from || t != through {
+			continue
+		}
+		fn(&s.chunks[j])
+		return true
+	}
+	return false
+}
@@ -1,23 +1,41 @@
 package ingester
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	gokitlog "github.com/go-kit/log"
+	"github.com/go-logfmt/logfmt"
 	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/kv"
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/services"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/require"
+	"github.com/uber/jaeger-client-go"
+	"github.com/weaveworks/common/httpgrpc"
 	"github.com/weaveworks/common/user"
+	"go.uber.org/atomic"
 	"golang.org/x/net/context"
 
 	"github.com/grafana/dskit/tenant"
@@ -32,6 +50,9 @@ import (
 	"github.com/grafana/loki/pkg/storage/chunk"
 	"github.com/grafana/loki/pkg/storage/chunk/fetcher"
 	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/usagestats"
+	"github.com/grafana/loki/pkg/util"
+	util_log "github.com/grafana/loki/pkg/util/log"
 	"github.com/grafana/loki/pkg/validation"
 )
 
@@ -62,58 +83,2831 @@ func TestChunkFlushingShutdown(t *testing.T) {
 	store.checkData(t, testData)
 }
 
+func TestChunkFlushingShutdownGracePeriod(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushShutdownGracePeriod = 100 * time.Millisecond
+	store, ing := newTestStore(t, cfg, nil)
+	pushTestSamples(t, ing)
+
+	// The store hangs until the flush is cancelled, well before the flush op timeout.
+	var cancelled atomic.Bool
+	store.onPut = func(ctx context.Context, _ []chunk.Chunk) error {
+		<-ctx.Done()
+		cancelled.Store(errors.Is(ctx.Err(), context.Canceled))
+		return ctx.Err()
+	}
+
+	start := time.Now()
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	require.Less(t, time.Since(start), cfg.FlushOpTimeout)
+	require.True(t, cancelled.Load())
+}
+
+func TestFlushProgressLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(logger gokitlog.Logger) { util_log.Logger = logger }(util_log.Logger)
+	util_log.Logger = gokitlog.NewLogfmtLogger(gokitlog.NewSyncWriter(&buf))
+
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushProgressLogInterval = 10 * time.Millisecond
+	store, ing := newTestStore(t, cfg, nil)
+	pushTestSamples(t, ing)
+
+	// Slow down the drain so that the progress is logged at least once.
+	store.onPut = func(_ context.Context, _ []chunk.Chunk) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	require.Contains(t, buf.String(), "waiting for flush queues to drain")
+}
+
 type fullWAL struct{}
 
-func (fullWAL) Log(_ *WALRecord) error { return &os.PathError{Err: syscall.ENOSPC} }
-func (fullWAL) Start()                 {}
-func (fullWAL) Stop() error            { return nil }
+func (fullWAL) Log(_ *WALRecord) error             { return &os.PathError{Err: syscall.ENOSPC} }
+func (fullWAL) Start()                             {}
+func (fullWAL) Stop() error                        { return nil }
+func (fullWAL) Checkpoint(_ context.Context) error { return nil }
+
+func Benchmark_FlushLoop(b *testing.B) {
+	var (
+		size   = 5
+		descs  [][]*chunkDesc
+		lbs    = makeRandomLabels()
+		ctx    = user.InjectOrgID(context.Background(), "foo")
+		_, ing = newTestStore(b, defaultIngesterTestConfig(b), nil)
+	)
+
+	for i := 0; i < size; i++ {
+		descs = append(descs, buildChunkDecs(b))
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		var wg sync.WaitGroup
+		for i := 0; i < size; i++ {
+			wg.Add(1)
+			go func(loop int) {
+				defer wg.Done()
+				require.NoError(b, ing.flushChunks(ctx, "foo", 0, lbs, descs[loop], &sync.RWMutex{}))
+			}(i)
+		}
+		wg.Wait()
+	}
+}
+
+func Benchmark_FlushChunkHeaderSizeEstimate(b *testing.B) {
+	for _, estimate := range []int{defaultChunkHeaderSizeEstimate, 512} {
+		b.Run(fmt.Sprintf("estimate=%d", estimate), func(b *testing.B) {
+			cfg := defaultIngesterTestConfig(b)
+			cfg.ChunkHeaderSizeEstimate = estimate
+			_, ing := newTestStore(b, cfg, nil)
+			defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+			var (
+				lbs = makeRandomLabels()
+				ctx = user.InjectOrgID(context.Background(), "foo")
+			)
+			descs := make([]*chunkDesc, 10)
+			for i := range descs {
+				// tiny chunks, where the header room dominates the allocation.
+				descs[i] = &chunkDesc{
+					closed: true,
+					chunk:  chunkenc.NewMemChunk(chunkenc.EncSnappy, chunkenc.UnorderedHeadBlockFmt, dummyConf().BlockSize, dummyConf().TargetChunkSize),
+				}
+				require.NoError(b, descs[i].chunk.Append(&logproto.Entry{Timestamp: time.Unix(0, 0), Line: "line"}))
+				require.NoError(b, descs[i].chunk.Close())
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				require.NoError(b, ing.flushChunks(ctx, "foo", 0, lbs, descs, &sync.RWMutex{}))
+			}
+		})
+	}
+}
+
+func Test_Flush(t *testing.T) {
+	var (
+		store, ing = newTestStore(t, defaultIngesterTestConfig(t), nil)
+		lbs        = makeRandomLabels()
+		ctx        = user.InjectOrgID(context.Background(), "foo")
+	)
+	store.onPut = func(ctx context.Context, chunks []chunk.Chunk) error {
+		for _, c := range chunks {
+			buf, err := c.Encoded()
+			require.Nil(t, err)
+			if err := c.Decode(chunk.NewDecodeContext(), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	require.NoError(t, ing.flushChunks(ctx, "foo", 0, lbs, buildChunkDecs(t), &sync.RWMutex{}))
+}
+
+func TestFlushDeadLetter(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushDeadLetterPath = filepath.Join(t.TempDir(), "dead-letter.log")
+
+	store, ing := newTestStore(t, cfg, nil)
+	store.onPut = func(ctx context.Context, chunks []chunk.Chunk) error {
+		return errors.New("store is down")
+	}
+
+	const userID = "testUser"
+	ctx := user.InjectOrgID(context.Background(), userID)
+	now := time.Unix(0, 0)
+	_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "l"}.String(), Entries: entries(5, now)},
+	}})
+	require.NoError(t, err)
+
+	inst, ok := ing.getInstanceByID(userID)
+	require.True(t, ok)
+	s, ok := inst.streams.Load(model.LabelSet{"app": "l"}.String())
+	require.True(t, ok)
+
+	require.Error(t, ing.flushUserSeries(userID, s.fp, true))
+
+	f, err := os.Open(cfg.FlushDeadLetterPath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var record deadLetterRecord
+	require.NoError(t, json.NewDecoder(f).Decode(&record))
+	require.Equal(t, userID, record.Tenant)
+	require.Equal(t, s.fp.String(), record.Fingerprint)
+	require.Equal(t, `{app="l"}`, record.Labels)
+	require.True(t, now.Equal(record.From))
+	require.Greater(t, record.Bytes, 0)
+	require.Equal(t, "store is down", record.Error)
+
+	// let the shutdown flush succeed.
+	store.onPut = nil
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+}
+
+func TestFlushQueuePushback(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.ConcurrentFlushes = 2
+	cfg.FlushQueuePushbackThreshold = 2
+	cfg.FlushQueuePushbackPeriod = time.Minute
+
+	ing := &Ingester{
+		cfg:           cfg,
+		flushQueues:   []*util.PriorityQueue{util.NewPriorityQueue(nil), util.NewPriorityQueue(nil)},
+		flushPushback: atomic.NewBool(false),
+		metrics:       newIngesterMetrics(nil),
+	}
+
+	now := time.Now()
+	for fp := model.Fingerprint(0); fp < 3; fp++ {
+		ing.flushQueues[fp%2].Enqueue(&flushOp{userID: "fake", fp: fp})
+	}
+
+	// Depth above the threshold, but not for long enough yet.
+	ing.updateFlushPushback(now)
+	require.False(t, ing.flushPushback.Load())
+	ing.updateFlushPushback(now.Add(30 * time.Second))
+	require.False(t, ing.flushPushback.Load())
+
+	ing.updateFlushPushback(now.Add(time.Minute))
+	require.True(t, ing.flushPushback.Load())
+
+	// Draining the queues turns the pushback off.
+	ing.flushQueues[0].Dequeue()
+	ing.updateFlushPushback(now.Add(2 * time.Minute))
+	require.False(t, ing.flushPushback.Load())
+}
+
+func TestFlushAttemptsMetric(t *testing.T) {
+	store := &testStore{
+		chunks: map[string][]chunk.Chunk{},
+	}
+	var puts int
+	store.onPut = func(ctx context.Context, chunks []chunk.Chunk) error {
+		puts++
+		if puts <= 2 {
+			return errors.New("store is flaky")
+		}
+		return nil
+	}
+
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	ing, err := New(defaultIngesterTestConfig(t), client.Config{}, store, limits, runtime.DefaultTenantConfigs(), reg)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	ctx := user.InjectOrgID(context.Background(), "testUser")
+	_, err = ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "l"}.String(), Entries: entries(5, time.Unix(0, 0))},
+	}})
+	require.NoError(t, err)
+
+	ing.sweepUsers(true, false)
+
+	expected := `
+# HELP loki_ingester_flush_attempts Number of attempts made by a flush operation before it succeeded or was dropped.
+# TYPE loki_ingester_flush_attempts histogram
+loki_ingester_flush_attempts_bucket{le="1"} 0
+loki_ingester_flush_attempts_bucket{le="2"} 0
+loki_ingester_flush_attempts_bucket{le="4"} 1
+loki_ingester_flush_attempts_bucket{le="8"} 1
+loki_ingester_flush_attempts_bucket{le="16"} 1
+loki_ingester_flush_attempts_bucket{le="32"} 1
+loki_ingester_flush_attempts_bucket{le="64"} 1
+loki_ingester_flush_attempts_bucket{le="128"} 1
+loki_ingester_flush_attempts_bucket{le="+Inf"} 1
+loki_ingester_flush_attempts_sum 3
+loki_ingester_flush_attempts_count 1
+`
+	require.Eventually(t, func() bool {
+		return testutil.GatherAndCompare(reg, strings.NewReader(expected), "loki_ingester_flush_attempts") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCloseAllChunksHandler(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+	pushTestSamples(t, ing)
+
+	w := httptest.NewRecorder()
+	ing.CloseAllChunksHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/chunks/close-all", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	for _, inst := range ing.getInstances() {
+		require.NoError(t, inst.streams.ForEach(func(s *stream) (bool, error) {
+			s.chunkMtx.RLock()
+			defer s.chunkMtx.RUnlock()
+			head := s.chunks[len(s.chunks)-1]
+			require.True(t, head.closed)
+			require.True(t, head.flushed.IsZero())
+			return true, nil
+		}))
+		require.Empty(t, store.getChunksForUser(inst.instanceID))
+	}
+}
+
+func TestMaxMemoryChunks(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	// Every test stream holds a single chunk, so going two above the limit must flush two streams.
+	cfg.MaxMemoryChunks = 3*numSeries - 2
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+	pushTestSamples(t, ing)
+
+	flushedBefore := testutil.ToFloat64(chunksFlushedPerReason.WithLabelValues(flushReasonPressure))
+	flushedChunks := func() int {
+		var n int
+		for _, userID := range []string{"1", "2", "3"} {
+			n += len(store.getChunksForUser(userID))
+		}
+		return n
+	}
+
+	ing.sweepUsers(false, false)
+	require.Eventually(t, func() bool { return flushedChunks() == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, float64(2), testutil.ToFloat64(chunksFlushedPerReason.WithLabelValues(flushReasonPressure))-flushedBefore)
+
+	// The flushed chunks are on their way out of memory, so another sweep must not flush more.
+	ing.sweepUsers(false, false)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 2, flushedChunks())
+}
+
+func TestMaxMemoryChunksOldestFirst(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.MaxMemoryChunks = 3
+	cfg.MemoryPressureFlushOrder = pressureFlushOrderOldest
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	// Minutes since the single entry of every stream, interleaving the ages across tenants.
+	ages := map[string][]int{
+		"a": {50, 10, 30},
+		"b": {40, 20, 60},
+	}
+	now := time.Now()
+	for userID, streamAges := range ages {
+		for j, age := range streamAges {
+			_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{
+				Streams: []logproto.Stream{{
+					Labels:  fmt.Sprintf(`{stream="%s%d"}`, userID, j),
+					Entries: []logproto.Entry{{Timestamp: now.Add(-time.Duration(age) * time.Minute), Line: strings.Repeat("x", 10*(3-j))}},
+				}},
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	ing.sweepUsers(false, false)
+	flushedStreams := func() []string {
+		var streams []string
+		for userID := range ages {
+			for _, c := range store.getChunksForUser(userID) {
+				streams = append(streams, c.Metric.Get("stream"))
+			}
+		}
+		sort.Strings(streams)
+		return streams
+	}
+	require.Eventually(t, func() bool { return len(flushedStreams()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"a0", "b0", "b2"}, flushedStreams())
+}
+
+func TestChunkFlushStatusHandler(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	_, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	_, err := ing.Push(user.InjectOrgID(context.Background(), "1"), &logproto.PushRequest{
+		Streams: []logproto.Stream{{
+			Labels:  `{app="foo"}`,
+			Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}, {Timestamp: time.Unix(2, 0), Line: "b"}},
+		}},
+	})
+	require.NoError(t, err)
+
+	inst, ok := ing.getInstanceByID("1")
+	require.True(t, ok)
+	var s *stream
+	_ = inst.streams.ForEach(func(st *stream) (bool, error) {
+		s = st
+		return false, nil
+	})
+
+	// The first chunk is flushed, a second one holding later data isn't.
+	flushedAt := time.Unix(100, 0)
+	head := chunkenc.NewMemChunk(chunkenc.EncGZIP, chunkenc.UnorderedHeadBlockFmt, cfg.BlockSize, cfg.TargetChunkSize)
+	require.NoError(t, head.Append(&logproto.Entry{Timestamp: time.Unix(10, 0), Line: "c"}))
+	s.chunkMtx.Lock()
+	s.chunks[0].closed = true
+	s.chunks[0].flushed = flushedAt
+	s.chunks = append(s.chunks, chunkDesc{chunk: head})
+	s.chunkMtx.Unlock()
+
+	getStatus := func(fp, from, through string) (int, ChunkFlushStatus) {
+		w := httptest.NewRecorder()
+		ing.ChunkFlushStatusHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/ingester/flush/chunk?tenant=1&fingerprint=%s&from=%s&through=%s", fp, from, through), nil))
+		var status ChunkFlushStatus
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		}
+		return w.Code, status
+	}
+
+	code, status := getStatus(s.fp.String(), "1", "2")
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, status.Flushed)
+	require.True(t, flushedAt.Equal(*status.FlushedAt))
+
+	code, status = getStatus(s.fp.String(), "10", "10")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, ChunkFlushStatus{}, status)
+
+	code, _ = getStatus(s.fp.String(), "1", "10")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = getStatus("0000000000000001", "1", "2")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = getStatus("nope", "1", "2")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestResetChunkFlushStatusHandler(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	const userID = "testUser"
+	_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+	}})
+	require.NoError(t, err)
+	inst, ok := ing.getInstanceByID(userID)
+	require.True(t, ok)
+	s, ok := inst.streams.Load(model.LabelSet{"app": "l"}.String())
+	require.True(t, ok)
+
+	require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+	require.Len(t, store.getChunksForUser(userID), 1)
+
+	reset := func(force string) int {
+		w := httptest.NewRecorder()
+		ing.ResetChunkFlushStatusHandler(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/ingester/flush/chunk/reset?tenant=%s&fingerprint=%s&from=1&through=1&force=%s", userID, s.fp, force), nil))
+		return w.Code
+	}
+	require.Equal(t, http.StatusBadRequest, reset(""))
+	status, _ := ing.chunkFlushStatus(userID, s.fp, model.TimeFromUnix(1), model.TimeFromUnix(1))
+	require.True(t, status.Flushed)
+
+	require.Equal(t, http.StatusNoContent, reset("true"))
+	status, _ = ing.chunkFlushStatus(userID, s.fp, model.TimeFromUnix(1), model.TimeFromUnix(1))
+	require.False(t, status.Flushed)
+
+	// The chunk is flushed again.
+	require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+	require.Len(t, store.getChunksForUser(userID), 2)
+	status, _ = ing.chunkFlushStatus(userID, s.fp, model.TimeFromUnix(1), model.TimeFromUnix(1))
+	require.True(t, status.Flushed)
+}
+
+func TestExtraFlushLabels(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.ExtraFlushLabels = map[string]string{"cluster": "eu-west", "app": "ignored"}
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	const userID = "testUser"
+	_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+	}})
+	require.NoError(t, err)
+	inst, ok := ing.getInstanceByID(userID)
+	require.True(t, ok)
+	s, ok := inst.streams.Load(model.LabelSet{"app": "l"}.String())
+	require.True(t, ok)
+
+	// The labels of the stream take precedence.
+	require.Equal(t, `{app="l", cluster="eu-west"}`, s.labels.String())
+
+	// The ingester returns the same series as the store.
+	ctx := user.InjectOrgID(context.Background(), userID)
+	result := mockQuerierServer{ctx: ctx}
+	require.NoError(t, ing.Query(&logproto.QueryRequest{
+		Selector: `{cluster="eu-west"}`,
+		Limit:    100,
+		Start:    time.Unix(0, 0),
+		End:      time.Unix(2, 0),
+	}, &result))
+	require.Len(t, result.resps, 1)
+	require.Len(t, result.resps[0].Streams, 1)
+	require.Equal(t, `{app="l", cluster="eu-west"}`, result.resps[0].Streams[0].Labels)
+
+	require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+	chunks := store.getChunksForUser(userID)
+	require.Len(t, chunks, 1)
+	require.Equal(t, "eu-west", chunks[0].Metric.Get("cluster"))
+	require.Equal(t, "l", chunks[0].Metric.Get("app"))
+	require.Equal(t, uint64(s.fp), chunks[0].Fingerprint)
+}
+
+func TestSweepConcurrency(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.SweepConcurrency = 2
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	lbs := model.LabelSet{"app": "l"}.String()
+	for _, userID := range []string{"blocked", "swept"} {
+		_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: lbs, Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+		}})
+		require.NoError(t, err)
+	}
+	inst, ok := ing.getInstanceByID("blocked")
+	require.True(t, ok)
+	blocked, ok := inst.streams.Load(lbs)
+	require.True(t, ok)
+
+	// The sweep of a tenant doesn't wait for the others.
+	blocked.chunkMtx.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ing.sweepUsers(true, false)
+	}()
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser("swept")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	blocked.chunkMtx.Unlock()
+
+	<-done
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser("blocked")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFlushBeforeHandler(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	for _, userID := range []string{"old", "recent"} {
+		ts := time.Unix(1, 0)
+		if userID == "recent" {
+			ts = time.Unix(10, 0)
+		}
+		_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: ts, Line: "a"}}},
+		}})
+		require.NoError(t, err)
+	}
+
+	flushBefore := func(cutoff string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ing.FlushBeforeHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/flush/before?cutoff="+cutoff, nil))
+		return w
+	}
+	require.Equal(t, http.StatusBadRequest, flushBefore("").Code)
+
+	// Neither chunk is idle nor old enough to be flushed otherwise.
+	flushedBefore := testutil.ToFloat64(chunksFlushedPerReason.WithLabelValues(flushReasonCutoff))
+	w := flushBefore("5")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"streams": 1}`, w.Body.String())
+	require.Eventually(t, func() bool {
+		unflushed := ing.unflushedData(time.Now())
+		return len(unflushed) == 1 && unflushed[0].Tenant == "recent"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, store.getChunksForUser("old"), 1)
+	require.Empty(t, store.getChunksForUser("recent"))
+	require.Equal(t, float64(1), testutil.ToFloat64(chunksFlushedPerReason.WithLabelValues(flushReasonCutoff))-flushedBefore)
+
+	// Flushed chunks aren't scheduled again.
+	require.JSONEq(t, `{"streams": 0}`, flushBefore("5").Body.String())
+}
+
+func TestFlushPause(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	w := httptest.NewRecorder()
+	ing.FlushPauseHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/flush/pause", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, float64(1), testutil.ToFloat64(ing.metrics.flushPaused))
+
+	const userID = "testUser"
+	_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+	}})
+	require.NoError(t, err)
+	ing.sweepUsers(true, false)
+
+	// Nothing is put while paused, the flush stays queued.
+	require.Never(t, func() bool {
+		return len(store.getChunksForUser(userID)) > 0
+	}, 200*time.Millisecond, 10*time.Millisecond)
+
+	w = httptest.NewRecorder()
+	ing.FlushResumeHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/flush/resume", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, float64(0), testutil.ToFloat64(ing.metrics.flushPaused))
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser(userID)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Flushing can't be paused anymore once stopping, which would hang the flush on shutdown.
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	w = httptest.NewRecorder()
+	ing.FlushPauseHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/flush/pause", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, float64(0), testutil.ToFloat64(ing.metrics.flushPaused))
+}
+
+func TestFlushConcurrencyHandler(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	setConcurrency := func(n string) int {
+		w := httptest.NewRecorder()
+		ing.FlushConcurrencyHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/flush/concurrency?n="+n, nil))
+		return w.Code
+	}
+	queues := func() int {
+		q, _ := ing.flushQueuesSnapshot()
+		return len(q)
+	}
+
+	require.Equal(t, http.StatusNoContent, setConcurrency("4"))
+	require.Equal(t, 4, queues())
+	require.Eventually(t, func() bool { return ing.flushWorkers.Load() == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	// Queue flushes in every queue, which the removed workers still flush before exiting.
+	_, err := ing.flushPause.pause()
+	require.NoError(t, err)
+	const userID = "testUser"
+	var streams []logproto.Stream
+	for j := 0; j < 20; j++ {
+		streams = append(streams, logproto.Stream{
+			Labels:  model.LabelSet{"app": model.LabelValue(fmt.Sprint(j))}.String(),
+			Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}},
+		})
+	}
+	_, err = ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: streams})
+	require.NoError(t, err)
+	ing.sweepUsers(true, false)
+
+	require.Equal(t, http.StatusNoContent, setConcurrency("1"))
+	require.Equal(t, 1, queues())
+	require.Equal(t, int32(4), ing.flushWorkers.Load())
+
+	ing.flushPause.resume()
+	require.Eventually(t, func() bool { return ing.flushWorkers.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser(userID)) == len(streams)
+	}, 5*time.Second, 10*time.Millisecond)
+	// Only the remaining queue reports its last successful flush.
+	require.Equal(t, 1, testutil.CollectAndCount(ing.metrics.flushLastSuccess))
+
+	require.Equal(t, http.StatusBadRequest, setConcurrency("0"))
+	require.Equal(t, http.StatusBadRequest, setConcurrency("many"))
+	require.Equal(t, 1, queues())
+}
+
+func TestFlushConcurrencyShrinkWhileRetrying(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.ConcurrentFlushes = 2
+	// Every stream goes to the last queue, which the shrink removes.
+	cfg.FlushScheduler = lastQueueFlushScheduler{}
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	putting, release := make(chan struct{}), make(chan struct{})
+	var failed bool
+	store.mtx.Lock()
+	store.onPut = func(ctx context.Context, chunks []chunk.Chunk) error {
+		if failed {
+			userID, err := tenant.TenantID(ctx)
+			if err != nil {
+				return err
+			}
+			store.chunks[userID] = append(store.chunks[userID], chunks...)
+			return nil
+		}
+		failed = true
+		close(putting)
+		<-release
+		return errors.New("store unavailable")
+	}
+	store.mtx.Unlock()
+
+	const userID = "testUser"
+	_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{{
+		Labels:  model.LabelSet{"app": "foo"}.String(),
+		Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}},
+	}}})
+	require.NoError(t, err)
+	ing.sweepUsers(true, false)
+
+	// The immediate flush fails once the queue it came from got removed, it's retried by the remaining loop.
+	<-putting
+	require.NoError(t, ing.setConcurrentFlushes(1))
+	close(release)
+
+	require.Eventually(t, func() bool {
+		store.mtx.Lock()
+		defer store.mtx.Unlock()
+		return len(store.chunks[userID]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return ing.flushWorkers.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.NotNil(t, ing.flushStatsSnapshot().Queues[0].LastFlush)
+}
+
+// newIngesterWithIdleFlushQueues returns an ingester which isn't started, so that no flush loop
+// dequeues from its flush queues and they can be inspected.
+func newIngesterWithIdleFlushQueues(t *testing.T, cfg Config, limits *validation.Overrides) *Ingester {
+	t.Helper()
+	ing, err := New(cfg, client.Config{}, &testStore{chunks: map[string][]chunk.Chunk{}}, limits, runtime.DefaultTenantConfigs(), nil)
+	require.NoError(t, err)
+	for j := range ing.flushQueues {
+		ing.flushQueues[j] = util.NewPriorityQueue(flushQueueLength)
+	}
+	return ing
+}
+
+func TestFlushRebalance(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.ConcurrentFlushes = 4
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+
+	ing := newIngesterWithIdleFlushQueues(t, cfg, limits)
+
+	w := httptest.NewRecorder()
+	ing.FlushRebalanceHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/flush/rebalance", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// All the ops are pending in the first queue.
+	keys := map[string]bool{}
+	for fp := model.Fingerprint(0); fp < 40; fp++ {
+		op := &flushOp{userID: "fake", fp: fp, from: model.Time(fp)}
+		ing.flushQueues[0].Enqueue(op)
+		keys[op.Key()] = true
+	}
+
+	require.NoError(t, ing.rebalanceFlushQueues())
+
+	// A later sweep enqueues the ops of the moved streams to their new queue, where they are already pending.
+	for fp := model.Fingerprint(0); fp < 40; fp++ {
+		ing.enqueueFlushOp(&flushOp{userID: "fake", fp: fp, from: model.Time(fp)})
+	}
+	for _, queue := range ing.flushQueues {
+		require.Equal(t, 10, queue.Length())
+		for _, op := range queue.Drain() {
+			require.True(t, keys[op.Key()], op.Key())
+			delete(keys, op.Key())
+		}
+	}
+	require.Empty(t, keys)
+
+	ing.closeFlushQueues(true)
+	require.ErrorIs(t, ing.rebalanceFlushQueues(), errFlushQueuesClosed)
+}
+
+func TestFlushBatching(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushBatchWindow = 500 * time.Millisecond
+	cfg.FlushBatchMaxChunks = 3
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	type put struct {
+		tenant string
+		chunks int
+	}
+	var puts []put
+	store.mtx.Lock()
+	store.onPut = func(ctx context.Context, chunks []chunk.Chunk) error {
+		tenant, err := tenant.TenantID(ctx)
+		if err != nil {
+			return err
+		}
+		puts = append(puts, put{tenant: tenant, chunks: len(chunks)})
+		return nil
+	}
+	store.mtx.Unlock()
+
+	// flush flushes a chunk of a distinct stream of every tenant concurrently, and returns how long it took.
+	flush := func(tenants ...string) time.Duration {
+		chunks := make([]*chunkDesc, len(tenants))
+		for j := range chunks {
+			chunks[j] = &chunkDesc{chunk: chunkenc.NewMemChunk(chunkenc.EncSnappy, chunkenc.UnorderedHeadBlockFmt, cfg.BlockSize, cfg.TargetChunkSize)}
+			require.NoError(t, chunks[j].chunk.Append(&logproto.Entry{Timestamp: time.Unix(1, 0), Line: "line"}))
+		}
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		errs := make([]error, len(tenants))
+		for j, userID := range tenants {
+			wg.Add(1)
+			go func(j int, userID string) {
+				defer wg.Done()
+				errs[j] = ing.flushChunks(context.Background(), userID, model.Fingerprint(j), makeRandomLabels(), []*chunkDesc{chunks[j]}, &sync.RWMutex{})
+			}(j, userID)
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+		for j := range tenants {
+			require.NoError(t, errs[j])
+			require.False(t, chunks[j].flushed.IsZero())
+		}
+		return elapsed
+	}
+
+	// A full batch is put right away.
+	require.Less(t, int64(flush("foo", "foo", "foo")), int64(cfg.FlushBatchWindow))
+	require.Equal(t, []put{{tenant: "foo", chunks: 3}}, puts)
+
+	// Partial batches are put once the window closes, every tenant in its own.
+	puts = nil
+	require.GreaterOrEqual(t, int64(flush("foo", "foo", "bar")), int64(cfg.FlushBatchWindow))
+	sort.Slice(puts, func(a, b int) bool { return puts[a].tenant < puts[b].tenant })
+	require.Equal(t, []put{{tenant: "bar", chunks: 1}, {tenant: "foo", chunks: 2}}, puts)
+
+	// By default, a batch is full once it holds as many chunks as there are flush loops.
+	ing.cfg.FlushBatchMaxChunks = 0
+	require.Equal(t, 1, ing.flushBatchMaxChunks())
+	require.NoError(t, ing.setConcurrentFlushes(3))
+	require.Eventually(t, func() bool { return ing.flushWorkers.Load() == 3 }, 5*time.Second, 10*time.Millisecond)
+	puts = nil
+	require.Less(t, int64(flush("foo", "foo", "foo")), int64(cfg.FlushBatchWindow))
+	require.Equal(t, []put{{tenant: "foo", chunks: 3}}, puts)
+}
+
+type fakeFlushEventSink struct {
+	mtx    sync.Mutex
+	events []FlushEvent
+}
+
+func (s *fakeFlushEventSink) Publish(event FlushEvent) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *fakeFlushEventSink) published() []FlushEvent {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]FlushEvent(nil), s.events...)
+}
+
+func TestFlushEvents(t *testing.T) {
+	sink := &fakeFlushEventSink{}
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushEventSink = sink
+	cfg.FlushEventBufferSize = 10
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	const userID = "testUser"
+	lbs := model.LabelSet{"app": "l"}
+	_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: lbs.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}, {Timestamp: time.Unix(2, 0), Line: "b"}}},
+	}})
+	require.NoError(t, err)
+	ing.sweepUsers(true, false)
+
+	require.Eventually(t, func() bool {
+		return len(sink.published()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	chunks := store.getChunksForUser(userID)
+	require.Len(t, chunks, 1)
+	buf, err := chunks[0].Encoded()
+	require.NoError(t, err)
+
+	event := sink.published()[0]
+	require.Equal(t, FlushEvent{
+		Tenant:      userID,
+		Fingerprint: model.Fingerprint(chunks[0].Fingerprint),
+		Reason:      flushReasonForced,
+		Chunks:      1,
+		Bytes:       len(buf),
+	}, event)
+}
+
+func TestFlushLoopRecoversFromPanics(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	var stored int
+	store.mtx.Lock()
+	store.onPut = func(_ context.Context, chunks []chunk.Chunk) error {
+		if chunks[0].UserID == "panicking" {
+			panic("nil chunk")
+		}
+		stored++
+		return nil
+	}
+	store.mtx.Unlock()
+	storedChunks := func() int {
+		store.mtx.Lock()
+		defer store.mtx.Unlock()
+		return stored
+	}
+
+	for _, userID := range []string{"panicking", "healthy"} {
+		_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+		}})
+		require.NoError(t, err)
+	}
+
+	// The immediate flush panicking isn't retried, and the flush loop carries on with the others.
+	ing.sweepUsers(true, false)
+	require.Eventually(t, func() bool {
+		return storedChunks() == 1 && ing.flushQueueDepth() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ing.metrics.flushPanics) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The flush loop is still running.
+	_, err := ing.Push(user.InjectOrgID(context.Background(), "healthy"), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "other"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+	}})
+	require.NoError(t, err)
+	ing.sweepUsers(true, false)
+	require.Eventually(t, func() bool {
+		return storedChunks() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFlushWithNilOverrides(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.MaxChunkIdle = 7 * time.Minute
+	store := &testStore{chunks: map[string][]chunk.Chunk{}}
+	ing, err := New(cfg, client.Config{}, store, nil, runtime.DefaultTenantConfigs(), nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	// The default limits apply, falling back to the ingester config.
+	const userID = "testUser"
+	require.Equal(t, cfg.MaxChunkIdle, ing.maxChunkIdle(userID))
+	require.Equal(t, cfg.MaxChunkAge, ing.maxChunkAge(userID))
+	require.Equal(t, cfg.RetainPeriod, ing.retainPeriod(userID))
+	require.Equal(t, 0, ing.flushPriorityClass(userID))
+
+	_, err = ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+	}})
+	require.NoError(t, err)
+	ing.sweepUsers(true, false)
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser(userID)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRetainPeriodDuringWALReplay(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.RetainPeriod = time.Hour
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+	ing, err := New(cfg, client.Config{}, &testStore{chunks: map[string][]chunk.Chunk{}}, limits, runtime.DefaultTenantConfigs(), nil)
+	require.NoError(t, err)
+
+	// The flushed chunks aren't retained while replaying, the replay toggling the limiter meanwhile.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for j := 0; j < 100; j++ {
+			ing.limiter.DisableForWALReplay()
+			ing.limiter.Enable()
+		}
+	}()
+	for j := 0; j < 100; j++ {
+		_ = ing.retainPeriod("fake")
+	}
+	<-done
+
+	ing.limiter.DisableForWALReplay()
+	require.Equal(t, time.Duration(0), ing.retainPeriod("fake"))
+	ing.limiter.Enable()
+	require.Equal(t, time.Hour, ing.retainPeriod("fake"))
+}
+
+func TestUndersizedChunks(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			cfg := defaultIngesterTestConfig(t)
+			if enabled {
+				cfg.UndersizedChunkUtilization = 0.5
+			}
+			_, ing := newTestStore(t, cfg, nil)
+			defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+			const userID = "testUser"
+			_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+				{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+			}})
+			require.NoError(t, err)
+			inst, ok := ing.getInstanceByID(userID)
+			require.True(t, ok)
+			s, ok := inst.streams.Load(model.LabelSet{"app": "l"}.String())
+			require.True(t, ok)
+
+			before := testutil.ToFloat64(undersizedChunks.WithLabelValues(flushReasonForced))
+			require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+			var expected float64
+			if enabled {
+				expected = 1
+			}
+			require.Equal(t, expected, testutil.ToFloat64(undersizedChunks.WithLabelValues(flushReasonForced))-before)
+		})
+	}
+}
+
+func TestStreamLastFlushed(t *testing.T) {
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	const userID = "testUser"
+	push := func(ts time.Time) {
+		_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: ts, Line: "a"}}},
+		}})
+		require.NoError(t, err)
+	}
+	push(time.Unix(1, 0))
+	inst, ok := ing.getInstanceByID(userID)
+	require.True(t, ok)
+	s, ok := inst.streams.Load(model.LabelSet{"app": "l"}.String())
+	require.True(t, ok)
+	lastFlushed := func() time.Time {
+		s.chunkMtx.RLock()
+		defer s.chunkMtx.RUnlock()
+		return s.lastFlushed
+	}
+
+	// A stream is unflushed since the oldest entry of its unflushed chunks.
+	require.True(t, lastFlushed().IsZero())
+	now := time.Unix(100, 0)
+	require.Equal(t, []TenantUnflushedData{
+		{Tenant: userID, Streams: 1, OldestUnflushed: time.Unix(1, 0), OldestUnflushedAge: 99},
+	}, ing.unflushedData(now))
+
+	before := time.Now()
+	require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+	flushed := lastFlushed()
+	require.False(t, flushed.Before(before))
+	require.Empty(t, ing.unflushedData(now))
+
+	// Even after a flush, which doesn't make the older data left behind any younger.
+	push(time.Unix(2, 0))
+	require.Equal(t, []TenantUnflushedData{
+		{Tenant: userID, Streams: 1, OldestUnflushed: time.Unix(2, 0), OldestUnflushedAge: 98},
+	}, ing.unflushedData(now))
+
+	w := httptest.NewRecorder()
+	ing.UnflushedDataHandler(w, httptest.NewRequest(http.MethodGet, "/ingester/unflushed", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"tenant":"testUser","streams":1`)
+
+	require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+	require.True(t, lastFlushed().After(flushed))
+}
+
+func TestFlushStatsHandler(t *testing.T) {
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+	pushTestSamples(t, ing)
+	ing.sweepUsers(true, false)
+
+	getStats := func() map[string]interface{} {
+		w := httptest.NewRecorder()
+		ing.FlushStatsHandler(w, httptest.NewRequest(http.MethodGet, "/ingester/flush/stats", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var stats map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		return stats
+	}
+
+	require.Eventually(t, func() bool {
+		queues := getStats()["queues"].([]interface{})
+		_, ok := queues[0].(map[string]interface{})["last_flush"]
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats := getStats()
+	require.Contains(t, stats, "queue_depth")
+	require.Contains(t, stats, "memory_chunks")
+	queues := stats["queues"].([]interface{})
+	require.Len(t, queues, 1)
+	queue := queues[0].(map[string]interface{})
+	require.Contains(t, queue, "depth")
+	require.Equal(t, float64(0), queue["failures"])
+
+	// The streams are only counted for the handler, not for every snapshot.
+	require.Eventually(t, func() bool {
+		stats := ing.flushStatsSnapshot()
+		return stats.QueueDepth == 0 && stats.InFlight == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	var streams int
+	for _, instance := range ing.getInstances() {
+		streams += instance.numStreams()
+	}
+	require.Equal(t, float64(streams), getStats()["queues"].([]interface{})[0].(map[string]interface{})["streams"])
+	require.Zero(t, ing.flushStatsSnapshot().Queues[0].Streams)
+}
+
+func TestFlushQueueHashDistribution(t *testing.T) {
+	const queues = 16
+	// Clustered fingerprints, all multiples of the number of queues.
+	fps := make([]model.Fingerprint, 0, 10000)
+	for j := 0; j < cap(fps); j++ {
+		fps = append(fps, model.Fingerprint(j*queues*4))
+	}
+
+	// skew is the ratio of the busiest queue to the mean number of streams per queue.
+	skew := func(hash string) float64 {
+		counts := make([]int, queues)
+		for _, fp := range fps {
+			counts[flushQueueIndex(hash, fp, queues)]++
+		}
+		var max int
+		for _, c := range counts {
+			if c > max {
+				max = c
+			}
+		}
+		return float64(max) / (float64(len(fps)) / queues)
+	}
+
+	require.Equal(t, float64(queues), skew(flushQueueHashModulo))
+	require.Less(t, skew(flushQueueHashXXHash), 1.2)
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		from     string
+		expected string
+	}{
+		{expr: "0 * * * *", from: "2022-03-01T10:00:00Z", expected: "2022-03-01T11:00:00Z"},
+		{expr: "*/15 * * * *", from: "2022-03-01T10:07:30Z", expected: "2022-03-01T10:15:00Z"},
+		{expr: "30 2 * * 1-5", from: "2022-03-05T00:00:00Z", expected: "2022-03-07T02:30:00Z"},
+		{expr: "0 0 1,15 * *", from: "2022-03-02T00:00:00Z", expected: "2022-03-15T00:00:00Z"},
+		{expr: "0 0 29 2 *", from: "2022-03-01T00:00:00Z", expected: "2024-02-29T00:00:00Z"},
+		{expr: "0 0 13 * 5", from: "2022-03-01T00:00:00Z", expected: "2022-03-04T00:00:00Z"},
+		{expr: "0 0 * * 7", from: "2022-03-01T00:00:00Z", expected: "2022-03-06T00:00:00Z"},
+		{expr: "0 0 30 2 *", from: "2022-03-01T00:00:00Z"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			s, err := parseCronSchedule(tc.expr)
+			require.NoError(t, err)
+			from, err := time.Parse(time.RFC3339, tc.from)
+			require.NoError(t, err)
+
+			next := s.next(from)
+			if tc.expected == "" {
+				require.True(t, next.IsZero())
+				return
+			}
+			require.Equal(t, tc.expected, next.Format(time.RFC3339))
+		})
+	}
+}
+
+func TestFlushCron(t *testing.T) {
+	schedule, err := parseCronSchedule("*/15 * * * *")
+	require.NoError(t, err)
+
+	// Fake clock jumping to the end of every wait.
+	now := time.Date(2022, 3, 1, 10, 7, 0, 0, time.UTC)
+	s := newFlushCron(schedule)
+	s.now = func() time.Time { return now }
+	s.after = func(d time.Duration) <-chan time.Time {
+		now = now.Add(d)
+		c := make(chan time.Time, 1)
+		c <- now
+		return c
+	}
+
+	var sweeps []string
+	quit := make(chan struct{})
+	s.run(quit, func() {
+		sweeps = append(sweeps, now.Format("15:04"))
+		if len(sweeps) == 3 {
+			close(quit)
+			// Never fire again, so that run returns on quit.
+			s.after = func(time.Duration) <-chan time.Time { return nil }
+		}
+	})
+	require.Equal(t, []string{"10:15", "10:30", "10:45"}, sweeps)
+}
+
+func TestFlushHandlerTimeRange(t *testing.T) {
+	const userID = "testUser"
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	ctx := user.InjectOrgID(context.Background(), userID)
+	_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{app="old"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(1000, 0), Line: "old"}}},
+		{Labels: `{app="new"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(5000, 0), Line: "new"}}},
+	}})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"from=not-a-time", http.StatusBadRequest},
+		{"from=5000&to=1000", http.StatusBadRequest},
+		{"from=2000&to=3000", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		ing.FlushHandler(w, httptest.NewRequest(http.MethodPost, "/flush?"+tc.query, nil))
+		require.Equal(t, tc.code, w.Code, tc.query)
+	}
+	require.Empty(t, store.getChunksForUser(userID))
+
+	w := httptest.NewRecorder()
+	ing.FlushHandler(w, httptest.NewRequest(http.MethodPost, "/flush?from=1970-01-01T01:00:00Z&to=6000", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"streams": 1}`, w.Body.String())
+
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser(userID)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "new", store.getChunksForUser(userID)[0].Metric.Get("app"))
+}
+
+// putConcurrencyStore records the highest number of concurrent Put calls.
+type putConcurrencyStore struct {
+	*testStore
+	puts, inFlight, maxInFlight atomic.Int32
+}
+
+func (s *putConcurrencyStore) Put(ctx context.Context, chunks []chunk.Chunk) error {
+	s.puts.Inc()
+	n := s.inFlight.Inc()
+	defer s.inFlight.Dec()
+	for {
+		m := s.maxInFlight.Load()
+		if n <= m || s.maxInFlight.CAS(m, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return s.testStore.Put(ctx, chunks)
+}
+
+// objectRefStore reports object references made of the chunk keys and a version.
+type objectRefStore struct {
+	*testStore
+}
+
+func (s *objectRefStore) PutWithObjectRefs(ctx context.Context, chunks []chunk.Chunk) ([]string, error) {
+	if err := s.testStore.Put(ctx, chunks); err != nil {
+		return nil, err
+	}
+	refs := make([]string, 0, len(chunks))
+	for _, c := range chunks {
+		refs = append(refs, config.SchemaConfig{}.ExternalKey(c.ChunkRef)+"?version=1")
+	}
+	return refs, nil
+}
+
+func TestFlushReceipts(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		objectRefs bool
+	}{
+		{name: "chunk keys"},
+		{name: "object refs", objectRefs: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var receipts []FlushReceipt
+			cfg := defaultIngesterTestConfig(t)
+			cfg.OnFlushReceipts = func(r []FlushReceipt) { receipts = append(receipts, r...) }
+			store, ing := newTestStore(t, cfg, nil)
+			defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+			if tc.objectRefs {
+				ing.store = &objectRefStore{store}
+			}
+
+			ctx := user.InjectOrgID(context.Background(), "foo")
+			require.NoError(t, ing.flushChunks(ctx, "foo", 42, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}))
+
+			stored := store.getChunksForUser("foo")
+			require.Len(t, receipts, len(stored))
+			for j, c := range stored {
+				key := config.SchemaConfig{}.ExternalKey(c.ChunkRef)
+				ref := key
+				if tc.objectRefs {
+					ref += "?version=1"
+				}
+				require.Equal(t, FlushReceipt{
+					Tenant:      "foo",
+					Fingerprint: 42,
+					From:        c.From,
+					Through:     c.Through,
+					Checksum:    c.Checksum,
+					ChunkKey:    key,
+					ObjectRef:   ref,
+				}, receipts[j])
+			}
+		})
+	}
+}
+
+func TestFlushStorePutConcurrency(t *testing.T) {
+	for _, concurrency := range []int{1, 3} {
+		concurrency := concurrency
+		t.Run(fmt.Sprintf("concurrency=%d", concurrency), func(t *testing.T) {
+			cfg := defaultIngesterTestConfig(t)
+			cfg.StorePutConcurrency = concurrency
+			store, ing := newTestStore(t, cfg, nil)
+			defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+			putStore := &putConcurrencyStore{testStore: store}
+			ing.store = putStore
+
+			ctx := user.InjectOrgID(context.Background(), "foo")
+			require.NoError(t, ing.flushChunks(ctx, "foo", 0, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}))
+
+			require.Len(t, store.getChunksForUser("foo"), 10)
+			require.Equal(t, int32(concurrency), putStore.maxInFlight.Load())
+			// Every chunk is put in its own request.
+			require.Equal(t, int32(10), putStore.puts.Load())
+		})
+	}
+}
+
+func TestFlushPartialProgressOnDeadline(t *testing.T) {
+	// Every chunk is put in its own request, even one at a time by default.
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	// A slow store, taking longer to store the whole batch than the deadline allows.
+	var (
+		mtx    sync.Mutex
+		stored []chunk.Chunk
+	)
+	delay := 20 * time.Millisecond
+	ing.store = &testStore{onPut: func(ctx context.Context, chunks []chunk.Chunk) error {
+		select {
+		case <-time.After(delay):
+			mtx.Lock()
+			defer mtx.Unlock()
+			stored = append(stored, chunks...)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+
+	descs := buildChunkDecs(t)
+	ctx, cancel := context.WithTimeout(user.InjectOrgID(context.Background(), "foo"), 5*delay)
+	defer cancel()
+	err := ing.flushChunks(ctx, "foo", 0, makeRandomLabels(), descs, &sync.RWMutex{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The chunks stored before the deadline stay flushed, only the other ones are retried.
+	pending := pendingChunks(descs)
+	require.NotEmpty(t, stored)
+	require.Len(t, pending, len(descs)-len(stored))
+
+	delay = 0
+	ctx = user.InjectOrgID(context.Background(), "foo")
+	require.NoError(t, ing.flushChunks(ctx, "foo", 0, makeRandomLabels(), pending, &sync.RWMutex{}))
+	require.Len(t, stored, len(descs))
+	require.Empty(t, pendingChunks(descs))
+}
+
+type tenantLimitsMock map[string]*validation.Limits
+
+func (m tenantLimitsMock) TenantLimits(userID string) *validation.Limits { return m[userID] }
+func (m tenantLimitsMock) AllByUserID() map[string]*validation.Limits    { return m }
+
+func TestFlushChunksLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(logger gokitlog.Logger) { util_log.Logger = logger }(util_log.Logger)
+	util_log.Logger = gokitlog.NewLogfmtLogger(gokitlog.NewSyncWriter(&buf))
+
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	ctx := user.InjectOrgID(context.Background(), "foo")
+	require.NoError(t, ing.flushChunks(ctx, "foo", 42, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}))
+	// Nothing else is logged while reading the logs.
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+
+	var storedBytes int
+	for _, c := range store.getChunksForUser("foo") {
+		b, err := c.Encoded()
+		require.NoError(t, err)
+		storedBytes += len(b)
+	}
+
+	logs := map[string]map[string]string{}
+	dec := logfmt.NewDecoder(&buf)
+	for dec.ScanRecord() {
+		fields := map[string]string{}
+		for dec.ScanKeyval() {
+			fields[string(dec.Key())] = string(dec.Value())
+		}
+		logs[fields["msg"]] = fields
+	}
+	require.NoError(t, dec.Err())
+
+	for msg, expected := range map[string]map[string]string{
+		"flushing chunks": {"level": "debug", "org_id": "foo", "fp": "000000000000002a", "chunks": "10"},
+		"flushed chunks": {
+			"level":         "debug",
+			"org_id":        "foo",
+			"fp":            "000000000000002a",
+			"chunks":        "10",
+			"stored_chunks": "10",
+			"stored_bytes":  strconv.Itoa(storedBytes),
+			"err":           "null",
+		},
+	} {
+		for k, v := range expected {
+			require.Equal(t, v, logs[msg][k], "%s: %s", msg, k)
+		}
+	}
+	_, err := time.ParseDuration(logs["flushed chunks"]["duration"])
+	require.NoError(t, err)
+}
+
+func TestFlushTracing(t *testing.T) {
+	reporter := jaeger.NewInMemoryReporter()
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), reporter)
+	defer closer.Close()
+	defer opentracing.SetGlobalTracer(opentracing.GlobalTracer())
+	opentracing.SetGlobalTracer(tracer)
+
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushTracing = true
+	store, ing := newTestStore(t, cfg, nil)
+
+	pushSpan := tracer.StartSpan("push")
+	ctx := opentracing.ContextWithSpan(user.InjectOrgID(context.Background(), "foo"), pushSpan)
+	_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{app="foo"}`, Entries: entries(5, time.Now())},
+	}})
+	require.NoError(t, err)
+	pushSpan.Finish()
+
+	instance, ok := ing.getInstanceByID("foo")
+	require.True(t, ok)
+	var fp model.Fingerprint
+	require.NoError(t, instance.streams.ForEach(func(s *stream) (bool, error) {
+		fp = s.fp
+		return false, nil
+	}))
+	require.NoError(t, ing.flushUserSeries("foo", fp, true))
+
+	var storedBytes int
+	for _, c := range store.getChunksForUser("foo") {
+		b, err := c.Encoded()
+		require.NoError(t, err)
+		storedBytes += len(b)
+	}
+	require.Greater(t, storedBytes, 0)
+
+	spans := map[string]*jaeger.Span{}
+	for _, sp := range reporter.GetSpans() {
+		spans[sp.(*jaeger.Span).OperationName()] = sp.(*jaeger.Span)
+	}
+	flushSpan, encodeSpan, putSpan := spans["flushUserSeries"], spans["encodeChunks"], spans["putChunks"]
+	require.NotNil(t, flushSpan)
+	require.NotNil(t, encodeSpan)
+	require.NotNil(t, putSpan)
+
+	require.Equal(t, opentracing.Tags{"tenant": "foo", "fp": fp.String(), "chunks": 1}, flushSpan.Tags())
+	require.Equal(t, opentracing.Tags{"chunks": 1, "bytes": storedBytes}, encodeSpan.Tags())
+	require.Equal(t, opentracing.Tags{"chunks": 1, "bytes": storedBytes}, putSpan.Tags())
+
+	// The flush follows from the push, and the phases are children of the flush.
+	require.Len(t, flushSpan.References(), 1)
+	require.Equal(t, opentracing.FollowsFromRef, flushSpan.References()[0].Type)
+	require.Equal(t, pushSpan.Context(), flushSpan.References()[0].ReferencedContext)
+	require.Equal(t, flushSpan.SpanContext().SpanID(), encodeSpan.SpanContext().ParentID())
+	require.Equal(t, flushSpan.SpanContext().SpanID(), putSpan.SpanContext().ParentID())
+}
+
+func TestFlushSkippedChunks(t *testing.T) {
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	_, err := ing.Push(user.InjectOrgID(context.Background(), "foo"), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{app="foo"}`, Entries: entries(5, time.Now())},
+	}})
+	require.NoError(t, err)
+	instance, ok := ing.getInstanceByID("foo")
+	require.True(t, ok)
+	var s *stream
+	require.NoError(t, instance.streams.ForEach(func(stream *stream) (bool, error) {
+		s = stream
+		return false, nil
+	}))
+
+	// The pushed chunk got flushed already, and an empty chunk got closed.
+	s.chunkMtx.Lock()
+	s.chunks[0].flushed = time.Now()
+	s.chunks = append(s.chunks, chunkDesc{chunk: s.NewChunk(), closed: true})
+	s.chunkMtx.Unlock()
+
+	alreadyFlushed := testutil.ToFloat64(chunksFlushSkipped.WithLabelValues(flushSkipAlreadyFlushed))
+	empty := testutil.ToFloat64(chunksFlushSkipped.WithLabelValues(flushSkipEmpty))
+	chunks, _ := ing.collectChunksToFlush(instance, s.fp, true, time.Time{})
+	require.Empty(t, chunks)
+	require.Equal(t, 1.0, testutil.ToFloat64(chunksFlushSkipped.WithLabelValues(flushSkipAlreadyFlushed))-alreadyFlushed)
+	require.Equal(t, 1.0, testutil.ToFloat64(chunksFlushSkipped.WithLabelValues(flushSkipEmpty))-empty)
+
+	// The empty chunk is released from memory like a flushed one.
+	s.chunkMtx.RLock()
+	defer s.chunkMtx.RUnlock()
+	require.False(t, s.chunks[1].flushed.IsZero())
+}
+
+func TestFlushBeforeRingLeave(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	kvClient := cfg.LifecyclerConfig.RingConfig.KVStore.Mock
+	store, ing := newTestStore(t, cfg, nil)
+
+	inRing := func() (ring.InstanceState, bool) {
+		desc, _ := kvClient.Get(context.Background(), RingKey)
+		if desc == nil {
+			return 0, false
+		}
+		instance, ok := desc.(*ring.Desc).Ingesters[cfg.LifecyclerConfig.ID]
+		return instance.State, ok
+	}
+	state, ok := inRing()
+	require.True(t, ok)
+	require.Equal(t, ring.ACTIVE, state)
+
+	testData := pushTestSamples(t, ing)
+
+	// Observed in the lifecycler goroutine once flushed.
+	var (
+		flushed        bool
+		flushedTenants int
+		flushedState   ring.InstanceState
+		flushedInRing  bool
+	)
+	ing.onShutdownFlushed = func() {
+		flushed = true
+		for userID := range testData {
+			if len(store.getChunksForUser(userID)) > 0 {
+				flushedTenants++
+			}
+		}
+		flushedState, flushedInRing = inRing()
+	}
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+
+	// Every chunk got stored while the ingester was still in the ring, before leaving it.
+	require.True(t, flushed)
+	require.Equal(t, len(testData), flushedTenants)
+	require.True(t, flushedInRing)
+	require.Equal(t, ring.LEAVING, flushedState)
+	store.checkData(t, testData)
+	_, ok = inRing()
+	require.False(t, ok)
+}
+
+func TestFlushSkipFlushMetrics(t *testing.T) {
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	skipped := defaultLimitsTestConfig()
+	skipped.SkipFlushMetrics = true
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), tenantLimitsMock{"synthetic": &skipped})
+	require.NoError(t, err)
+	ing.limiter = NewLimiter(limits, NilMetrics, &ringCountMock{count: 1}, 1)
+
+	for _, userID := range []string{"synthetic", "production"} {
+		ctx := user.InjectOrgID(context.Background(), userID)
+		require.NoError(t, ing.flushChunks(ctx, userID, 0, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}))
+	}
+
+	// Deleting reports whether the series existed.
+	require.False(t, chunksPerTenant.DeleteLabelValues("synthetic"))
+	require.False(t, chunkSizePerTenant.DeleteLabelValues("synthetic"))
+	require.True(t, chunksPerTenant.DeleteLabelValues("production"))
+	require.True(t, chunkSizePerTenant.DeleteLabelValues("production"))
+}
+
+func TestFlushBytesPerReason(t *testing.T) {
+	const userID = "testUser"
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	ctx := user.InjectOrgID(context.Background(), userID)
+	_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{app="full"}`, Entries: entries(100, time.Now().Add(-time.Minute))},
+		{Labels: `{app="forced"}`, Entries: entries(10, time.Now().Add(-time.Minute))},
+	}})
+	require.NoError(t, err)
+
+	inst, ok := ing.getInstanceByID(userID)
+	require.True(t, ok)
+	full, ok := inst.streams.Load(`{app="full"}`)
+	require.True(t, ok)
+	forced, ok := inst.streams.Load(`{app="forced"}`)
+	require.True(t, ok)
+
+	before := map[string]float64{}
+	for _, reason := range []string{flushReasonFull, flushReasonForced} {
+		before[reason] = testutil.ToFloat64(chunkBytesFlushedPerReason.WithLabelValues(reason))
+	}
+
+	full.chunkMtx.Lock()
+	full.chunks[len(full.chunks)-1].closed = true
+	full.chunkMtx.Unlock()
+	require.NoError(t, ing.flushUserSeries(userID, full.fp, false))
+	require.NoError(t, ing.flushUserSeries(userID, forced.fp, true))
+
+	flushed := map[string]float64{}
+	for _, c := range store.getChunksForUser(userID) {
+		b, err := c.Encoded()
+		require.NoError(t, err)
+		flushed[c.Metric.Get("app")] += float64(len(b))
+	}
+	require.Len(t, flushed, 2)
+
+	for _, reason := range []string{flushReasonFull, flushReasonForced} {
+		require.Equal(t, flushed[reason], testutil.ToFloat64(chunkBytesFlushedPerReason.WithLabelValues(reason))-before[reason], reason)
+	}
+}
+
+func TestFlushPerTenantChunkUtilization(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			cfg := defaultIngesterTestConfig(t)
+			cfg.PerTenantChunkUtilization = enabled
+			_, ing := newTestStore(t, cfg, nil)
+			defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+			const userID = "utilization"
+			ctx := user.InjectOrgID(context.Background(), userID)
+			require.NoError(t, ing.flushChunks(ctx, userID, 0, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}))
+
+			if !enabled {
+				require.Equal(t, 0, testutil.CollectAndCount(chunkUtilizationPerTenant))
+				return
+			}
+			require.Equal(t, 1, testutil.CollectAndCount(chunkUtilizationPerTenant))
+			var m dto.Metric
+			require.NoError(t, chunkUtilizationPerTenant.WithLabelValues(userID).(prometheus.Metric).Write(&m))
+			require.Equal(t, uint64(10), m.GetHistogram().GetSampleCount())
+			chunkUtilizationPerTenant.Reset()
+		})
+	}
+}
+
+func TestFlushSettingsFollowOverrides(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	tenantLimits := tenantLimitsMock{}
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), tenantLimits)
+	require.NoError(t, err)
+	ing.limiter = NewLimiter(limits, NilMetrics, &ringCountMock{count: 1}, 1)
+
+	pushTestSamples(t, ing)
+	ing.sweepUsers(false, false)
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, store.getChunksForUser("1"))
+
+	// Reload the overrides of a single tenant at runtime.
+	overridden := defaultLimitsTestConfig()
+	overridden.ChunkIdlePeriod = model.Duration(time.Nanosecond)
+	tenantLimits["1"] = &overridden
+	require.Equal(t, time.Nanosecond, ing.maxChunkIdle("1"))
+
+	ing.sweepUsers(false, false)
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser("1")) == numSeries
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, store.getChunksForUser("2"))
+	require.Empty(t, store.getChunksForUser("3"))
+}
+
+func TestFlushTenantOverMemoryLimit(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	capped := defaultLimitsTestConfig()
+	capped.MaxTenantMemoryBytes = 1000
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), tenantLimitsMock{"big": &capped, "small": &capped})
+	require.NoError(t, err)
+	ing.limiter = NewLimiter(limits, NilMetrics, &ringCountMock{count: 1}, 1)
+
+	// Both tenants have young and active streams, only the big one is over the limit.
+	for userID, n := range map[string]int{"big": 200, "small": 10} {
+		ctx := user.InjectOrgID(context.Background(), userID)
+		_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: `{app="a"}`, Entries: entries(n, time.Now())},
+			{Labels: `{app="b"}`, Entries: entries(n, time.Now())},
+		}})
+		require.NoError(t, err)
+	}
+
+	ing.sweepUsers(false, true)
+	require.Eventually(t, func() bool { return len(store.getChunksForUser("big")) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, store.getChunksForUser("small"))
+
+	for userID, flushed := range map[string]bool{"big": true, "small": false} {
+		inst, ok := ing.getInstanceByID(userID)
+		require.True(t, ok)
+		if flushed {
+			require.Greater(t, inst.unflushedBytes.Load(), int64(1000))
+			// The chunks are marked flushed right after being stored.
+			require.Eventually(t, func() bool { return inst.updateUnflushedBytes() == 0 }, 5*time.Second, 10*time.Millisecond)
+		} else {
+			require.Positive(t, inst.unflushedBytes.Load())
+			require.LessOrEqual(t, inst.unflushedBytes.Load(), int64(1000))
+		}
+	}
+}
+
+func TestFlushLagPerTenant(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.PerTenantFlushLag = true
+	_, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+	defer flushLagPerTenant.DeleteLabelValues("lagging")
+	defer flushLagPerTenant.DeleteLabelValues("current")
+
+	now := time.Now()
+	for userID, streams := range map[string][]logproto.Stream{
+		"lagging": {
+			{Labels: `{app="old"}`, Entries: entries(5, now.Add(-time.Hour))},
+			{Labels: `{app="new"}`, Entries: entries(5, now)},
+		},
+		"current": {
+			{Labels: `{app="new"}`, Entries: entries(5, now)},
+		},
+	} {
+		_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: streams})
+		require.NoError(t, err)
+	}
+
+	ing.sweepUsers(false, false)
+	require.InDelta(t, time.Hour.Seconds(), testutil.ToFloat64(flushLagPerTenant.WithLabelValues("lagging")), 10)
+	require.Less(t, testutil.ToFloat64(flushLagPerTenant.WithLabelValues("current")), float64(10))
+
+	// Nothing is left to lose once everything is flushed.
+	ing.sweepUsers(true, false)
+	require.Eventually(t, func() bool {
+		ing.sweepUsers(false, false)
+		return testutil.ToFloat64(flushLagPerTenant.WithLabelValues("lagging")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFlushPriorityClass(t *testing.T) {
+	critical := defaultLimitsTestConfig()
+	critical.FlushPriorityClass = 10
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), tenantLimitsMock{"3": &critical})
+	require.NoError(t, err)
+
+	ing := newIngesterWithIdleFlushQueues(t, defaultIngesterTestConfig(t), limits)
+
+	// Tenant 3 has the most recent data, which would otherwise be flushed last.
+	pushTestSamples(t, ing)
+	ing.sweepUsers(true, false)
+
+	queue := ing.flushQueues[0]
+	require.Equal(t, 3*numSeries, queue.Length())
+	for j := 0; j < 3*numSeries; j++ {
+		op := queue.Dequeue().(*flushOp)
+		if j < numSeries {
+			require.Equal(t, "3", op.userID)
+		} else {
+			require.NotEqual(t, "3", op.userID)
+		}
+	}
+}
+
+func TestFlushOpPriorityImmediateFirst(t *testing.T) {
+	queue := util.NewPriorityQueue(nil)
+	queue.Enqueue(&flushOp{userID: "fake", fp: 1, from: 0})
+	queue.Enqueue(&flushOp{userID: "fake", fp: 2, from: model.Now(), immediate: true})
+	queue.Enqueue(&flushOp{userID: "fake", fp: 3, from: model.Now(), immediate: true, priorityClass: validation.MaxFlushPriorityClass})
+
+	// Immediate ops come first despite their more recent data, by priority class.
+	for _, fp := range []model.Fingerprint{3, 2, 1} {
+		require.Equal(t, fp, queue.Dequeue().(*flushOp).fp)
+	}
+}
+
+func TestFlushFairQueueing(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushFairQueueing = true
+	premium := defaultLimitsTestConfig()
+	premium.FlushWeight = 3
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), tenantLimitsMock{"premium": &premium})
+	require.NoError(t, err)
+
+	ing := newIngesterWithIdleFlushQueues(t, cfg, limits)
+
+	// Both tenants are behind, the basic tenant with older data.
+	for fp := model.Fingerprint(0); fp < 30; fp++ {
+		ing.enqueueFlushOp(&flushOp{userID: "basic", fp: fp, from: 1})
+	}
+	for fp := model.Fingerprint(0); fp < 30; fp++ {
+		ing.enqueueFlushOp(&flushOp{userID: "premium", fp: fp, from: 2})
+	}
+
+	served := map[string]int{}
+	for j := 0; j < 20; j++ {
+		op := ing.flushQueues[0].Dequeue().(*flushOp)
+		ing.flushFair.serve(op)
+		served[op.userID]++
+	}
+	require.Equal(t, map[string]int{"premium": 15, "basic": 5}, served)
+
+	// A tenant which was idle gets its share from now on, despite its older data, without catching
+	// up on the time it was idle.
+	ing.enqueueFlushOp(&flushOp{userID: "idle", fp: 0, from: 0})
+	var next []string
+	for j := 0; j < 3; j++ {
+		next = append(next, ing.flushQueues[0].Dequeue().(*flushOp).userID)
+	}
+	require.Equal(t, []string{"premium", "premium", "idle"}, next)
+}
+
+func TestFlushFairQueueingRepeatedSweeps(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushFairQueueing = true
+	premium := defaultLimitsTestConfig()
+	premium.FlushWeight = 3
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), tenantLimitsMock{"premium": &premium})
+	require.NoError(t, err)
+
+	ing := newIngesterWithIdleFlushQueues(t, cfg, limits)
+
+	// Every sweep enqueues the whole backlog of both tenants again, most of it still queued, while
+	// the flush loop keeps up with a few ops per sweep. The backlogs don't weigh on the shares.
+	served := map[string]int{}
+	for sweep := 0; sweep < 10; sweep++ {
+		for fp := model.Fingerprint(0); fp < 4; fp++ {
+			ing.enqueueFlushOp(&flushOp{userID: "basic", fp: fp, from: 1})
+		}
+		for fp := model.Fingerprint(0); fp < 40; fp++ {
+			ing.enqueueFlushOp(&flushOp{userID: "premium", fp: fp, from: 1})
+		}
+		for j := 0; j < 4; j++ {
+			op := ing.flushQueues[0].Dequeue().(*flushOp)
+			ing.flushFair.serve(op)
+			served[op.userID]++
+		}
+	}
+	require.Equal(t, map[string]int{"premium": 30, "basic": 10}, served)
+}
+
+func TestDisabledFlushMetrics(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.DisabledFlushMetrics = []string{"loki_ingester_chunk_age_seconds"}
+	require.NoError(t, cfg.Validate())
+
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	_, err = New(cfg, client.Config{}, &testStore{chunks: map[string][]chunk.Chunk{}}, limits, runtime.DefaultTenantConfigs(), reg)
+	require.NoError(t, err)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	names := map[string]bool{}
+	for _, mf := range families {
+		names[mf.GetName()] = true
+	}
+	require.False(t, names["loki_ingester_chunk_age_seconds"])
+	require.True(t, names["loki_ingester_chunk_bounds_hours"])
+
+	cfg.DisabledFlushMetrics = []string{"loki_ingester_memory_chunks"}
+	require.Error(t, cfg.Validate())
+}
+
+func TestFlushChunkCloseErrorPolicy(t *testing.T) {
+	for _, policy := range []string{chunkCloseErrorRetry, chunkCloseErrorDrop, chunkCloseErrorQuarantine} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := defaultIngesterTestConfig(t)
+			cfg.OnChunkCloseError = policy
+			cfg.FlushDeadLetterPath = filepath.Join(t.TempDir(), "dead-letters.jsonl")
+			require.NoError(t, cfg.Validate())
+			store, ing := newTestStore(t, cfg, nil)
+			defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+			descs := buildChunkDecs(t)
+			bad := descs[1].chunk
+			ing.closeChunk = func(c *chunkenc.MemChunk) error {
+				if c == bad {
+					return errors.New("corrupt chunk")
+				}
+				return c.Close()
+			}
+			discarded := testutil.ToFloat64(chunksDiscardedOnCloseError.WithLabelValues(policy))
+
+			ctx := user.InjectOrgID(context.Background(), "foo")
+			err := ing.flushChunks(ctx, "foo", 0, makeRandomLabels(), descs, &sync.RWMutex{})
+
+			records, readErr := os.ReadFile(cfg.FlushDeadLetterPath)
+			require.NoError(t, readErr)
+			if policy == chunkCloseErrorRetry {
+				require.EqualError(t, err, "corrupt chunk")
+				require.Empty(t, store.getChunksForUser("foo"))
+				require.Empty(t, records)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, store.getChunksForUser("foo"), len(descs)-1)
+			require.False(t, descs[1].flushed.IsZero())
+			require.Equal(t, discarded+1, testutil.ToFloat64(chunksDiscardedOnCloseError.WithLabelValues(policy)))
+			if policy == chunkCloseErrorDrop {
+				require.Empty(t, records)
+				return
+			}
+
+			var record deadLetterRecord
+			require.NoError(t, json.Unmarshal(records, &record))
+			require.Equal(t, "foo", record.Tenant)
+			require.Equal(t, "corrupt chunk", record.Error)
+		})
+	}
+}
+
+func TestFlushReasonCounts(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+
+	idle := defaultLimitsTestConfig()
+	idle.ChunkIdlePeriod = model.Duration(time.Nanosecond)
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), tenantLimitsMock{"1": &idle})
+	require.NoError(t, err)
+	ing.limiter = NewLimiter(limits, NilMetrics, &ringCountMock{count: 1}, 1)
+
+	pushTestSamples(t, ing)
+	require.Empty(t, ing.FlushReasonCounts())
+
+	// The chunks of tenant 1 are flushed as idle, the other ones are forced on shutdown.
+	ing.sweepUsers(false, false)
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser("1")) == numSeries
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+
+	require.Equal(t, map[string]uint64{
+		flushReasonIdle:   numSeries,
+		flushReasonForced: 2 * numSeries,
+	}, ing.FlushReasonCounts())
+}
+
+func TestFlushStallDetection(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(logger gokitlog.Logger) { util_log.Logger = logger }(util_log.Logger)
+	util_log.Logger = gokitlog.NewLogfmtLogger(gokitlog.NewSyncWriter(&buf))
+
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushStallThreshold = time.Minute
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+	store := &testStore{chunks: map[string][]chunk.Chunk{}}
+	reg := prometheus.NewRegistry()
+	ing, err := New(cfg, client.Config{}, store, limits, runtime.DefaultTenantConfigs(), reg)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+
+	// Stall the flush loop on the store.
+	release := make(chan struct{})
+	store.onPut = func(_ context.Context, _ []chunk.Chunk) error {
+		<-release
+		return nil
+	}
+	pushTestSamples(t, ing)
+	ing.sweepUsers(true, false)
+	require.Eventually(t, func() bool {
+		return ing.flushStatsSnapshot().InFlight == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Nothing got flushed yet.
+	require.Equal(t, float64(0), testutil.ToFloat64(ing.metrics.flushLastSuccess.WithLabelValues("0")))
+	require.Equal(t, 0, ing.checkFlushStalls(time.Now()))
+	require.Equal(t, 1, ing.checkFlushStalls(time.Now().Add(2*cfg.FlushStallThreshold)))
+	require.Contains(t, buf.String(), "flush queue is not making progress")
+
+	// Paused queues aren't expected to make progress.
+	_, err = ing.flushPause.pause()
+	require.NoError(t, err)
+	require.Equal(t, 0, ing.checkFlushStalls(time.Now().Add(2*cfg.FlushStallThreshold)))
+	ing.flushPause.resume()
+
+	close(release)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ing.metrics.flushLastSuccess.WithLabelValues("0")) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	require.Equal(t, 0, ing.checkFlushStalls(time.Now().Add(2*cfg.FlushStallThreshold)))
+}
+
+func TestFlushMinChunkAge(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.MaxChunkIdle = time.Minute
+	cfg.MinChunkAge = time.Hour
+	ing := &Ingester{cfg: cfg}
+
+	now := time.Now()
+	c := &chunkDesc{
+		chunk:       chunkenc.NewMemChunk(chunkenc.EncSnappy, chunkenc.UnorderedHeadBlockFmt, cfg.BlockSize, cfg.TargetChunkSize),
+		lastUpdated: now.Add(-2 * cfg.MaxChunkIdle),
+	}
+	require.NoError(t, c.chunk.Append(&logproto.Entry{Timestamp: now.Add(-10 * time.Minute), Line: "young"}))
+
+	// Idle, but too young to be flushed.
+	shouldFlush, _ := ing.shouldFlushChunk("foo", c)
+	require.False(t, shouldFlush)
+
+	// Once aged past the minimum.
+	require.NoError(t, c.chunk.Append(&logproto.Entry{Timestamp: now.Add(-2 * cfg.MinChunkAge), Line: "old"}))
+	shouldFlush, reason := ing.shouldFlushChunk("foo", c)
+	require.True(t, shouldFlush)
+	require.Equal(t, flushReasonIdle, reason)
+}
+
+func TestRemoveFlushedChunksRacingWrite(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.RetainPeriod = 0
+	_, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	inst := ing.GetOrCreateInstance("foo")
+	push := func(ts time.Time) {
+		require.NoError(t, inst.Push(context.Background(), &logproto.PushRequest{Streams: []logproto.Stream{{
+			Labels:  `{app="foo"}`,
+			Entries: []logproto.Entry{{Timestamp: ts, Line: "line"}},
+		}}}))
+	}
+	flushAll := func(s *stream) {
+		s.chunkMtx.Lock()
+		defer s.chunkMtx.Unlock()
+		for j := range s.chunks {
+			s.chunks[j].flushed = time.Now().Add(-time.Hour)
+		}
+	}
+
+	now := time.Now()
+	push(now)
+	var s *stream
+	_ = inst.streams.ForEach(func(st *stream) (bool, error) {
+		s = st
+		return false, nil
+	})
+	flushAll(s)
+
+	// A write lands while the emptied stream is unlocked, before it gets removed.
+	ing.beforeStreamRemoval = func(*stream) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			push(now.Add(time.Second))
+		}()
+		<-done
+	}
+	ing.removeFlushedChunks(inst, s, true)
+
+	require.Equal(t, 1, inst.streams.Len())
+	s.chunkMtx.RLock()
+	require.Len(t, s.chunks, 1)
+	require.Equal(t, 1, s.chunks[0].chunk.Size())
+	s.chunkMtx.RUnlock()
+
+	// Without a racing write, the stream is removed once its chunks are flushed.
+	ing.beforeStreamRemoval = nil
+	flushAll(s)
+	ing.removeFlushedChunks(inst, s, true)
+	require.Equal(t, 0, inst.streams.Len())
+}
+
+func TestEvictFlushedChunksHandler(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.RetainPeriod = time.Hour
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	const userID = "testUser"
+	_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+	}})
+	require.NoError(t, err)
+	ing.sweepUsers(true, true)
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser(userID)) == 1 && len(ing.unflushedData(time.Now())) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The flushed chunk is retained.
+	ing.sweepUsers(false, true)
+	inst, ok := ing.getInstanceByID(userID)
+	require.True(t, ok)
+	s, ok := inst.streams.Load(model.LabelSet{"app": "l"}.String())
+	require.True(t, ok)
+	numChunks := func() int {
+		s.chunkMtx.RLock()
+		defer s.chunkMtx.RUnlock()
+		return len(s.chunks)
+	}
+	require.Equal(t, 1, numChunks())
+
+	chunksBefore := testutil.ToFloat64(memoryChunks)
+	w := httptest.NewRecorder()
+	ing.EvictFlushedChunksHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/chunks/evict-flushed", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"chunks": 1}`, w.Body.String())
+	require.Equal(t, 0, numChunks())
+	require.Equal(t, chunksBefore-1, testutil.ToFloat64(memoryChunks))
+}
+
+func TestFlushLabelLimits(t *testing.T) {
+	limits := defaultLimitsTestConfig()
+	limits.MaxLabelNamesPerSeries = 2
+	limits.MaxLabelValueLength = 5
+	overrides, err := validation.NewOverrides(limits, nil)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		policy   string
+		lbs      string
+		expected string // Empty if discarded.
+	}{
+		{policy: flushLabelLimitsIgnore, lbs: `{app="verylong"}`, expected: `{app="verylong"}`},
+		{policy: flushLabelLimitsReject, lbs: `{app="short"}`, expected: `{app="short"}`},
+		{policy: flushLabelLimitsReject, lbs: `{app="verylong"}`},
+		{policy: flushLabelLimitsReject, lbs: `{a="1", b="2", c="3"}`},
+		{policy: flushLabelLimitsTruncate, lbs: `{app="verylong", env="prod"}`, expected: `{app="veryl", env="prod"}`},
+		// The value is truncated before the multi-byte rune crossing the limit.
+		{policy: flushLabelLimitsTruncate, lbs: `{app="abcdé"}`, expected: `{app="abcd"}`},
+		{policy: flushLabelLimitsTruncate, lbs: `{a="1", b="2", c="3"}`},
+	} {
+		t.Run(tc.policy+tc.lbs, func(t *testing.T) {
+			cfg := defaultIngesterTestConfig(t)
+			cfg.FlushLabelLimits = tc.policy
+			store, ing := newTestStore(t, cfg, nil)
+			defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+			ing.limiter.limits = overrides
+
+			const userID = "testUser"
+			discardedBefore := testutil.ToFloat64(chunksDiscardedOnLabelLimits)
+			discardedBytesBefore := testutil.ToFloat64(chunkBytesDiscardedOnLabelLimits)
+			_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+				{Labels: tc.lbs, Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+			}})
+			require.NoError(t, err)
+			ing.sweepUsers(true, false)
+
+			// Discarded chunks are marked as flushed too.
+			require.Eventually(t, func() bool {
+				return len(ing.unflushedData(time.Now())) == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			chunks := store.getChunksForUser(userID)
+			if tc.expected == "" {
+				require.Empty(t, chunks)
+				require.Equal(t, float64(1), testutil.ToFloat64(chunksDiscardedOnLabelLimits)-discardedBefore)
+				require.Equal(t, float64(1), testutil.ToFloat64(chunkBytesDiscardedOnLabelLimits)-discardedBytesBefore)
+				return
+			}
+			require.Equal(t, discardedBefore, testutil.ToFloat64(chunksDiscardedOnLabelLimits))
+			require.Len(t, chunks, 1)
+			require.Equal(t, tc.expected, chunks[0].Metric.String())
+		})
+	}
+}
+
+func TestFlushMetricsPerBackend(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+	ing.periodicConfigs = []config.PeriodConfig{
+		{From: config.DayTime{Time: 0}, IndexType: "boltdb-shipper", ObjectType: "gcs"},
+		{From: config.DayTime{Time: model.TimeFromUnix(24 * 3600)}, IndexType: "boltdb-shipper", ObjectType: "s3"},
+	}
 
-func Benchmark_FlushLoop(b *testing.B) {
+	before := map[string]float64{}
+	for _, backend := range []string{"gcs", "s3"} {
+		before[backend] = testutil.ToFloat64(chunksPerBackend.WithLabelValues(backend))
+	}
+
+	const userID = "testUser"
+	_, err := ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"period": "first"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(3600, 0), Line: "a"}}},
+		{Labels: model.LabelSet{"period": "second"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(2*24*3600, 0), Line: "a"}}},
+		{Labels: model.LabelSet{"period": "second", "app": "other"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(3*24*3600, 0), Line: "a"}}},
+	}})
+	require.NoError(t, err)
+	ing.sweepUsers(true, false)
+	require.Eventually(t, func() bool {
+		return len(store.getChunksForUser(userID)) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(chunksPerBackend.WithLabelValues("gcs"))-before["gcs"] == 1 &&
+			testutil.ToFloat64(chunksPerBackend.WithLabelValues("s3"))-before["s3"] == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Greater(t, testutil.ToFloat64(chunkSizePerBackend.WithLabelValues("s3")), float64(0))
+}
+
+func TestFlushChunksOutsideSchema(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushDeadLetterPath = filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+	// The chunks built by buildChunkDecs start at the Unix epoch, before the first period.
+	ing.periodicConfigs = []config.PeriodConfig{
+		{From: config.DayTime{Time: model.TimeFromUnix(24 * 3600)}, IndexType: "boltdb-shipper", ObjectType: "gcs"},
+	}
+
+	inPeriod := &chunkDesc{
+		closed: true,
+		chunk:  chunkenc.NewMemChunk(chunkenc.EncSnappy, chunkenc.UnorderedHeadBlockFmt, dummyConf().BlockSize, dummyConf().TargetChunkSize),
+	}
+	require.NoError(t, inPeriod.chunk.Append(&logproto.Entry{Timestamp: time.Unix(2*24*3600, 0), Line: "a"}))
+	require.NoError(t, inPeriod.chunk.Close())
+	outside := buildChunkDecs(t)[:2]
+	chunks := append([]*chunkDesc{inPeriod}, outside...)
+
+	// The chunks in a period are stored, the others are discarded.
+	before := testutil.ToFloat64(chunksOutsideSchema)
+	require.NoError(t, ing.flushChunks(context.Background(), "foo", 42, makeRandomLabels(), chunks, &sync.RWMutex{}))
+	require.Len(t, store.getChunksForUser("foo"), 1)
+	require.Empty(t, pendingChunks(chunks))
+	require.Equal(t, float64(len(outside)), testutil.ToFloat64(chunksOutsideSchema)-before)
+
+	deadLetters, err := os.ReadFile(cfg.FlushDeadLetterPath)
+	require.NoError(t, err)
+	require.Equal(t, len(outside), bytes.Count(deadLetters, []byte("\n")))
+	require.Contains(t, string(deadLetters), errChunkOutsideSchema.Error())
+
+	// The discarded chunks are released by the following sweep rather than flushed again.
+	const userID = "testUser"
+	_, err = ing.Push(user.InjectOrgID(context.Background(), userID), &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: model.LabelSet{"app": "l"}.String(), Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "a"}}},
+	}})
+	require.NoError(t, err)
+	ing.sweepUsers(true, false)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(chunksOutsideSchema)-before == float64(len(outside)+1)
+	}, 5*time.Second, 10*time.Millisecond)
+	ing.sweepUsers(true, false)
+	require.Never(t, func() bool {
+		return testutil.ToFloat64(chunksOutsideSchema)-before > float64(len(outside)+1)
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	require.Empty(t, store.getChunksForUser(userID))
+}
+
+func TestFlushOnFlushResult(t *testing.T) {
 	var (
-		size   = 5
-		descs  [][]*chunkDesc
-		lbs    = makeRandomLabels()
-		ctx    = user.InjectOrgID(context.Background(), "foo")
-		_, ing = newTestStore(b, defaultIngesterTestConfig(b), nil)
+		mtx     sync.Mutex
+		results = map[string][]error{}
 	)
+	cfg := defaultIngesterTestConfig(t)
+	cfg.MaxChunkIdle = time.Nanosecond
+	cfg.OnFlushResult = func(userID string, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		results[userID] = append(results[userID], err)
+	}
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
 
-	for i := 0; i < size; i++ {
-		descs = append(descs, buildChunkDecs(b))
+	pushTestSamples(t, ing)
+	storeErr := errors.New("store unavailable")
+	store.onPut = func(ctx context.Context, _ []chunk.Chunk) error {
+		if userID, _ := tenant.TenantID(ctx); userID == "2" {
+			return storeErr
+		}
+		return nil
+	}
+	ing.sweepUsers(false, false)
+
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(results["1"])+len(results["2"])+len(results["3"]) == 3*numSeries
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, userID := range []string{"1", "3"} {
+		require.Len(t, results[userID], numSeries)
+		for _, err := range results[userID] {
+			require.NoError(t, err)
+		}
+	}
+	require.Len(t, results["2"], numSeries)
+	for _, err := range results["2"] {
+		require.ErrorIs(t, err, storeErr)
 	}
 
-	b.ResetTimer()
-	b.ReportAllocs()
+	// Let the flush on shutdown succeed.
+	store.mtx.Lock()
+	store.onPut = nil
+	store.mtx.Unlock()
+}
 
-	for n := 0; n < b.N; n++ {
-		var wg sync.WaitGroup
-		for i := 0; i < size; i++ {
-			wg.Add(1)
-			go func(loop int) {
-				defer wg.Done()
-				require.NoError(b, ing.flushChunks(ctx, 0, lbs, descs[loop], &sync.RWMutex{}))
-			}(i)
+func TestFlushIdleChunkCompressionDeferral(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.MaxChunkIdle = time.Minute
+	cfg.IdleFlushMinCompressionRatio = 2
+	ing := &Ingester{cfg: cfg}
+
+	now := time.Now()
+	idleChunk := func(blockSize, entries int) *chunkDesc {
+		c := &chunkDesc{
+			chunk:       chunkenc.NewMemChunk(chunkenc.EncSnappy, chunkenc.UnorderedHeadBlockFmt, blockSize, cfg.TargetChunkSize),
+			lastUpdated: now.Add(-2 * cfg.MaxChunkIdle),
 		}
-		wg.Wait()
+		for j := 0; j < entries; j++ {
+			require.NoError(t, c.chunk.Append(&logproto.Entry{Timestamp: now.Add(time.Duration(j)), Line: "a very repetitive log line"}))
+		}
+		return c
 	}
+
+	// Small and not compressed yet, so it could still grow.
+	small := idleChunk(cfg.BlockSize, 10)
+	shouldFlush, _ := ing.shouldFlushChunk("foo", small)
+	require.False(t, shouldFlush)
+
+	// Compressing well, with blocks already cut.
+	compressed := idleChunk(1024, 1000)
+	shouldFlush, reason := ing.shouldFlushChunk("foo", compressed)
+	require.True(t, shouldFlush)
+	require.Equal(t, flushReasonIdle, reason)
+
+	// Not deferred any more once idle for the max chunk age.
+	small.lastUpdated = now.Add(-2 * cfg.MaxChunkAge)
+	shouldFlush, _ = ing.shouldFlushChunk("foo", small)
+	require.True(t, shouldFlush)
+
+	// Nor when disabled.
+	ing.cfg.IdleFlushMinCompressionRatio = 0
+	shouldFlush, _ = ing.shouldFlushChunk("foo", idleChunk(cfg.BlockSize, 10))
+	require.True(t, shouldFlush)
 }
 
-func Test_Flush(t *testing.T) {
-	var (
-		store, ing = newTestStore(t, defaultIngesterTestConfig(t), nil)
-		lbs        = makeRandomLabels()
-		ctx        = user.InjectOrgID(context.Background(), "foo")
-	)
-	store.onPut = func(ctx context.Context, chunks []chunk.Chunk) error {
-		for _, c := range chunks {
-			buf, err := c.Encoded()
-			require.Nil(t, err)
-			if err := c.Decode(chunk.NewDecodeContext(), buf); err != nil {
-				return err
+func TestFlushSpool(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushSpool.Dir = t.TempDir()
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	testData := pushTestSamples(t, ing)
+	store.mtx.Lock()
+	store.onPut = func(_ context.Context, _ []chunk.Chunk) error {
+		return errors.New("store unavailable")
+	}
+	store.mtx.Unlock()
+	flushedTotal := func() int64 { return flushedChunksStats.Value()["total"].(int64) }
+	flushed, flushedForTenant := flushedTotal(), testutil.ToFloat64(chunksPerTenant.WithLabelValues("1"))
+	ing.sweepUsers(true, false)
+
+	spooled := func() int {
+		var n int
+		_ = filepath.Walk(cfg.FlushSpool.Dir, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n++
 			}
+			return err
+		})
+		return n
+	}
+	require.Eventually(t, func() bool {
+		return spooled() == 3*numSeries
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Spooled chunks aren't counted as flushed until replayed.
+	require.Equal(t, flushed, flushedTotal())
+	require.Equal(t, flushedForTenant, testutil.ToFloat64(chunksPerTenant.WithLabelValues("1")))
+
+	// Replaying while the store is still failing keeps the chunks spooled.
+	ing.replayFlushSpool()
+	require.Equal(t, 3*numSeries, spooled())
+	require.Equal(t, flushed, flushedTotal())
+
+	store.mtx.Lock()
+	store.onPut = nil
+	store.mtx.Unlock()
+	ing.replayFlushSpool()
+	require.Equal(t, 0, spooled())
+	require.Equal(t, float64(0), testutil.ToFloat64(ing.metrics.flushSpoolBytes))
+	require.Equal(t, float64(3*numSeries), testutil.ToFloat64(ing.metrics.flushSpoolChunksReplayed))
+	require.Equal(t, flushed+3*numSeries, flushedTotal())
+	require.Equal(t, flushedForTenant+numSeries, testutil.ToFloat64(chunksPerTenant.WithLabelValues("1")))
+	store.checkData(t, testData)
+
+	// Chunks are kept in memory once the spool is full.
+	full, err := newFlushSpool(FlushSpoolConfig{Dir: t.TempDir(), MaxSizeBytes: 1}, ing.metrics)
+	require.NoError(t, err)
+	c := chunk.NewChunk("1", 1, labels.Labels{{Name: "foo", Value: "bar"}}, chunkenc.NewFacade(chunkenc.NewMemChunk(chunkenc.EncGZIP, chunkenc.UnorderedHeadBlockFmt, cfg.BlockSize, cfg.TargetChunkSize), cfg.BlockSize, cfg.TargetChunkSize), 0, 1)
+	require.NoError(t, c.Encode())
+	require.ErrorIs(t, full.Write([]chunk.Chunk{c}), errFlushSpoolFull)
+
+	// Chunks can be spooled while replaying, as the spool isn't locked during the puts.
+	spool, err := newFlushSpool(FlushSpoolConfig{Dir: t.TempDir(), MaxSizeBytes: 1 << 20}, ing.metrics)
+	require.NoError(t, err)
+	require.NoError(t, spool.Write([]chunk.Chunk{c}))
+	other := chunk.NewChunk("1", 1, labels.Labels{{Name: "foo", Value: "bar"}}, chunkenc.NewFacade(chunkenc.NewMemChunk(chunkenc.EncGZIP, chunkenc.UnorderedHeadBlockFmt, cfg.BlockSize, cfg.TargetChunkSize), cfg.BlockSize, cfg.TargetChunkSize), 2, 3)
+	require.NoError(t, other.Encode())
+	n, err := spool.Replay(context.Background(), func(_ context.Context, _ []chunk.Chunk) error {
+		return spool.Write([]chunk.Chunk{other})
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	otherBuf, err := other.Encoded()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(otherBuf)), spool.size)
+}
+
+func TestFlushSpoolAfterRetries(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushSpool.Dir = t.TempDir()
+	cfg.FlushOpRetries = 2
+	cfg.FlushOpRetryMinBackoff = time.Millisecond
+	cfg.FlushOpRetryMaxBackoff = 5 * time.Millisecond
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	const userID = "testUser"
+	ctx := user.InjectOrgID(context.Background(), userID)
+	for _, app := range []string{"flaky", "down"} {
+		_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: model.LabelSet{"app": model.LabelValue(app)}.String(), Entries: entries(5, time.Unix(0, 0))},
+		}})
+		require.NoError(t, err)
+	}
+	inst, ok := ing.getInstanceByID(userID)
+	require.True(t, ok)
+
+	var puts, failures int
+	store.mtx.Lock()
+	store.onPut = func(_ context.Context, _ []chunk.Chunk) error {
+		puts++
+		if puts <= failures {
+			return errors.New("store unavailable")
+		}
+		return nil
+	}
+	store.mtx.Unlock()
+
+	// Transient failures are retried instead of being spooled.
+	failures = 2
+	s, ok := inst.streams.Load(model.LabelSet{"app": "flaky"}.String())
+	require.True(t, ok)
+	require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+	require.Equal(t, 3, puts)
+	require.Equal(t, float64(0), testutil.ToFloat64(ing.metrics.flushSpoolChunksWritten))
+
+	// The chunks still failing once the retries are exhausted are spooled.
+	puts, failures = 0, 3
+	s, ok = inst.streams.Load(model.LabelSet{"app": "down"}.String())
+	require.True(t, ok)
+	require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+	require.Equal(t, 3, puts)
+	require.Equal(t, float64(1), testutil.ToFloat64(ing.metrics.flushSpoolChunksWritten))
+	require.False(t, s.chunks[0].flushed.IsZero())
+}
+
+func TestFlushBatchChunksMetric(t *testing.T) {
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	batches := func() (uint64, float64) {
+		var m dto.Metric
+		require.NoError(t, flushBatchChunks.Write(&m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	count, sum := batches()
+
+	ctx := user.InjectOrgID(context.Background(), "foo")
+	require.NoError(t, ing.flushChunks(ctx, "foo", 0, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}))
+
+	newCount, newSum := batches()
+	require.Equal(t, count+1, newCount)
+	require.Equal(t, sum+10, newSum)
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.ReadOnly = true
+	store, ing := newTestStore(t, cfg, nil)
+
+	// It's LEAVING the ring, so that the distributors don't send it writes.
+	require.Equal(t, ring.LEAVING, ing.lifecycler.GetState())
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req := &logproto.PushRequest{Streams: buildTestStreams(0)}
+	_, err := ing.Push(ctx, req)
+	require.ErrorIs(t, err, ErrReadOnlyMode)
+
+	// Streams can still be created by a WAL replay, which bypasses Push.
+	inst := ing.GetOrCreateInstance("1")
+	require.NoError(t, inst.Push(ctx, req))
+
+	ing.sweepUsers(true, true)
+	w := httptest.NewRecorder()
+	ing.FlushHandler(w, httptest.NewRequest(http.MethodPost, "/flush?from=0", nil))
+	require.Equal(t, 0, ing.flushQueueDepth())
+
+	// Not even the flush on shutdown flushes anything.
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	require.Empty(t, store.getChunksForUser("1"))
+	require.Equal(t, numSeries, inst.streams.Len())
+}
+
+func TestSweepIntervalJitter(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushCheckPeriod = 30 * time.Second
+	ing := &Ingester{cfg: cfg}
+	require.Equal(t, cfg.FlushCheckPeriod, ing.nextSweepInterval())
+
+	ing.cfg.FlushCheckPeriodJitter = 0.1
+	intervals := map[time.Duration]struct{}{}
+	for j := 0; j < 100; j++ {
+		interval := ing.nextSweepInterval()
+		require.GreaterOrEqual(t, interval, 27*time.Second)
+		require.LessOrEqual(t, interval, 33*time.Second)
+		intervals[interval] = struct{}{}
+	}
+	require.Greater(t, len(intervals), 1)
+}
+
+func TestFlushChunksWithoutOrgID(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	// The tenant is passed explicitly, the store still gets it from the context.
+	require.NoError(t, ing.flushChunks(context.Background(), "foo", 0, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}))
+	require.Len(t, store.getChunksForUser("foo"), 10)
+}
+
+func TestChunksGarbageCollectedMetric(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	before := testutil.ToFloat64(chunksGarbageCollected)
+	pushTestSamples(t, ing)
+	ing.sweepUsers(true, false)
+
+	// The flushed chunks are released by the following sweeps, as there is no retain period.
+	require.Eventually(t, func() bool {
+		ing.sweepUsers(false, false)
+		return testutil.ToFloat64(chunksGarbageCollected)-before == 3*numSeries
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var stored int
+	for _, userID := range []string{"1", "2", "3"} {
+		stored += len(store.getChunksForUser(userID))
+	}
+	require.Equal(t, 3*numSeries, stored)
+}
+
+func TestExportChunksHandler(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+	testData := pushTestSamples(t, ing)
+
+	w := httptest.NewRecorder()
+	ing.ExportChunksHandler(w, httptest.NewRequest(http.MethodGet, "/ingester/chunks/export", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/x-tar", w.Header().Get("Content-Type"))
+
+	// Decode the exported chunks into a separate store to compare them with the pushed data.
+	exported := &testStore{chunks: map[string][]chunk.Chunk{}}
+	tr := tar.NewReader(w.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		buf, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		userID, name := filepath.Split(hdr.Name)
+		userID = filepath.Clean(userID)
+		c, err := parseSpoolFileName(userID, name)
+		require.NoError(t, err)
+		require.NoError(t, c.Decode(chunk.NewDecodeContext(), buf))
+		require.NoError(t, exported.Put(user.InjectOrgID(context.Background(), userID), []chunk.Chunk{c}))
+	}
+	exported.checkData(t, testData)
+
+	// Nothing was flushed nor closed.
+	for userID := range testData {
+		require.Empty(t, store.getChunksForUser(userID))
+	}
+	inst, _ := ing.getInstanceByID("1")
+	_ = inst.streams.ForEach(func(s *stream) (bool, error) {
+		s.chunkMtx.RLock()
+		defer s.chunkMtx.RUnlock()
+		require.False(t, s.chunks[0].closed)
+		return true, nil
+	})
+}
+
+func TestFlushOpRetries(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushOpRetries = 3
+	cfg.FlushOpRetryMinBackoff = time.Millisecond
+	cfg.FlushOpRetryMaxBackoff = 5 * time.Millisecond
+
+	store, ing := newTestStore(t, cfg, nil)
+
+	const userID = "testUser"
+	ctx := user.InjectOrgID(context.Background(), userID)
+	for _, app := range []string{"flaky", "rejected"} {
+		_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: model.LabelSet{"app": model.LabelValue(app)}.String(), Entries: entries(5, time.Unix(0, 0))},
+		}})
+		require.NoError(t, err)
+	}
+	inst, ok := ing.getInstanceByID(userID)
+	require.True(t, ok)
+
+	// Transient failures are retried until the flush succeeds.
+	var puts int
+	store.mtx.Lock()
+	store.onPut = func(_ context.Context, _ []chunk.Chunk) error {
+		puts++
+		if puts <= 2 {
+			return errors.New("store is flaky")
+		}
+		return nil
+	}
+	store.mtx.Unlock()
+
+	s, ok := inst.streams.Load(model.LabelSet{"app": "flaky"}.String())
+	require.True(t, ok)
+	require.NoError(t, ing.flushUserSeries(userID, s.fp, true))
+	require.Equal(t, 3, puts)
+	require.False(t, s.chunks[0].flushed.IsZero())
+
+	// Client errors are not.
+	puts = 0
+	store.mtx.Lock()
+	store.onPut = func(_ context.Context, _ []chunk.Chunk) error {
+		puts++
+		return httpgrpc.Errorf(http.StatusBadRequest, "invalid chunk")
+	}
+	store.mtx.Unlock()
+
+	s, ok = inst.streams.Load(model.LabelSet{"app": "rejected"}.String())
+	require.True(t, ok)
+	require.Error(t, ing.flushUserSeries(userID, s.fp, true))
+	require.Equal(t, 1, puts)
+
+	// let the shutdown flush succeed.
+	store.mtx.Lock()
+	store.onPut = nil
+	store.mtx.Unlock()
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+}
+
+func TestUsageSnapshot(t *testing.T) {
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	// The stats are global, only look at what this flush adds.
+	before := ing.UsageSnapshot()
+	require.NoError(t, ing.flushChunks(context.Background(), "foo", 0, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}))
+	after := ing.UsageSnapshot()
+
+	require.Equal(t, float64(10), after["ingester_flushed_chunks_total"]-before["ingester_flushed_chunks_total"])
+	require.Equal(t, float64(10), after["ingester_flushed_chunks_bytes_count"]-before["ingester_flushed_chunks_bytes_count"])
+	require.Equal(t, float64(10), after["ingester_flushed_chunks_lines_count"]-before["ingester_flushed_chunks_lines_count"])
+	require.Greater(t, after["ingester_flushed_chunks_bytes_max"], float64(0))
+}
+
+func TestFlushPacing(t *testing.T) {
+	metrics := newIngesterMetrics(prometheus.NewRegistry())
+	pacer := newFlushPacer(100*time.Millisecond, metrics)
+
+	// Puts faster than the target don't pace the sweeps.
+	for j := 0; j < 10; j++ {
+		pacer.observe(10 * time.Millisecond)
+	}
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.flushPacingFactor))
+	for j := 0; j < 10; j++ {
+		require.True(t, pacer.allow())
+	}
+
+	// The pacing factor decreases while the store slows down.
+	last := float64(1)
+	for j := 0; j < 5; j++ {
+		pacer.observe(time.Second)
+		factor := testutil.ToFloat64(metrics.flushPacingFactor)
+		require.Less(t, factor, last)
+		last = factor
+	}
+
+	// Once slower than ten times the target, a tenth of the streams are enqueued.
+	for j := 0; j < 20; j++ {
+		pacer.observe(2 * time.Second)
+	}
+	require.Equal(t, flushPacingMinFactor, testutil.ToFloat64(metrics.flushPacingFactor))
+	var allowed int
+	for j := 0; j < 100; j++ {
+		if pacer.allow() {
+			allowed++
+		}
+	}
+	require.InDelta(t, 10, allowed, 1)
+
+	// A disabled pacer allows everything.
+	var disabled *flushPacer
+	disabled.observe(time.Hour)
+	require.True(t, disabled.allow())
+}
+
+func TestFlushBreaker(t *testing.T) {
+	metrics := newIngesterMetrics(prometheus.NewRegistry())
+	breaker := newFlushBreaker(3, time.Minute, metrics)
+	now := time.Unix(0, 0)
+	breaker.now = func() time.Time { return now }
+	unavailable := httpgrpc.Errorf(http.StatusServiceUnavailable, "store down")
+
+	// Rejected chunks don't count, and a success resets the failures.
+	for j := 0; j < 5; j++ {
+		require.True(t, breaker.allow())
+		breaker.done(httpgrpc.Errorf(http.StatusBadRequest, "invalid chunk"))
+	}
+	for j := 0; j < 2; j++ {
+		require.True(t, breaker.allow())
+		breaker.done(unavailable)
+	}
+	require.True(t, breaker.allow())
+	breaker.done(nil)
+	require.Equal(t, float64(circuitClosed), testutil.ToFloat64(metrics.flushCircuitBreakerState))
+
+	// Consecutive failures open the breaker for the cooldown.
+	for j := 0; j < 3; j++ {
+		require.True(t, breaker.allow())
+		breaker.done(unavailable)
+	}
+	require.Equal(t, float64(circuitOpen), testutil.ToFloat64(metrics.flushCircuitBreakerState))
+	now = now.Add(59 * time.Second)
+	require.False(t, breaker.allow())
+
+	// After the cooldown a single probe is let through, and the breaker opens again if it fails.
+	now = now.Add(time.Second)
+	require.True(t, breaker.allow())
+	require.Equal(t, float64(circuitHalfOpen), testutil.ToFloat64(metrics.flushCircuitBreakerState))
+	require.False(t, breaker.allow())
+	breaker.done(unavailable)
+	require.Equal(t, float64(circuitOpen), testutil.ToFloat64(metrics.flushCircuitBreakerState))
+	require.False(t, breaker.allow())
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	require.True(t, breaker.allow())
+	breaker.done(nil)
+	require.Equal(t, float64(circuitClosed), testutil.ToFloat64(metrics.flushCircuitBreakerState))
+	require.True(t, breaker.allow())
+	require.True(t, breaker.allow())
+
+	// A disabled breaker allows everything.
+	var disabled *flushBreaker
+	disabled.done(unavailable)
+	require.True(t, disabled.allow())
+}
+
+func TestFlushCircuitBreakerSkipsStore(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushCircuitBreakerFailures = 1
+	cfg.FlushCircuitBreakerCooldown = time.Hour
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	var puts int
+	store.mtx.Lock()
+	store.onPut = func(_ context.Context, _ []chunk.Chunk) error {
+		puts++
+		return httpgrpc.Errorf(http.StatusServiceUnavailable, "store down")
+	}
+	store.mtx.Unlock()
+
+	c := chunk.Chunk{ChunkRef: logproto.ChunkRef{UserID: "foo"}}
+	ctx := user.InjectOrgID(context.Background(), "foo")
+	require.Error(t, ing.timedPut(ctx, []chunk.Chunk{c}))
+	require.ErrorIs(t, ing.timedPut(ctx, []chunk.Chunk{c}), errFlushCircuitOpen)
+	require.False(t, isRetryableFlushError(errFlushCircuitOpen))
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	require.Equal(t, 1, puts)
+}
+
+func TestFlushPanickingPut(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.FlushCircuitBreakerFailures = 1
+	cfg.FlushCircuitBreakerCooldown = time.Hour
+	cfg.StorePutConcurrency = 2
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	panicking := true
+	store.mtx.Lock()
+	store.onPut = func(_ context.Context, _ []chunk.Chunk) error {
+		if panicking {
+			panic("nil chunk")
 		}
 		return nil
 	}
-	require.NoError(t, ing.flushChunks(ctx, 0, lbs, buildChunkDecs(t), &sync.RWMutex{}))
+	store.mtx.Unlock()
+
+	// The puts run in their own goroutines, out of reach of the recovery of the flush loop.
+	ctx := user.InjectOrgID(context.Background(), "foo")
+	require.ErrorIs(t, ing.flushChunks(ctx, "foo", 0, makeRandomLabels(), buildChunkDecs(t), &sync.RWMutex{}), errFlushPanic)
+	require.GreaterOrEqual(t, testutil.ToFloat64(ing.metrics.flushPanics), float64(1))
+	require.False(t, isRetryableFlushError(errFlushPanic))
+
+	// A panicking put counts as a failure of the store, opening the circuit breaker.
+	c := chunk.Chunk{ChunkRef: logproto.ChunkRef{UserID: "foo"}}
+	require.ErrorIs(t, ing.timedPut(ctx, []chunk.Chunk{c}), errFlushCircuitOpen)
+
+	// A panicking probe opens it again, rather than failing the following probes forever.
+	now := time.Now()
+	ing.flushBreaker.now = func() time.Time { return now }
+	now = now.Add(2 * cfg.FlushCircuitBreakerCooldown)
+	require.ErrorIs(t, ing.timedPut(ctx, []chunk.Chunk{c}), errFlushPanic)
+	require.ErrorIs(t, ing.timedPut(ctx, []chunk.Chunk{c}), errFlushCircuitOpen)
+
+	store.mtx.Lock()
+	panicking = false
+	store.mtx.Unlock()
+	now = now.Add(2 * cfg.FlushCircuitBreakerCooldown)
+	require.NoError(t, ing.timedPut(ctx, []chunk.Chunk{c}))
+}
+
+func TestFlushBatcherRecoversFromPanics(t *testing.T) {
+	batcher := newFlushBatcher(context.Background(), time.Millisecond, func() int { return 10 }, time.Second, func(_ context.Context, _ []chunk.Chunk) ([]string, error) {
+		panic("nil chunk")
+	})
+
+	// The batch is put by the timer of its window.
+	stored, _, err := batcher.add(context.Background(), []chunk.Chunk{{ChunkRef: logproto.ChunkRef{UserID: "foo"}}})
+	require.ErrorIs(t, err, errFlushPanic)
+	require.Equal(t, []bool{false}, stored)
 }
 
 func buildChunkDecs(t testing.TB) []*chunkDesc {
@@ -430,3 +3224,154 @@ func buildStreamsFromChunk(t *testing.T, lbs string, chk chunkenc.Chunk) logprot
 	require.NoError(t, it.Error())
 	return stream
 }
+
+func TestDefaultFlushScheduler(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.MaxChunkIdle = time.Minute
+	cfg.MaxChunkAge = time.Hour
+	critical := defaultLimitsTestConfig()
+	critical.FlushPriorityClass = 10
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), tenantLimitsMock{"critical": &critical})
+	require.NoError(t, err)
+	ing := &Ingester{cfg: cfg, limiter: NewLimiter(limits, NilMetrics, &ringCountMock{count: 1}, 1)}
+	scheduler := ing.scheduler()
+	require.Equal(t, defaultFlushScheduler{i: ing}, scheduler)
+
+	now := time.Now()
+	newChunk := func(lastUpdated time.Time, entries ...time.Time) *chunkDesc {
+		c := &chunkDesc{
+			chunk:       chunkenc.NewMemChunk(chunkenc.EncSnappy, chunkenc.UnorderedHeadBlockFmt, cfg.BlockSize, cfg.TargetChunkSize),
+			lastUpdated: lastUpdated,
+		}
+		for _, ts := range entries {
+			require.NoError(t, c.chunk.Append(&logproto.Entry{Timestamp: ts, Line: "line"}))
+		}
+		return c
+	}
+	closed := func(c *chunkDesc, synced, pressure bool) *chunkDesc {
+		c.closed, c.synced, c.pressure = true, synced, pressure
+		return c
+	}
+
+	for _, tc := range []struct {
+		name   string
+		chunk  *chunkDesc
+		flush  bool
+		reason string
+	}{
+		{name: "fresh", chunk: newChunk(now, now), flush: false},
+		{name: "full", chunk: closed(newChunk(now, now), false, false), flush: true, reason: flushReasonFull},
+		{name: "synced", chunk: closed(newChunk(now, now), true, false), flush: true, reason: flushReasonSynced},
+		{name: "pressure", chunk: closed(newChunk(now, now), false, true), flush: true, reason: flushReasonPressure},
+		{name: "idle", chunk: newChunk(now.Add(-2*cfg.MaxChunkIdle), now.Add(-2*cfg.MaxChunkIdle)), flush: true, reason: flushReasonIdle},
+		{name: "max age", chunk: newChunk(now, now.Add(-2*cfg.MaxChunkAge), now), flush: true, reason: flushReasonMaxAge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flush, reason := scheduler.ShouldFlush("fake", FlushChunk{desc: tc.chunk})
+			require.Equal(t, tc.flush, flush)
+			require.Equal(t, tc.reason, reason)
+		})
+	}
+
+	require.Equal(t, 10, scheduler.Priority("critical"))
+	require.Equal(t, 0, scheduler.Priority("fake"))
+
+	for _, hash := range []string{flushQueueHashModulo, flushQueueHashXXHash} {
+		ing.cfg.FlushQueueHash = hash
+		for fp := model.Fingerprint(0); fp < 100; fp++ {
+			require.Equal(t, flushQueueIndex(hash, fp, 16), scheduler.QueueIndex(fp, 16))
+		}
+	}
+	ing.cfg.FlushQueueHash = flushQueueHashModulo
+	require.Equal(t, 3, scheduler.QueueIndex(19, 16))
+}
+
+// lastQueueFlushScheduler flushes every chunk through the last flush queue.
+type lastQueueFlushScheduler struct{}
+
+func (lastQueueFlushScheduler) ShouldFlush(string, FlushChunk) (bool, string) {
+	return true, flushReasonFull
+}
+
+func (lastQueueFlushScheduler) Priority(string) int { return 0 }
+
+func (lastQueueFlushScheduler) QueueIndex(_ model.Fingerprint, n int) int { return n - 1 }
+
+// outOfRangeFlushScheduler returns flush queues which don't exist.
+type outOfRangeFlushScheduler struct {
+	lastQueueFlushScheduler
+}
+
+func (outOfRangeFlushScheduler) QueueIndex(fp model.Fingerprint, n int) int {
+	if fp%2 == 0 {
+		return -1
+	}
+	return n
+}
+
+func TestFlushSchedulerQueueIndexOutOfRange(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.ConcurrentFlushes = 2
+	cfg.FlushScheduler = outOfRangeFlushScheduler{}
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	// The streams fall back to the queue of the default scheduler.
+	for fp := model.Fingerprint(0); fp < 4; fp++ {
+		require.Equal(t, flushQueueIndex(cfg.FlushQueueHash, fp, 2), ing.schedulerQueueIndex(fp, 2))
+	}
+	testData := pushTestSamples(t, ing)
+	ing.sweepUsers(true, false)
+	require.Eventually(t, func() bool { return ing.flushQueueDepth() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, ing.flushStatsSnapshot().Queues, 2)
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	store.checkData(t, testData)
+}
+
+func TestCustomFlushScheduler(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.ConcurrentFlushes = 2
+	cfg.FlushScheduler = lastQueueFlushScheduler{}
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+
+	ing := newIngesterWithIdleFlushQueues(t, cfg, limits)
+
+	// None of the chunks is due, but the scheduler flushes them all anyway.
+	pushTestSamples(t, ing)
+	ing.sweepUsers(false, false)
+
+	require.Equal(t, 0, ing.flushQueues[0].Length())
+	require.Equal(t, 3*numSeries, ing.flushQueues[1].Length())
+}
+
+func TestFlushUsageStatsPerReason(t *testing.T) {
+	store, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	reasonStats := func(reason string) map[string]interface{} {
+		report := usagestats.BuildReport(&usagestats.ClusterSeed{}, time.Now())
+		stats, ok := report.Metrics["ingester_flushed_chunks_bytes_reason_"+reason]
+		require.True(t, ok, reason)
+		return stats.(map[string]interface{})
+	}
+
+	// Every flush reason is reported, flushed chunks or not.
+	for _, reason := range flushReasons {
+		reasonStats(reason)
+	}
+
+	idle := reasonStats(flushReasonIdle)["count"].(int64)
+	full := reasonStats(flushReasonFull)["count"].(int64)
+	chunks := buildChunkDecs(t)
+	for _, c := range chunks {
+		c.flushReason = flushReasonIdle
+	}
+	require.NoError(t, ing.flushChunks(context.Background(), "foo", 42, makeRandomLabels(), chunks, &sync.RWMutex{}))
+	require.Len(t, store.getChunksForUser("foo"), len(chunks))
+
+	stats := reasonStats(flushReasonIdle)
+	require.Equal(t, int64(len(chunks)), stats["count"].(int64)-idle)
+	require.Greater(t, stats["max"].(float64), 0.0)
+	require.Equal(t, full, reasonStats(flushReasonFull)["count"].(int64))
+}
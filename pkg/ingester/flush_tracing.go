@@ -0,0 +1,46 @@
+package ingester
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+var noopFlushSpan = opentracing.NoopTracer{}.StartSpan("")
+
+// startFlushSpan starts a span of a flush phase as a child of the span in ctx, if the flush
+// tracing is enabled. The returned span is a no-op otherwise, and ctx is returned as is.
+func (i *Ingester) startFlushSpan(ctx context.Context, operationName string, opts ...opentracing.StartSpanOption) (opentracing.Span, context.Context) {
+	if !i.cfg.FlushTracing {
+		return noopFlushSpan, ctx
+	}
+	return opentracing.StartSpanFromContext(ctx, operationName, opts...)
+}
+
+// startFlushUserSeriesSpan starts the root span of the flush of a stream. It follows from the span
+// of the last push to the stream, if any, so that the flush shows up in the trace of the data.
+func (i *Ingester) startFlushUserSeriesSpan(ctx context.Context, userID string, fp model.Fingerprint, chunks int, pushSpan opentracing.SpanContext) (opentracing.Span, context.Context) {
+	var opts []opentracing.StartSpanOption
+	if pushSpan != nil {
+		opts = append(opts, opentracing.FollowsFrom(pushSpan))
+	}
+	sp, ctx := i.startFlushSpan(ctx, "flushUserSeries", opts...)
+	sp.SetTag("tenant", userID)
+	sp.SetTag("fp", fp.String())
+	sp.SetTag("chunks", chunks)
+	return sp, ctx
+}
+
+// encodedSize returns the total size of the encoded chunks.
+func encodedSize(chunks []chunk.Chunk) int {
+	var size int
+	for _, c := range chunks {
+		if b, err := c.Encoded(); err == nil {
+			size += len(b)
+		}
+	}
+	return size
+}
@@ -7,10 +7,13 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/services"
 	"github.com/grafana/dskit/tenant"
@@ -19,6 +22,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/weaveworks/common/httpgrpc"
+	"go.uber.org/atomic"
 	"google.golang.org/grpc/health/grpc_health_v1"
 
 	"github.com/grafana/loki/pkg/chunkenc"
@@ -51,6 +56,19 @@ const (
 var (
 	ErrReadOnly = errors.New("Ingester is shutting down")
 
+	// ErrReadOnlyMode is returned when a push is attempted on an ingester running in read-only mode.
+	ErrReadOnlyMode = errors.New("Ingester is in read-only mode")
+
+	// ErrDraining is returned when a push is attempted on a draining ingester, see DrainHandler.
+	ErrDraining = errors.New("Ingester is draining")
+
+	// ErrFlushPushback is returned when a push is attempted while the flush queues are saturated,
+	// see -ingester.flush-queue-pushback-threshold. It is a 429 so that clients back off and retry.
+	ErrFlushPushback = httpgrpc.Errorf(http.StatusTooManyRequests, "Ingester flush queues are saturated")
+
+	// flushQueueLength only reports the length of the flush queues, which are unbounded:
+	// enqueueing a flush operation never blocks. Use -ingester.flush-queue-pushback-threshold
+	// to react to deep queues.
 	flushQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "cortex_ingester_flush_queue_length",
 		Help: "The total number of series pending in the flush queue.",
@@ -101,6 +119,98 @@ type Config struct {
 	IndexShards int `yaml:"index_shards"`
 
 	MaxDroppedStreams int `yaml:"max_dropped_streams"`
+
+	FlushDeadLetterPath string `yaml:"flush_dead_letter_path"`
+
+	FlushQueuePushbackThreshold int           `yaml:"flush_queue_pushback_threshold"`
+	FlushQueuePushbackPeriod    time.Duration `yaml:"flush_queue_pushback_period"`
+
+	ChunkHeaderSizeEstimate int `yaml:"chunk_header_size_estimate"`
+
+	MaxMemoryChunks int `yaml:"max_memory_chunks"`
+
+	TenantGCGracePeriod time.Duration `yaml:"tenant_gc_grace_period"`
+
+	StorePutConcurrency int `yaml:"store_put_concurrency"`
+
+	FlushShutdownGracePeriod time.Duration `yaml:"flush_shutdown_grace_period"`
+
+	PerTenantChunkUtilization bool `yaml:"per_tenant_chunk_utilization"`
+
+	PerTenantFlushLag bool `yaml:"per_tenant_flush_lag"`
+
+	FlushProgressLogInterval time.Duration `yaml:"flush_progress_log_interval"`
+
+	DisabledFlushMetrics flagext.StringSliceCSV `yaml:"disabled_flush_metrics"`
+
+	OnChunkCloseError string `yaml:"on_chunk_close_error"`
+
+	FlushStallThreshold time.Duration `yaml:"flush_stall_threshold"`
+
+	MinChunkAge time.Duration `yaml:"min_chunk_age"`
+
+	IdleFlushMinCompressionRatio float64 `yaml:"idle_flush_min_compression_ratio"`
+
+	FlushSpool FlushSpoolConfig `yaml:"flush_spool"`
+
+	MemoryPressureFlushOrder string `yaml:"memory_pressure_flush_order"`
+
+	ReadOnly bool `yaml:"read_only"`
+
+	FlushCheckPeriodJitter float64 `yaml:"flush_check_period_jitter"`
+
+	FlushOpRetries         int           `yaml:"flush_op_retries"`
+	FlushOpRetryMinBackoff time.Duration `yaml:"flush_op_retry_min_backoff"`
+	FlushOpRetryMaxBackoff time.Duration `yaml:"flush_op_retry_max_backoff"`
+
+	FlushPacingTargetLatency time.Duration `yaml:"flush_pacing_target_latency"`
+
+	PerTenantMemoryStreamsMetric bool `yaml:"per_tenant_memory_streams_metric"`
+
+	FlushCircuitBreakerFailures int           `yaml:"flush_circuit_breaker_failures"`
+	FlushCircuitBreakerCooldown time.Duration `yaml:"flush_circuit_breaker_cooldown"`
+
+	DrainStreamsPerSweep int `yaml:"drain_streams_per_sweep"`
+
+	ExtraFlushLabels map[string]string `yaml:"extra_flush_labels,omitempty"`
+
+	SweepConcurrency int `yaml:"sweep_concurrency"`
+
+	UndersizedChunkUtilization float64 `yaml:"undersized_chunk_utilization"`
+
+	FlushEventBufferSize int `yaml:"flush_event_buffer_size"`
+
+	FlushQueueHash string `yaml:"flush_queue_hash"`
+
+	StrictValidation bool `yaml:"strict_validation"`
+
+	FlushLabelLimits string `yaml:"flush_label_limits"`
+
+	FlushSchedule string `yaml:"flush_schedule"`
+
+	FlushWorkerCPUAffinity bool `yaml:"flush_worker_cpu_affinity"`
+
+	FlushTracing bool `yaml:"flush_tracing"`
+
+	FlushBatchWindow    time.Duration `yaml:"flush_batch_window"`
+	FlushBatchMaxChunks int           `yaml:"flush_batch_max_chunks"`
+
+	FlushFairQueueing bool `yaml:"flush_fair_queueing"`
+
+	// FlushEventSink, when set, receives an event for every successful flush, see FlushEventSink.
+	FlushEventSink FlushEventSink `yaml:"-"`
+
+	// OnFlushResult, when set, is called with the outcome of every flush of a stream, e.g. for
+	// embedders to implement per tenant alerting. It must not block.
+	OnFlushResult func(tenant string, err error) `yaml:"-"`
+
+	// OnFlushReceipts, when set, is called with the receipts of the chunks of a stream stored by
+	// a flush, see FlushReceipt. It must not block.
+	OnFlushReceipts func(receipts []FlushReceipt) `yaml:"-"`
+
+	// FlushScheduler, when set, replaces the default strategy deciding which chunks are flushed and
+	// how they are queued, see FlushScheduler.
+	FlushScheduler FlushScheduler `yaml:"-"`
 }
 
 // RegisterFlags registers the flags.
@@ -125,6 +235,59 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.BoolVar(&cfg.AutoForgetUnhealthy, "ingester.autoforget-unhealthy", false, "Enable to remove unhealthy ingesters from the ring after `ring.kvstore.heartbeat_timeout`")
 	f.IntVar(&cfg.IndexShards, "ingester.index-shards", index.DefaultIndexShards, "Shard factor used in the ingesters for the in process reverse index. This MUST be evenly divisible by ALL schema shard factors or Loki will not start.")
 	f.IntVar(&cfg.MaxDroppedStreams, "ingester.tailer.max-dropped-streams", 10, "Maximum number of dropped streams to keep in memory during tailing")
+	f.IntVar(&cfg.FlushQueuePushbackThreshold, "ingester.flush-queue-pushback-threshold", 0, "Total number of pending flush operations above which the ingester reports itself as not ready and rejects pushes with a 429 until the queues drain. 0 to disable.")
+	f.DurationVar(&cfg.FlushQueuePushbackPeriod, "ingester.flush-queue-pushback-period", time.Minute, "How long the flush queues must stay above the pushback threshold before the ingester starts pushing back.")
+	f.IntVar(&cfg.ChunkHeaderSizeEstimate, "ingester.chunk-header-size-estimate", defaultChunkHeaderSizeEstimate, "Room in bytes reserved for the chunk header when allocating the buffer a chunk is encoded into at flush time. Lower it to reduce allocations when flushing many small chunks.")
+	f.IntVar(&cfg.MaxMemoryChunks, "ingester.max-memory-chunks", 0, "Maximum number of chunks held in memory across all tenants. When exceeded, the head chunks of the biggest streams are flushed until back under the limit. 0 to disable.")
+	f.DurationVar(&cfg.TenantGCGracePeriod, "ingester.tenant-gc-grace-period", 0, "How long a tenant may hold no streams before it is removed, releasing its state, so that tenants which reappear constantly aren't recreated every time. 0 keeps the tenants until shutdown.")
+	f.IntVar(&cfg.StorePutConcurrency, "ingester.store-put-concurrency", 1, "Maximum number of chunks of a single flush uploaded to the store in parallel. Every chunk is uploaded in its own request, so that the chunks uploaded before a failure, e.g. when the flush op timeout expires, aren't uploaded again.")
+	f.DurationVar(&cfg.FlushShutdownGracePeriod, "ingester.flush-shutdown-grace-period", 0, "How long the flush on shutdown may run before the outstanding flush operations are cancelled, so that shutdown doesn't wait for the flush op timeout of every operation. 0 to wait for all the flushes.")
+	f.BoolVar(&cfg.PerTenantChunkUtilization, "ingester.per-tenant-chunk-utilization", false, "Record the utilization of the flushed chunks per tenant, to identify tenants producing poorly utilized chunks. This adds a histogram per tenant.")
+	f.BoolVar(&cfg.PerTenantFlushLag, "ingester.per-tenant-flush-lag", false, "Record the flush lag of every tenant on each sweep, the age of the newest data of its oldest unflushed chunk, which quantifies the data loss window if the ingester is lost. This adds a gauge per tenant.")
+	f.DurationVar(&cfg.FlushProgressLogInterval, "ingester.flush-progress-log-interval", 30*time.Second, "How often the progress of a flush of all the in-memory chunks, e.g. on shutdown, is logged while waiting for the flush queues to drain. 0 to disable.")
+	f.Var(&cfg.DisabledFlushMetrics, "ingester.disabled-flush-metrics", "Comma separated list of flush metrics which aren't registered, to reduce the scrape cost. Supported metrics: loki_ingester_chunk_utilization, loki_ingester_chunk_entries, loki_ingester_chunk_size_bytes, loki_ingester_chunk_compression_ratio, loki_ingester_chunk_age_seconds, loki_ingester_chunk_encode_time_seconds, loki_ingester_chunk_bounds_hours.")
+	f.StringVar(&cfg.OnChunkCloseError, "ingester.on-chunk-close-error", chunkCloseErrorRetry, "What to do with a chunk which fails to be closed for flushing. retry retries the whole flush, drop discards the chunk and quarantine records it in the flush dead-letter file before discarding it. Options: retry, drop, quarantine.")
+	f.DurationVar(&cfg.FlushStallThreshold, "ingester.flush-stall-threshold", 0, "How long a flush queue with pending operations may go without dequeuing any before a warning is logged, to detect flush loops stuck e.g. on a store call. Not checked while flushing is paused. 0 to disable.")
+	f.DurationVar(&cfg.MinChunkAge, "ingester.min-chunk-age", 0, "Minimum age of the oldest entry of a chunk before it is flushed for being idle, so that streams pausing briefly don't produce tiny chunks. Doesn't apply to forced flushes. 0 to disable.")
+	f.Float64Var(&cfg.IdleFlushMinCompressionRatio, "ingester.idle-flush-min-compression-ratio", 0, "Defer flushing idle chunks smaller than the target chunk size while their estimated compression ratio is below this value, as they could still grow and compress better. Flushes are deferred for at most the max chunk age after the last write. 0 to disable.")
+	cfg.FlushSpool.RegisterFlags(f)
+	f.StringVar(&cfg.MemoryPressureFlushOrder, "ingester.memory-pressure-flush-order", pressureFlushOrderBiggest, "Which streams are flushed first when more chunks than the max memory chunks are held in memory. biggest flushes the streams with the biggest head chunks, oldest the head chunks holding the oldest data across all the tenants. Options: biggest, oldest.")
+	f.BoolVar(&cfg.ReadOnly, "ingester.read-only", false, "Start the ingester in read-only mode, e.g. for forensic analysis of a WAL: it replays the WAL and serves queries, but rejects pushes and never flushes chunks. It is LEAVING the ring once joined, so that the distributors don't send it writes. The WAL replay memory ceiling is ignored, as no memory can be reclaimed by flushing.")
+	f.Float64Var(&cfg.FlushCheckPeriodJitter, "ingester.flush-check-period-jitter", 0, "Fraction of the flush check period by which every sweep is randomly brought forward or delayed, so that the ingesters of a fleet don't flush in lockstep. 0 to disable.")
+	f.IntVar(&cfg.FlushOpRetries, "ingester.flush-op-retries", 0, "How many times the chunks of a stream failing to flush with a retryable error are retried right away, with a backoff, before the flush operation fails. Client errors of the store, except rate limiting, aren't retried. 0 to disable.")
+	f.DurationVar(&cfg.FlushOpRetryMinBackoff, "ingester.flush-op-retry-min-backoff", 100*time.Millisecond, "Minimum delay before retrying a failed flush.")
+	f.DurationVar(&cfg.FlushOpRetryMaxBackoff, "ingester.flush-op-retry-max-backoff", 5*time.Second, "Maximum delay before retrying a failed flush.")
+	f.DurationVar(&cfg.FlushPacingTargetLatency, "ingester.flush-pacing-target-latency", 0, "Store put latency above which the periodic sweeps enqueue proportionally fewer streams for flushing, down to a tenth, to avoid piling on a struggling store. The skipped streams are enqueued by later sweeps. Flushes on shutdown and through the flush endpoint are never paced. 0 to disable.")
+	f.BoolVar(&cfg.PerTenantMemoryStreamsMetric, "ingester.per-tenant-memory-streams-metric", true, "Export the number of streams held in memory per tenant as loki_ingester_memory_streams. Disable to bound the cardinality of the ingester metrics with many tenants.")
+	f.IntVar(&cfg.FlushCircuitBreakerFailures, "ingester.flush-circuit-breaker-failures", 0, "Number of consecutive failed puts to the store after which the flushes fail right away for the flush circuit breaker cooldown, instead of waiting for a down store. A single put then probes the store, closing the breaker if it succeeds. Failed flushes are retried as usual. 0 to disable.")
+	f.DurationVar(&cfg.FlushCircuitBreakerCooldown, "ingester.flush-circuit-breaker-cooldown", 30*time.Second, "How long the flush circuit breaker stays open before probing the store again.")
+	f.IntVar(&cfg.DrainStreamsPerSweep, "ingester.drain-streams-per-sweep", 1000, "Maximum number of streams enqueued for flushing by every flush check period while the ingester is draining, once the previous ones have been flushed. 0 to enqueue every stream at once.")
+	f.IntVar(&cfg.SweepConcurrency, "ingester.sweep-concurrency", 1, "Number of tenants whose streams are swept concurrently to enqueue the chunks to flush, so that a tenant with many streams doesn't delay the others.")
+	f.Float64Var(&cfg.UndersizedChunkUtilization, "ingester.undersized-chunk-utilization", 0, "Count the flushed chunks whose size relative to the target chunk size is below this value in loki_ingester_undersized_chunks_total, and log them at debug level, to surface premature flushes. 0 to disable.")
+	f.IntVar(&cfg.FlushEventBufferSize, "ingester.flush-event-buffer-size", 1000, "Number of flush events buffered for publishing to the flush event sink set by embedders. Events are dropped while the buffer is full, so that a slow sink doesn't hold back the flushes.")
+	f.StringVar(&cfg.FlushQueueHash, "ingester.flush-queue-hash", flushQueueHashModulo, "How streams are assigned to the flush queues. modulo takes the stream fingerprint modulo the number of queues, xxhash hashes the fingerprint first to spread clustered fingerprints evenly. Options: modulo, xxhash.")
+	f.BoolVar(&cfg.StrictValidation, "ingester.strict-validation", false, "Fail to start on settings which are likely mistakes, e.g. a chunk retain period much longer than the max chunk age, instead of logging a warning.")
+	f.StringVar(&cfg.FlushLabelLimits, "ingester.flush-label-limits", flushLabelLimitsIgnore, "What to do with chunks whose labels, including the extra flush labels, violate the label limits of their tenant, which queries would reject. ignore stores them anyway, reject discards them and truncate truncates the too long label values, discarding the chunks violating the other limits. Options: ignore, reject, truncate.")
+	f.StringVar(&cfg.FlushSchedule, "ingester.flush-schedule", "", "Cron expression, evaluated in UTC, of the times at which every stream is flushed like by the /flush endpoint, e.g. '0 * * * *' to flush at the top of each hour. Disabled when empty.")
+	f.BoolVar(&cfg.FlushWorkerCPUAffinity, "ingester.flush-worker-cpu-affinity", false, "Pin every flush loop to a CPU, spreading them over the first GOMAXPROCS CPUs available to the process, so that chunk encoding stays on consistent cores, e.g. on NUMA systems. Best effort, only supported on Linux.")
+	f.BoolVar(&cfg.FlushTracing, "ingester.flush-tracing", false, "Emit a tracing span for every flush of a stream, with child spans for the encoding and the storing of its chunks. The flush spans follow from the span of the last push to the stream.")
+	f.DurationVar(&cfg.FlushBatchWindow, "ingester.flush-batch-window", 0, "How long to accumulate the chunks of the streams of a tenant flushed concurrently by the flush loops, to put them to the store in a single request. Reduces the number of requests to object stores with a per request overhead, at the cost of flush latency. Every flush loop waits for the batch of the stream it flushes to be put, so a batch holds the chunks of at most as many streams as there are flush loops. 0 disables batching, the chunks of every stream are then put on their own.")
+	f.IntVar(&cfg.FlushBatchMaxChunks, "ingester.flush-batch-max-chunks", 0, "Max number of chunks of a flush batch, which is put right away once full instead of at the end of the batching window. 0 for the number of flush loops, so that a batch is put as soon as every flush loop added a chunk to it.")
+	f.BoolVar(&cfg.FlushFairQueueing, "ingester.flush-fair-queueing", false, "Share the flush loops between the tenants in proportion to their flush_weight override, instead of flushing the streams with the oldest data first, so that under contention the tenants with a higher weight get more flush throughput.")
+	f.StringVar(&cfg.FlushDeadLetterPath, "ingester.flush-dead-letter-path", "", "File to which metadata of chunks that failed to flush is appended for later reconciliation. Disabled when empty.")
+}
+
+// maxRetainPeriodToChunkAgeRatio is the ratio of the chunk retain period to the max chunk age above
+// which the flushed chunks are likely kept in memory for no use.
+const maxRetainPeriodToChunkAgeRatio = 10
+
+// validationWarnings returns the settings which are valid but likely mistakes.
+func (cfg *Config) validationWarnings() []string {
+	var warnings []string
+	if cfg.MaxChunkAge > 0 && cfg.RetainPeriod > maxRetainPeriodToChunkAgeRatio*cfg.MaxChunkAge {
+		warnings = append(warnings, fmt.Sprintf("the chunk retain period %v is more than %d times the max chunk age %v, keeping many flushed chunks in memory", cfg.RetainPeriod, maxRetainPeriodToChunkAgeRatio, cfg.MaxChunkAge))
+	}
+	return warnings
 }
 
 func (cfg *Config) Validate() error {
@@ -142,10 +305,117 @@ func (cfg *Config) Validate() error {
 		return errors.New("the use of the write ahead log (WAL) is incompatible with chunk transfers. It's suggested to use the WAL. Please try setting ingester.max-transfer-retries to 0 to disable transfers")
 	}
 
+	if err = cfg.FlushSpool.Validate(); err != nil {
+		return err
+	}
+
+	if cfg.ConcurrentFlushes <= 0 {
+		return fmt.Errorf("invalid ingester concurrent flushes: %d, it must be at least 1 or chunks are never flushed", cfg.ConcurrentFlushes)
+	}
+
 	if cfg.IndexShards <= 0 {
 		return fmt.Errorf("invalid ingester index shard factor: %d", cfg.IndexShards)
 	}
 
+	if cfg.ChunkHeaderSizeEstimate < 0 {
+		return fmt.Errorf("invalid chunk header size estimate: %d", cfg.ChunkHeaderSizeEstimate)
+	}
+
+	switch cfg.OnChunkCloseError {
+	case "", chunkCloseErrorRetry, chunkCloseErrorDrop:
+	case chunkCloseErrorQuarantine:
+		if cfg.FlushDeadLetterPath == "" {
+			return errors.New("quarantining chunks which fail to be closed requires the flush dead-letter path to be set")
+		}
+	default:
+		return fmt.Errorf("invalid chunk close error policy: %s", cfg.OnChunkCloseError)
+	}
+
+	switch cfg.FlushLabelLimits {
+	case "", flushLabelLimitsIgnore, flushLabelLimitsReject, flushLabelLimitsTruncate:
+	default:
+		return fmt.Errorf("invalid flush label limits policy: %s", cfg.FlushLabelLimits)
+	}
+
+	if cfg.FlushSchedule != "" {
+		if _, err := parseCronSchedule(cfg.FlushSchedule); err != nil {
+			return fmt.Errorf("invalid flush schedule: %v", err)
+		}
+	}
+
+	if cfg.FlushBatchWindow < 0 {
+		return fmt.Errorf("invalid flush batch window: %s", cfg.FlushBatchWindow)
+	}
+	if cfg.FlushBatchMaxChunks < 0 {
+		return fmt.Errorf("invalid flush batch max chunks: %d", cfg.FlushBatchMaxChunks)
+	}
+
+	switch cfg.FlushQueueHash {
+	case "", flushQueueHashModulo, flushQueueHashXXHash:
+	default:
+		return fmt.Errorf("invalid flush queue hash: %s", cfg.FlushQueueHash)
+	}
+
+	for name := range cfg.ExtraFlushLabels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid extra flush label name: %q", name)
+		}
+	}
+
+	if cfg.UndersizedChunkUtilization < 0 || cfg.UndersizedChunkUtilization > 1 {
+		return fmt.Errorf("invalid undersized chunk utilization: %v, it must be between 0 and 1", cfg.UndersizedChunkUtilization)
+	}
+
+	for _, warning := range cfg.validationWarnings() {
+		if cfg.StrictValidation {
+			return errors.New(warning)
+		}
+		level.Warn(util_log.Logger).Log("msg", "suspicious ingester config", "warning", warning)
+	}
+
+	if cfg.FlushEventSink != nil && cfg.FlushEventBufferSize <= 0 {
+		return fmt.Errorf("invalid flush event buffer size: %d", cfg.FlushEventBufferSize)
+	}
+
+	if cfg.SweepConcurrency < 0 {
+		return fmt.Errorf("invalid sweep concurrency: %d", cfg.SweepConcurrency)
+	}
+
+	if cfg.DrainStreamsPerSweep < 0 {
+		return fmt.Errorf("invalid drain streams per sweep: %d", cfg.DrainStreamsPerSweep)
+	}
+
+	if cfg.FlushCircuitBreakerFailures < 0 {
+		return fmt.Errorf("invalid flush circuit breaker failures: %d", cfg.FlushCircuitBreakerFailures)
+	}
+	if cfg.FlushCircuitBreakerFailures > 0 && cfg.FlushCircuitBreakerCooldown <= 0 {
+		return fmt.Errorf("invalid flush circuit breaker cooldown: %v", cfg.FlushCircuitBreakerCooldown)
+	}
+
+	if cfg.FlushPacingTargetLatency < 0 {
+		return fmt.Errorf("invalid flush pacing target latency: %v", cfg.FlushPacingTargetLatency)
+	}
+
+	if cfg.FlushOpRetries < 0 {
+		return fmt.Errorf("invalid flush op retries: %d", cfg.FlushOpRetries)
+	}
+
+	if cfg.FlushCheckPeriodJitter < 0 || cfg.FlushCheckPeriodJitter >= 1 {
+		return fmt.Errorf("invalid flush check period jitter: %v, must be in [0, 1)", cfg.FlushCheckPeriodJitter)
+	}
+
+	switch cfg.MemoryPressureFlushOrder {
+	case "", pressureFlushOrderBiggest, pressureFlushOrderOldest:
+	default:
+		return fmt.Errorf("invalid memory pressure flush order: %s", cfg.MemoryPressureFlushOrder)
+	}
+
+	for _, name := range cfg.DisabledFlushMetrics {
+		if _, ok := optionalFlushMetrics[name]; !ok {
+			return fmt.Errorf("invalid disabled flush metric: %s", name)
+		}
+	}
+
 	return nil
 }
 
@@ -171,6 +441,21 @@ type Interface interface {
 	logproto.QuerierServer
 	CheckReady(ctx context.Context) error
 	FlushHandler(w http.ResponseWriter, _ *http.Request)
+	CloseAllChunksHandler(w http.ResponseWriter, _ *http.Request)
+	EvictFlushedChunksHandler(w http.ResponseWriter, _ *http.Request)
+	FlushStatsHandler(w http.ResponseWriter, _ *http.Request)
+	ChunkFlushStatusHandler(w http.ResponseWriter, r *http.Request)
+	ResetChunkFlushStatusHandler(w http.ResponseWriter, r *http.Request)
+	ExportChunksHandler(w http.ResponseWriter, _ *http.Request)
+	TenantsHandler(w http.ResponseWriter, _ *http.Request)
+	UnflushedDataHandler(w http.ResponseWriter, _ *http.Request)
+	FlushBeforeHandler(w http.ResponseWriter, r *http.Request)
+	CheckpointHandler(w http.ResponseWriter, r *http.Request)
+	DrainHandler(w http.ResponseWriter, r *http.Request)
+	FlushPauseHandler(w http.ResponseWriter, _ *http.Request)
+	FlushResumeHandler(w http.ResponseWriter, _ *http.Request)
+	FlushConcurrencyHandler(w http.ResponseWriter, r *http.Request)
+	FlushRebalanceHandler(w http.ResponseWriter, r *http.Request)
 	ShutdownHandler(w http.ResponseWriter, r *http.Request)
 	GetOrCreateInstance(instanceID string) *instance
 }
@@ -202,6 +487,28 @@ type Ingester struct {
 	// pick a queue.
 	flushQueues     []*util.PriorityQueue
 	flushQueuesDone sync.WaitGroup
+	// Activity of each flush queue, reported by FlushStatsHandler.
+	flushStats []*flushQueueStats
+	// The flush queue of the streams moved by the last rebalance, see rebalanceFlushQueues.
+	flushQueueOverrides map[flushStreamKey]int
+	// Guards flushQueues, flushStats and flushQueueOverrides, which FlushConcurrencyHandler resizes
+	// at runtime, and whether the flush queues got closed.
+	flushQueuesMtx    sync.RWMutex
+	flushQueuesClosed bool
+	// Number of running flush loops, including the ones draining their queue after a shrink.
+	flushWorkers atomic.Int32
+	// Cumulative number of chunks flushed per reason, reported by FlushReasonCounts.
+	flushReasonCounts sync.Map
+	// Parent context of the flush operations, cancelled once the shutdown grace period elapsed.
+	flushCtx      context.Context
+	cancelFlushes context.CancelFunc
+
+	// Set when the flush queues have been saturated for too long, see updateFlushPushback.
+	flushPushback      *atomic.Bool
+	flushPushbackSince time.Time
+
+	// Set while draining, see DrainHandler.
+	draining *atomic.Bool
 
 	limiter *Limiter
 
@@ -216,7 +523,46 @@ type Ingester struct {
 
 	wal WAL
 
+	// Optional sink recording chunks which failed to flush.
+	deadLetters *deadLetterLog
+
+	// Optional local spool for chunks which failed to flush, replayed once the store recovers.
+	spool *flushSpool
+
+	// Optional pacing of the periodic sweeps, following the store put latency.
+	flushPacer *flushPacer
+
+	// Optional circuit breaker around the store puts.
+	flushBreaker *flushBreaker
+
+	// Holds back the flush loops while flushing is paused, see FlushPauseHandler.
+	flushPause *flushPause
+
+	// Optional publisher of the flush events to the configured sink.
+	flushEvents *flushEventPublisher
+
+	// Optional scheduler of the flushes at the times of the flush schedule.
+	flushCron *flushCron
+
+	// Optional replacement of the default flush scheduler, see scheduler.
+	flushScheduler FlushScheduler
+
+	// Optional batcher of the chunks put to the store by concurrent flushes.
+	flushBatcher *flushBatcher
+
+	// Optional clock of the fair queueing of the flush operations.
+	flushFair *flushFairClock
+
+	// Called once the flush on shutdown completed, before leaving the ring. Set in tests.
+	onShutdownFlushed func()
+
 	chunkFilter chunk.RequestChunkFilterer
+
+	// Closes the chunks before flushing them, overridable in tests.
+	closeChunk func(*chunkenc.MemChunk) error
+
+	// Called in tests once a stream emptied by a flush is unlocked, right before removing it.
+	beforeStreamRemoval func(*stream)
 }
 
 // New makes a new Ingester.
@@ -231,6 +577,9 @@ func New(cfg Config, clientConfig client.Config, store ChunkStore, limits *valid
 		walStats.Set("enabled")
 	}
 	metrics := newIngesterMetrics(registerer)
+	if err := registerFlushMetrics(registerer, cfg.DisabledFlushMetrics); err != nil {
+		return nil, err
+	}
 
 	i := &Ingester{
 		cfg:                   cfg,
@@ -241,11 +590,25 @@ func New(cfg Config, clientConfig client.Config, store ChunkStore, limits *valid
 		periodicConfigs:       store.GetSchemaConfigs(),
 		loopQuit:              make(chan struct{}),
 		flushQueues:           make([]*util.PriorityQueue, cfg.ConcurrentFlushes),
+		flushStats:            newFlushQueueStats(cfg.ConcurrentFlushes),
+		flushPushback:         atomic.NewBool(false),
+		draining:              atomic.NewBool(false),
+		flushPause:            newFlushPause(metrics),
 		tailersQuit:           make(chan struct{}),
 		metrics:               metrics,
 		flushOnShutdownSwitch: &OnceSwitch{},
+		closeChunk:            (*chunkenc.MemChunk).Close,
+	}
+	i.flushCtx, i.cancelFlushes = context.WithCancel(context.Background())
+	if cfg.FlushFairQueueing {
+		i.flushFair = newFlushFairClock()
+	}
+	if cfg.FlushBatchWindow > 0 {
+		i.flushBatcher = newFlushBatcher(i.flushCtx, cfg.FlushBatchWindow, i.flushBatchMaxChunks, cfg.FlushOpTimeout, i.timedPutWithRefs)
 	}
 	i.replayController = newReplayController(metrics, cfg.WAL, &replayFlusher{i})
+	// Nothing is flushed in read-only mode, so the replay can't be throttled by flushing.
+	i.replayController.noCeiling = cfg.ReadOnly
 
 	if cfg.WAL.Enabled {
 		if err := os.MkdirAll(cfg.WAL.Dir, os.ModePerm); err != nil {
@@ -265,6 +628,28 @@ func New(cfg Config, clientConfig client.Config, store ChunkStore, limits *valid
 	}
 	i.wal = wal
 
+	if cfg.FlushDeadLetterPath != "" {
+		i.deadLetters, err = newDeadLetterLog(cfg.FlushDeadLetterPath)
+		if err != nil {
+			return nil, fmt.Errorf("creating flush dead-letter log at %q: %w", cfg.FlushDeadLetterPath, err)
+		}
+	}
+
+	if cfg.FlushSpool.Dir != "" {
+		i.spool, err = newFlushSpool(cfg.FlushSpool, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("creating flush spool at %q: %w", cfg.FlushSpool.Dir, err)
+		}
+	}
+
+	if cfg.FlushPacingTargetLatency > 0 {
+		i.flushPacer = newFlushPacer(cfg.FlushPacingTargetLatency, metrics)
+	}
+
+	if cfg.FlushCircuitBreakerFailures > 0 {
+		i.flushBreaker = newFlushBreaker(cfg.FlushCircuitBreakerFailures, cfg.FlushCircuitBreakerCooldown, metrics)
+	}
+
 	i.lifecycler, err = ring.NewLifecycler(cfg.LifecyclerConfig, i, "ingester", RingKey, !cfg.WAL.Enabled || cfg.WAL.FlushOnShutdown, util_log.Logger, prometheus.WrapRegistererWithPrefix("cortex_", registerer))
 	if err != nil {
 		return nil, err
@@ -285,6 +670,18 @@ func New(cfg Config, clientConfig client.Config, store ChunkStore, limits *valid
 		i.SetChunkFilterer(i.cfg.ChunkFilterer)
 	}
 
+	if cfg.FlushEventSink != nil {
+		i.flushEvents = newFlushEventPublisher(cfg.FlushEventSink, cfg.FlushEventBufferSize, metrics)
+	}
+	if cfg.FlushSchedule != "" {
+		schedule, err := parseCronSchedule(cfg.FlushSchedule)
+		if err != nil {
+			return nil, err
+		}
+		i.flushCron = newFlushCron(schedule)
+	}
+	i.flushScheduler = cfg.FlushScheduler
+
 	return i, nil
 }
 
@@ -443,7 +840,10 @@ func (i *Ingester) starting(ctx context.Context) error {
 
 		endReplay()
 
-		i.wal.Start()
+		// Don't checkpoint nor truncate the replayed WAL in read-only mode.
+		if !i.cfg.ReadOnly {
+			i.wal.Start()
+		}
 	}
 
 	i.InitFlushQueues()
@@ -459,9 +859,30 @@ func (i *Ingester) starting(ctx context.Context) error {
 		return err
 	}
 
+	if i.cfg.ReadOnly {
+		if err := i.leaveRingReadOnly(ctx); err != nil {
+			return fmt.Errorf("leaving the ring in read-only mode: %w", err)
+		}
+	}
+
 	// start our loop
 	i.loopDone.Add(1)
 	go i.loop()
+
+	if i.cfg.FlushStallThreshold > 0 {
+		i.loopDone.Add(1)
+		go i.flushWatchdog()
+	}
+
+	if i.flushCron != nil {
+		i.loopDone.Add(1)
+		go i.flushScheduleLoop()
+	}
+
+	if i.spool != nil {
+		i.loopDone.Add(1)
+		go i.flushSpoolReplayLoop()
+	}
 	return nil
 }
 
@@ -486,6 +907,29 @@ func (i *Ingester) running(ctx context.Context) error {
 	return serviceError
 }
 
+// leaveRingReadOnly moves a read-only ingester to the LEAVING state once it joined the ring: the
+// distributors don't send writes to LEAVING ingesters, which it would reject, while the queriers
+// still query them. The lifecycler only allows ACTIVE ingesters to leave, so it waits for the join.
+func (i *Ingester) leaveRingReadOnly(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		switch i.lifecycler.GetState() {
+		case ring.LEAVING:
+			return nil
+		case ring.ACTIVE:
+			return i.lifecycler.ChangeState(ctx, ring.LEAVING)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 // Called after running exits, when Ingester transitions to Stopping state.
 // At this point, loop no longer runs, but flushers are still running.
 func (i *Ingester) stopping(_ error) error {
@@ -493,17 +937,25 @@ func (i *Ingester) stopping(_ error) error {
 	var errs errUtil.MultiError
 	errs.Add(i.wal.Stop())
 
+	// The flush on shutdown would otherwise wait forever.
+	if i.flushPause.stop() {
+		level.Info(util_log.Logger).Log("msg", "resumed the paused flushing on shutdown")
+	}
+
 	if i.flushOnShutdownSwitch.Get() {
 		i.lifecycler.SetFlushOnShutdown(true)
 	}
+	// Stopping the lifecycler flushes the chunks with the flush loops still running, and only then
+	// removes the ingester from the ring, see Flush.
 	errs.Add(services.StopAndAwaitTerminated(context.Background(), i.lifecycler))
 
 	// Normally, flushers are stopped via lifecycler (in transferOut), but if lifecycler fails,
 	// we better stop them.
-	for _, flushQueue := range i.flushQueues {
-		flushQueue.Close()
-	}
+	i.closeFlushQueues(false)
 	i.flushQueuesDone.Wait()
+	i.cancelFlushes()
+	i.flushEvents.Close()
+	errs.Add(i.deadLetters.Close())
 
 	return errs.Err()
 }
@@ -511,13 +963,17 @@ func (i *Ingester) stopping(_ error) error {
 func (i *Ingester) loop() {
 	defer i.loopDone.Done()
 
-	flushTicker := time.NewTicker(i.cfg.FlushCheckPeriod)
-	defer flushTicker.Stop()
+	flushTimer := time.NewTimer(i.nextSweepInterval())
+	defer flushTimer.Stop()
 
 	for {
 		select {
-		case <-flushTicker.C:
+		case <-flushTimer.C:
 			i.sweepUsers(false, true)
+			i.drainSweep()
+			i.updateFlushPushback(time.Now())
+			i.removeIdleEmptyTenants(time.Now())
+			flushTimer.Reset(i.nextSweepInterval())
 
 		case <-i.loopQuit:
 			return
@@ -525,6 +981,81 @@ func (i *Ingester) loop() {
 	}
 }
 
+// nextSweepInterval returns the flush check period, randomised by the configured jitter.
+func (i *Ingester) nextSweepInterval() time.Duration {
+	if i.cfg.FlushCheckPeriodJitter <= 0 {
+		return i.cfg.FlushCheckPeriod
+	}
+	return util.DurationWithJitter(i.cfg.FlushCheckPeriod, i.cfg.FlushCheckPeriodJitter)
+}
+
+// removeIdleEmptyTenants garbage collects the tenants which have held no streams for longer than
+// TenantGCGracePeriod. An instance is only removed once no push or new tailer is using it, see
+// withInstance, and with no open tailers.
+func (i *Ingester) removeIdleEmptyTenants(now time.Time) {
+	if i.cfg.TenantGCGracePeriod <= 0 {
+		return
+	}
+	for _, instance := range i.getInstances() {
+		if instance.numStreams() > 0 {
+			instance.emptySince.Store(0)
+			continue
+		}
+		since := instance.emptySince.Load()
+		if since == 0 {
+			instance.emptySince.Store(now.UnixNano())
+			continue
+		}
+		if now.Sub(time.Unix(0, since)) < i.cfg.TenantGCGracePeriod {
+			continue
+		}
+
+		instance.gcMtx.Lock()
+		if instance.numStreams() == 0 && instance.openTailersCount() == 0 {
+			instance.removed = true
+			i.instancesMtx.Lock()
+			delete(i.instances, instance.instanceID)
+			activeTenantsStats.Set(int64(len(i.instances)))
+			i.instancesMtx.Unlock()
+			i.metrics.emptyTenantsReclaimed.Inc()
+			i.forgetTenant(instance.instanceID)
+		}
+		instance.gcMtx.Unlock()
+	}
+}
+
+// forgetTenant deletes the per tenant series and state of a removed tenant, so that they don't
+// accumulate with tenants coming and going. They are created again if the tenant comes back.
+func (i *Ingester) forgetTenant(userID string) {
+	memoryStreams.DeleteLabelValues(userID)
+	streamsCreatedTotal.DeleteLabelValues(userID)
+	streamsRemovedTotal.DeleteLabelValues(userID)
+	flushLagPerTenant.DeleteLabelValues(userID)
+	chunkUtilizationPerTenant.DeleteLabelValues(userID)
+	chunksPerTenant.DeleteLabelValues(userID)
+	chunkSizePerTenant.DeleteLabelValues(userID)
+	if i.flushFair != nil {
+		i.flushFair.forget(userID)
+	}
+}
+
+// withInstance calls f with the instance of the tenant, created if needed, which isn't garbage
+// collected until f returns.
+func (i *Ingester) withInstance(instanceID string, f func(*instance) error) error {
+	for {
+		instance := i.GetOrCreateInstance(instanceID)
+		instance.gcMtx.RLock()
+		if instance.removed {
+			// Removed from the instances while holding gcMtx, the next one is a new instance.
+			instance.gcMtx.RUnlock()
+			continue
+		}
+		err := f(instance)
+		instance.gcMtx.RUnlock()
+		return err
+	}
+}
+
 // ShutdownHandler triggers the following set of operations in order:
 //     * Change the state of ring to stop accepting writes.
 //     * Flush all the chunks.
@@ -537,6 +1068,58 @@ func (i *Ingester) ShutdownHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// CheckpointHandler writes a WAL checkpoint right away, e.g. before a planned restart to shorten
+// the replay, and responds once it is durable. Like the periodic checkpoints, it reads every
+// stream under its chunk lock so that it doesn't race with flushes.
+func (i *Ingester) CheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	if i.cfg.ReadOnly {
+		http.Error(w, "the WAL isn't running in read-only mode", http.StatusBadRequest)
+		return
+	}
+	err := i.wal.Checkpoint(r.Context())
+	if errors.Is(err, errWALDisabled) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("checkpoint failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TenantStats is the in-memory data of a tenant as reported by TenantsHandler.
+type TenantStats struct {
+	Tenant  string `json:"tenant"`
+	Streams int    `json:"streams"`
+	Chunks  int    `json:"chunks"`
+}
+
+// TenantsHandler lists the tenants holding data in memory, with their number of streams and chunks.
+func (i *Ingester) TenantsHandler(w http.ResponseWriter, _ *http.Request) {
+	util.WriteJSONResponse(w, struct {
+		Tenants []TenantStats `json:"tenants"`
+	}{Tenants: i.tenantStats()})
+}
+
+func (i *Ingester) tenantStats() []TenantStats {
+	instances := i.getInstances()
+	tenants := make([]TenantStats, 0, len(instances))
+	for _, instance := range instances {
+		ts := TenantStats{Tenant: instance.instanceID}
+		_ = instance.streams.ForEach(func(s *stream) (bool, error) {
+			s.chunkMtx.RLock()
+			ts.Chunks += len(s.chunks)
+			s.chunkMtx.RUnlock()
+			ts.Streams++
+			return true, nil
+		})
+		tenants = append(tenants, ts)
+	}
+	sort.Slice(tenants, func(a, b int) bool { return tenants[a].Tenant < tenants[b].Tenant })
+	return tenants
+}
+
 // Push implements logproto.Pusher.
 func (i *Ingester) Push(ctx context.Context, req *logproto.PushRequest) (*logproto.PushResponse, error) {
 	instanceID, err := tenant.TenantID(ctx)
@@ -544,10 +1127,17 @@ func (i *Ingester) Push(ctx context.Context, req *logproto.PushRequest) (*logpro
 		return nil, err
 	} else if i.readonly {
 		return nil, ErrReadOnly
+	} else if i.cfg.ReadOnly {
+		return nil, ErrReadOnlyMode
+	} else if i.draining.Load() {
+		return nil, ErrDraining
+	} else if i.flushPushback.Load() {
+		return nil, ErrFlushPushback
 	}
 
-	instance := i.GetOrCreateInstance(instanceID)
-	err = instance.Push(ctx, req)
+	err = i.withInstance(instanceID, func(instance *instance) error {
+		return instance.Push(ctx, req)
+	})
 	return &logproto.PushResponse{}, err
 }
 
@@ -792,6 +1382,9 @@ func (i *Ingester) CheckReady(ctx context.Context) error {
 	if s := i.State(); s != services.Running && s != services.Stopping {
 		return fmt.Errorf("ingester not ready: %v", s)
 	}
+	if i.flushPushback.Load() {
+		return errors.New("ingester not ready: flush queues are saturated")
+	}
 	return i.lifecycler.CheckReady(ctx)
 }
 
@@ -827,13 +1420,15 @@ func (i *Ingester) Tail(req *logproto.TailRequest, queryServer logproto.Querier_
 		return err
 	}
 
-	instance := i.GetOrCreateInstance(instanceID)
 	tailer, err := newTailer(instanceID, req.Query, queryServer, i.cfg.MaxDroppedStreams)
 	if err != nil {
 		return err
 	}
 
-	if err := instance.addNewTailer(queryServer.Context(), tailer); err != nil {
+	err = i.withInstance(instanceID, func(instance *instance) error {
+		return instance.addNewTailer(queryServer.Context(), tailer)
+	})
+	if err != nil {
 		return err
 	}
 	tailer.loop()
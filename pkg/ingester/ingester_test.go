@@ -5,13 +5,16 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"sort"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/require"
@@ -343,6 +346,171 @@ func defaultLimitsTestConfig() validation.Limits {
 	return limits
 }
 
+func TestIngester_TenantsHandler(t *testing.T) {
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	for tenantID, streams := range map[string][]string{
+		"tenant-a": {`{app="a"}`, `{app="b"}`},
+		"tenant-b": {`{app="a"}`},
+	} {
+		req := &logproto.PushRequest{}
+		for _, lbs := range streams {
+			req.Streams = append(req.Streams, logproto.Stream{Labels: lbs, Entries: entries(5, time.Unix(0, 0))})
+		}
+		_, err := ing.Push(user.InjectOrgID(context.Background(), tenantID), req)
+		require.NoError(t, err)
+	}
+
+	w := httptest.NewRecorder()
+	ing.TenantsHandler(w, httptest.NewRequest(http.MethodGet, "/ingester/tenants", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"tenants": [
+		{"tenant": "tenant-a", "streams": 2, "chunks": 2},
+		{"tenant": "tenant-b", "streams": 1, "chunks": 1}
+	]}`, w.Body.String())
+}
+
+func TestIngester_RemoveIdleEmptyTenants(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.TenantGCGracePeriod = time.Minute
+	cfg.FlushFairQueueing = true
+	_, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	const tenantID = "intermittent"
+	ctx := user.InjectOrgID(context.Background(), tenantID)
+	push := func() {
+		_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: `{app="a"}`, Entries: entries(5, time.Now())},
+		}})
+		require.NoError(t, err)
+	}
+	emptyStreams := func() {
+		inst, ok := ing.getInstanceByID(tenantID)
+		require.True(t, ok)
+		s, ok := inst.streams.Load(`{app="a"}`)
+		require.True(t, ok)
+		inst.removeStream(s)
+	}
+	exists := func() bool {
+		_, ok := ing.getInstanceByID(tenantID)
+		return ok
+	}
+
+	push()
+	emptyStreams()
+	now := time.Now()
+	ing.removeIdleEmptyTenants(now)
+	ing.removeIdleEmptyTenants(now.Add(50 * time.Second))
+	require.True(t, exists())
+
+	// Briefly empty, the tenant reappears within the grace period.
+	push()
+	ing.removeIdleEmptyTenants(now.Add(70 * time.Second))
+	require.True(t, exists())
+
+	emptyStreams()
+	flushLagPerTenant.WithLabelValues(tenantID).Set(1)
+	chunksPerTenant.WithLabelValues(tenantID).Inc()
+	chunkSizePerTenant.WithLabelValues(tenantID).Add(1)
+	require.True(t, ing.flushFair.tag(&flushOp{userID: tenantID}, 1, func() bool { return true }))
+	ing.removeIdleEmptyTenants(now.Add(80 * time.Second))
+	ing.removeIdleEmptyTenants(now.Add(130 * time.Second))
+	require.True(t, exists())
+	ing.removeIdleEmptyTenants(now.Add(140 * time.Second))
+	require.False(t, exists())
+	require.Equal(t, float64(1), testutil.ToFloat64(ing.metrics.emptyTenantsReclaimed))
+
+	// The series of the tenant are gone, deleting them again finds nothing.
+	require.False(t, memoryStreams.DeleteLabelValues(tenantID))
+	require.False(t, flushLagPerTenant.DeleteLabelValues(tenantID))
+	require.False(t, chunksPerTenant.DeleteLabelValues(tenantID))
+	require.False(t, chunkSizePerTenant.DeleteLabelValues(tenantID))
+	require.NotContains(t, ing.flushFair.last, tenantID)
+
+	// Pushing again creates a new instance.
+	push()
+	require.True(t, exists())
+}
+
+func TestIngester_Draining(t *testing.T) {
+	cfg := defaultIngesterTestConfig(t)
+	cfg.DrainStreamsPerSweep = 1
+	store, ing := newTestStore(t, cfg, nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	ctx := user.InjectOrgID(context.Background(), "test")
+	push := func() error {
+		_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: `{app="a"}`, Entries: entries(5, time.Unix(0, 0))},
+			{Labels: `{app="b"}`, Entries: entries(5, time.Unix(0, 0))},
+		}})
+		return err
+	}
+	require.NoError(t, push())
+
+	w := httptest.NewRecorder()
+	ing.DrainHandler(w, httptest.NewRequest(http.MethodPost, "/ingester/drain", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	// The distributors stop sending writes to the ingester, the ones still reaching it are rejected.
+	require.Equal(t, ring.LEAVING, ing.lifecycler.GetState())
+	desc, err := ing.lifecycler.KVStore.Get(context.Background(), RingKey)
+	require.NoError(t, err)
+	require.Equal(t, ring.LEAVING, desc.(*ring.Desc).Ingesters[cfg.LifecyclerConfig.ID].State)
+	require.ErrorIs(t, push(), ErrDraining)
+
+	// The streams are flushed one per sweep.
+	flushed := func(n int) func() bool {
+		return func() bool {
+			store.mtx.Lock()
+			defer store.mtx.Unlock()
+			return len(store.chunks["test"]) == n
+		}
+	}
+	require.Eventually(t, flushed(1), 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return ing.flushQueueDepth() == 0 }, 5*time.Second, 10*time.Millisecond)
+	ing.drainSweep()
+	require.Eventually(t, flushed(2), 5*time.Second, 10*time.Millisecond)
+
+	// Queries are still served from memory.
+	result := mockQuerierServer{ctx: ctx}
+	require.NoError(t, ing.Query(&logproto.QueryRequest{
+		Selector: `{app=~"a|b"}`,
+		Limit:    100,
+		Start:    time.Unix(0, 0),
+		End:      time.Unix(1, 0),
+	}, &result))
+	require.Len(t, result.resps, 1)
+	require.Len(t, result.resps[0].Streams, 2)
+}
+
+func TestIngester_FlushPushbackRejectsPushes(t *testing.T) {
+	_, ing := newTestStore(t, defaultIngesterTestConfig(t), nil)
+	defer services.StopAndAwaitTerminated(context.Background(), ing) //nolint:errcheck
+
+	ctx := user.InjectOrgID(context.Background(), "test")
+	push := func() error {
+		_, err := ing.Push(ctx, &logproto.PushRequest{Streams: []logproto.Stream{
+			{Labels: `{app="a"}`, Entries: entries(5, time.Unix(0, 0))},
+		}})
+		return err
+	}
+
+	ing.flushPushback.Store(true)
+	err := push()
+	require.ErrorIs(t, err, ErrFlushPushback)
+	resp, ok := httpgrpc.HTTPResponseFromError(err)
+	require.True(t, ok)
+	require.Equal(t, int32(http.StatusTooManyRequests), resp.Code)
+	_, ok = ing.getInstanceByID("test")
+	require.False(t, ok)
+
+	ing.flushPushback.Store(false)
+	require.NoError(t, push())
+}
+
 func TestIngester_buildStoreRequest(t *testing.T) {
 	now := time.Now()
 	for _, tc := range []struct {
@@ -491,27 +659,150 @@ func TestValidate(t *testing.T) {
 	}{
 		{
 			in: Config{
-				MaxChunkAge:   time.Minute,
-				ChunkEncoding: chunkenc.EncGZIP.String(),
-				IndexShards:   index.DefaultIndexShards,
+				MaxChunkAge:       time.Minute,
+				ChunkEncoding:     chunkenc.EncGZIP.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
 			},
 			expected: Config{
-				MaxChunkAge:    time.Minute,
-				ChunkEncoding:  chunkenc.EncGZIP.String(),
-				parsedEncoding: chunkenc.EncGZIP,
-				IndexShards:    index.DefaultIndexShards,
+				MaxChunkAge:       time.Minute,
+				ChunkEncoding:     chunkenc.EncGZIP.String(),
+				parsedEncoding:    chunkenc.EncGZIP,
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
 			},
 		},
 		{
 			in: Config{
-				ChunkEncoding: chunkenc.EncSnappy.String(),
-				IndexShards:   index.DefaultIndexShards,
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
 			},
 			expected: Config{
-				ChunkEncoding:  chunkenc.EncSnappy.String(),
-				parsedEncoding: chunkenc.EncSnappy,
-				IndexShards:    index.DefaultIndexShards,
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				parsedEncoding:    chunkenc.EncSnappy,
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+			},
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: -1,
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				FlushOpRetries:    -1,
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:               chunkenc.EncSnappy.String(),
+				IndexShards:                 index.DefaultIndexShards,
+				ConcurrentFlushes:           1,
+				FlushCircuitBreakerFailures: 3,
 			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				ExtraFlushLabels:  map[string]string{"__name__": "other"},
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:              chunkenc.EncSnappy.String(),
+				IndexShards:                index.DefaultIndexShards,
+				ConcurrentFlushes:          1,
+				UndersizedChunkUtilization: 2,
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				FlushEventSink:    &fakeFlushEventSink{},
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				FlushQueueHash:    "crc32",
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				FlushLabelLimits:  "drop",
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				FlushSchedule:     "*/15 * * *",
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				FlushSchedule:     "0 24 * * *",
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				FlushBatchWindow:  -time.Second,
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:       chunkenc.EncSnappy.String(),
+				IndexShards:         index.DefaultIndexShards,
+				ConcurrentFlushes:   1,
+				FlushBatchWindow:    time.Second,
+				FlushBatchMaxChunks: -1,
+			},
+			err: true,
+		},
+		{
+			in: Config{
+				ChunkEncoding:     chunkenc.EncSnappy.String(),
+				IndexShards:       index.DefaultIndexShards,
+				ConcurrentFlushes: 1,
+				MaxChunkAge:       time.Hour,
+				RetainPeriod:      24 * time.Hour,
+				StrictValidation:  true,
+			},
+			err: true,
 		},
 		{
 			in: Config{
@@ -540,6 +831,20 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestValidationWarnings(t *testing.T) {
+	cfg := Config{MaxChunkAge: time.Hour, RetainPeriod: 5 * time.Hour}
+	require.Empty(t, cfg.validationWarnings())
+
+	cfg.RetainPeriod = 24 * time.Hour
+	warnings := cfg.validationWarnings()
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "chunk retain period")
+
+	// Nothing to compare the retain period to without a max chunk age.
+	cfg.MaxChunkAge = 0
+	require.Empty(t, cfg.validationWarnings())
+}
+
 func Test_InMemoryLabels(t *testing.T) {
 	ingesterConfig := defaultIngesterTestConfig(t)
 	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
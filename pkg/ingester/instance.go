@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	"github.com/go-kit/log/level"
+	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -70,6 +71,7 @@ type instance struct {
 
 	instanceID string
 
+	memoryStreams       prometheus.Gauge
 	streamsCreatedTotal prometheus.Counter
 	streamsRemovedTotal prometheus.Counter
 
@@ -88,6 +90,16 @@ type instance struct {
 	metrics *ingesterMetrics
 
 	chunkFilter chunk.RequestChunkFilterer
+
+	// Uncompressed bytes of the unflushed chunks in memory, as of the last periodic sweep.
+	unflushedBytes atomic.Int64
+
+	// Held for reading while pushing or adding a tailer, so that the instance isn't garbage
+	// collected meanwhile, and for writing while removing it, see Ingester.removeIdleEmptyTenants.
+	gcMtx   sync.RWMutex
+	removed bool
+	// Unix nanoseconds since when the instance holds no streams as seen by the sweeps, 0 otherwise.
+	emptySince atomic.Int64
 }
 
 func newInstance(cfg *Config, instanceID string, limiter *Limiter, configs *runtime.TenantConfigs, wal WAL, metrics *ingesterMetrics, flushOnShutdownSwitch *OnceSwitch, chunkFilter chunk.RequestChunkFilterer) *instance {
@@ -111,6 +123,12 @@ func newInstance(cfg *Config, instanceID string, limiter *Limiter, configs *runt
 
 		chunkFilter: chunkFilter,
 	}
+	if cfg.PerTenantMemoryStreamsMetric {
+		i.memoryStreams = memoryStreams.WithLabelValues(instanceID)
+	} else {
+		// Unregistered, so that the tenant doesn't add to the cardinality.
+		i.memoryStreams = prometheus.NewGauge(prometheus.GaugeOpts{})
+	}
 	i.mapper = newFPMapper(i.getLabelsFromFingerprint)
 	return i
 }
@@ -172,6 +190,11 @@ func (i *instance) Push(ctx context.Context, req *logproto.PushRequest) error {
 		if err != nil {
 			appendErr = err
 		}
+		if i.cfg.FlushTracing {
+			if sp := opentracing.SpanFromContext(ctx); sp != nil {
+				s.lastPushSpan = sp.Context()
+			}
+		}
 		s.chunkMtx.Unlock()
 	}
 
@@ -233,6 +256,9 @@ func (i *instance) createStream(pushReqStream logproto.Stream, record *WALRecord
 		}
 		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 	}
+	// The stream is the same series as its chunks in the store, so that the query results of the
+	// ingester and of the store merge.
+	labels = withExtraFlushLabels(labels, i.cfg.ExtraFlushLabels)
 	fp := i.getHashForLabels(labels)
 
 	sortedLabels := i.index.Add(logproto.FromLabelsToLabelAdapters(labels), fp)
@@ -249,7 +275,7 @@ func (i *instance) createStream(pushReqStream logproto.Stream, record *WALRecord
 		i.metrics.recoveredStreamsTotal.Inc()
 	}
 
-	memoryStreams.WithLabelValues(i.instanceID).Inc()
+	i.memoryStreams.Inc()
 	i.streamsCreatedTotal.Inc()
 	i.addTailersToNewStream(s)
 	streamsCountStats.Add(1)
@@ -270,7 +296,7 @@ func (i *instance) createStreamByFP(ls labels.Labels, fp model.Fingerprint) *str
 	s := newStream(i.cfg, i.limiter, i.instanceID, fp, sortedLabels, i.limiter.UnorderedWrites(i.instanceID), i.metrics)
 
 	i.streamsCreatedTotal.Inc()
-	memoryStreams.WithLabelValues(i.instanceID).Inc()
+	i.memoryStreams.Inc()
 	i.addTailersToNewStream(s)
 
 	return s
@@ -292,7 +318,7 @@ func (i *instance) removeStream(s *stream) {
 	if i.streams.Delete(s) {
 		i.index.Delete(s.labels, s.fp)
 		i.streamsRemovedTotal.Inc()
-		memoryStreams.WithLabelValues(i.instanceID).Dec()
+		i.memoryStreams.Dec()
 		streamsCountStats.Add(-1)
 	}
 }
@@ -508,6 +534,24 @@ func (i *instance) Series(ctx context.Context, req *logproto.SeriesRequest) (*lo
 	return &logproto.SeriesResponse{Series: series}, nil
 }
 
+// updateUnflushedBytes sums the uncompressed bytes of the unflushed chunks of all the streams,
+// records the sum in unflushedBytes and returns it.
+func (i *instance) updateUnflushedBytes() int64 {
+	var total int64
+	_ = i.streams.ForEach(func(s *stream) (bool, error) {
+		s.chunkMtx.RLock()
+		defer s.chunkMtx.RUnlock()
+		for _, c := range s.chunks {
+			if c.flushed.IsZero() {
+				total += int64(c.chunk.UncompressedSize())
+			}
+		}
+		return true, nil
+	})
+	i.unflushedBytes.Store(total)
+	return total
+}
+
 func (i *instance) numStreams() int {
 	return i.streams.Len()
 }
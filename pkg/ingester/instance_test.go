@@ -15,6 +15,7 @@ import (
 	"github.com/grafana/loki/pkg/storage/chunk"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/require"
 
@@ -26,9 +27,10 @@ import (
 
 func defaultConfig() *Config {
 	cfg := Config{
-		BlockSize:     512,
-		ChunkEncoding: "gzip",
-		IndexShards:   32,
+		BlockSize:         512,
+		ChunkEncoding:     "gzip",
+		IndexShards:       32,
+		ConcurrentFlushes: 1,
 	}
 	if err := cfg.Validate(); err != nil {
 		panic(errors.Wrap(err, "error building default test config"))
@@ -65,6 +67,41 @@ func TestLabelsCollisions(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestMemoryStreamsMetric(t *testing.T) {
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+	limiter := NewLimiter(limits, NilMetrics, &ringCountMock{count: 1}, 1)
+
+	cfg := defaultConfig()
+	cfg.PerTenantMemoryStreamsMetric = true
+	push := func(inst *instance, streams ...string) {
+		req := &logproto.PushRequest{}
+		for _, lbs := range streams {
+			req.Streams = append(req.Streams, logproto.Stream{Labels: lbs, Entries: entries(5, time.Now())})
+		}
+		require.NoError(t, inst.Push(context.Background(), req))
+	}
+
+	instA := newInstance(cfg, "memory-streams-a", limiter, loki_runtime.DefaultTenantConfigs(), noopWAL{}, NilMetrics, &OnceSwitch{}, nil)
+	instB := newInstance(cfg, "memory-streams-b", limiter, loki_runtime.DefaultTenantConfigs(), noopWAL{}, NilMetrics, &OnceSwitch{}, nil)
+	push(instA, `{app="a"}`, `{app="b"}`)
+	push(instB, `{app="a"}`)
+	require.Equal(t, float64(2), testutil.ToFloat64(memoryStreams.WithLabelValues("memory-streams-a")))
+	require.Equal(t, float64(1), testutil.ToFloat64(memoryStreams.WithLabelValues("memory-streams-b")))
+
+	s, ok := instA.streams.Load(`{app="a"}`)
+	require.True(t, ok)
+	instA.removeStream(s)
+	require.Equal(t, float64(1), testutil.ToFloat64(memoryStreams.WithLabelValues("memory-streams-a")))
+
+	// No series is added for the tenants when disabled.
+	series := testutil.CollectAndCount(memoryStreams)
+	cfg = defaultConfig()
+	instC := newInstance(cfg, "memory-streams-c", limiter, loki_runtime.DefaultTenantConfigs(), noopWAL{}, NilMetrics, &OnceSwitch{}, nil)
+	push(instC, `{app="a"}`)
+	require.Equal(t, series, testutil.CollectAndCount(memoryStreams))
+}
+
 func TestConcurrentPushes(t *testing.T) {
 	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
 	require.NoError(t, err)
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/grafana/dskit/flagext"
 	"golang.org/x/time/rate"
 
 	"github.com/grafana/loki/pkg/validation"
@@ -47,8 +48,35 @@ func (l *Limiter) Enable() {
 	l.metrics.limiterEnabled.Set(1)
 }
 
-// NewLimiter makes a new limiter
+// Disabled reports whether the limiter is disabled, i.e. during WAL replay.
+func (l *Limiter) Disabled() bool {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.disabled
+}
+
+var (
+	defaultOverridesOnce sync.Once
+	defaultOverrides     *validation.Overrides
+)
+
+// overridesOrDefaults returns the given overrides, or overrides holding the default limits of
+// every tenant when the ingester has none configured.
+func overridesOrDefaults(limits *validation.Overrides) *validation.Overrides {
+	if limits != nil {
+		return limits
+	}
+	defaultOverridesOnce.Do(func() {
+		var defaults validation.Limits
+		flagext.DefaultValues(&defaults)
+		defaultOverrides, _ = validation.NewOverrides(defaults, nil)
+	})
+	return defaultOverrides
+}
+
+// NewLimiter makes a new limiter. The default limits apply to every tenant when limits is nil.
 func NewLimiter(limits *validation.Overrides, metrics *ingesterMetrics, ring RingCount, replicationFactor int) *Limiter {
+	limits = overridesOrDefaults(limits)
 	return &Limiter{
 		limits:            limits,
 		ring:              ring,
@@ -67,6 +95,10 @@ func (l *Limiter) UnorderedWrites(userID string) bool {
 	return l.limits.UnorderedWrites(userID)
 }
 
+func (l *Limiter) SkipFlushMetrics(userID string) bool {
+	return l.limits.SkipFlushMetrics(userID)
+}
+
 // AssertMaxStreamsPerUser ensures limit has not been reached compared to the current
 // number of streams in input and returns an error if so.
 func (l *Limiter) AssertMaxStreamsPerUser(userID string, streams int) error {
@@ -35,6 +35,26 @@ type ingesterMetrics struct {
 	limiterEnabled prometheus.Gauge
 
 	autoForgetUnhealthyIngestersTotal prometheus.Counter
+
+	flushPushback prometheus.Gauge
+	flushAttempts prometheus.Histogram
+	flushPanics   prometheus.Counter
+
+	emptyTenantsReclaimed prometheus.Counter
+
+	flushLastSuccess *prometheus.GaugeVec
+
+	flushSpoolBytes          prometheus.Gauge
+	flushSpoolChunksWritten  prometheus.Counter
+	flushSpoolChunksReplayed prometheus.Counter
+
+	flushPacingFactor prometheus.Gauge
+
+	flushCircuitBreakerState prometheus.Gauge
+
+	flushPaused prometheus.Gauge
+
+	flushEventsDropped *prometheus.CounterVec
 }
 
 // setRecoveryBytesInUse bounds the bytes reports to >= 0.
@@ -148,5 +168,55 @@ func newIngesterMetrics(r prometheus.Registerer) *ingesterMetrics {
 			Name: "loki_ingester_autoforget_unhealthy_ingesters_total",
 			Help: "Total number of ingesters automatically forgotten",
 		}),
+		flushPushback: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Name: "loki_ingester_flush_pushback",
+			Help: "Whether the ingester is pushing back writes because its flush queues are saturated.",
+		}),
+		flushAttempts: promauto.With(r).NewHistogram(prometheus.HistogramOpts{
+			Name: "loki_ingester_flush_attempts",
+			Help: "Number of attempts made by a flush operation before it succeeded or was dropped.",
+			// 1 to 128 attempts.
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		}),
+		flushPanics: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Name: "loki_ingester_flush_panics_total",
+			Help: "Total number of flush operations which panicked. The flush loops recover and carry on with the next operations.",
+		}),
+		emptyTenantsReclaimed: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Name: "loki_ingester_empty_tenants_reclaimed_total",
+			Help: "Total number of tenants removed after holding no streams for longer than the tenant GC grace period.",
+		}),
+		flushLastSuccess: promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "loki_ingester_flush_last_success_seconds",
+			Help: "Unix timestamp of the last successful flush operation of each flush queue.",
+		}, []string{"queue"}),
+		flushSpoolBytes: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Name: "loki_ingester_flush_spool_bytes",
+			Help: "Size of the chunks spooled to local disk after failing to be flushed to the store.",
+		}),
+		flushSpoolChunksWritten: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Name: "loki_ingester_flush_spool_chunks_written_total",
+			Help: "Total number of chunks spooled to local disk after failing to be flushed to the store.",
+		}),
+		flushSpoolChunksReplayed: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Name: "loki_ingester_flush_spool_chunks_replayed_total",
+			Help: "Total number of spooled chunks successfully replayed to the store.",
+		}),
+		flushPacingFactor: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Name: "loki_ingester_flush_pacing_factor",
+			Help: "Fraction of the streams due for a flush which are enqueued by the sweeps, lowered while the store is slower than the flush pacing target latency.",
+		}),
+		flushCircuitBreakerState: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Name: "loki_ingester_flush_circuit_breaker_state",
+			Help: "State of the circuit breaker around the store puts: 0 closed, 1 open, failing the flushes right away, 2 half-open, probing the store.",
+		}),
+		flushPaused: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Name: "loki_ingester_flush_paused",
+			Help: "1 while flushing is paused through the /ingester/flush/pause endpoint, 0 otherwise.",
+		}),
+		flushEventsDropped: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Name: "loki_ingester_flush_events_dropped_total",
+			Help: "Total number of flush events not published to the flush event sink, because the buffer was full or publishing failed.",
+		}, []string{"reason"}),
 	}
 }
@@ -52,6 +52,8 @@ type replayController struct {
 	cond         *sync.Cond
 	isFlushing   atomic.Bool
 	flusher      Flusher
+	// Disables the back pressure, e.g. in read-only mode where nothing can be flushed.
+	noCeiling bool
 }
 
 // flusher is expected to reduce pressure via calling Sub
@@ -111,6 +113,10 @@ func (c *replayController) Flush() {
 // It will call the function as long as there is expected room before the memory cap and will then flush data intermittently
 // when needed.
 func (c *replayController) WithBackPressure(fn func() error) error {
+	if c.noCeiling {
+		return fn()
+	}
+
 	// Account for backpressure and wait until there's enough memory to continue replaying the WAL
 	c.cond.L.Lock()
 
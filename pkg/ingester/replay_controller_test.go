@@ -75,3 +75,18 @@ func TestReplayController(t *testing.T) {
 	require.Equal(t, expected, ops)
 
 }
+
+func TestReplayControllerNoCeiling(t *testing.T) {
+	var flushes int
+	rc := newReplayController(nilMetrics(), WALConfig{ReplayMemoryCeiling: 100}, newDumbFlusher(func() { flushes++ }))
+	rc.noCeiling = true
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, rc.WithBackPressure(func() error {
+			rc.Add(50)
+			return nil
+		}))
+	}
+	require.Equal(t, 250, rc.Cur())
+	require.Equal(t, 0, flushes)
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/go-kit/log/level"
+	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
@@ -100,13 +101,24 @@ type stream struct {
 	entryCt int64
 
 	unorderedWrites bool
+
+	// when a chunk of the stream was last stored by a flush, zero if none was.
+	// Protected by chunkMtx.
+	lastFlushed time.Time
+
+	// span of the last push to the stream, which its flushes follow from when the flush tracing is
+	// enabled. Protected by chunkMtx.
+	lastPushSpan opentracing.SpanContext
 }
 
 type chunkDesc struct {
-	chunk   *chunkenc.MemChunk
-	closed  bool
-	synced  bool
-	flushed time.Time
+	chunk    *chunkenc.MemChunk
+	closed   bool
+	synced   bool
+	pressure bool // closed to get the number of in memory chunks back under the limit.
+	flushed  time.Time
+	// why the chunk was last collected for flushing, set by collectChunksToFlush.
+	flushReason string
 
 	lastUpdated time.Time
 }
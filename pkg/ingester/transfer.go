@@ -289,9 +289,7 @@ func (i *Ingester) transferOut(ctx context.Context) error {
 		return errors.Wrap(err, "CloseAndRecv")
 	}
 
-	for _, flushQueue := range i.flushQueues {
-		flushQueue.DiscardAndClose()
-	}
+	i.closeFlushQueues(true)
 	i.flushQueuesDone.Wait()
 
 	level.Info(logger).Log("msg", "successfully sent chunks", "to_ingester", targetIngester.Addr)
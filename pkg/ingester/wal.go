@@ -1,6 +1,7 @@
 package ingester
 
 import (
+	"context"
 	"flag"
 	"sync"
 	"time"
@@ -57,13 +58,21 @@ type WAL interface {
 	Log(*WALRecord) error
 	// Stop stops all the WAL operations.
 	Stop() error
+	// Checkpoint writes a checkpoint right away, returning once it is durable.
+	Checkpoint(ctx context.Context) error
 }
 
+var (
+	errWALDisabled = errors.New("WAL is disabled")
+	errWALStopped  = errors.New("WAL is stopped")
+)
+
 type noopWAL struct{}
 
-func (noopWAL) Start()               {}
-func (noopWAL) Log(*WALRecord) error { return nil }
-func (noopWAL) Stop() error          { return nil }
+func (noopWAL) Start()                           {}
+func (noopWAL) Log(*WALRecord) error             { return nil }
+func (noopWAL) Stop() error                      { return nil }
+func (noopWAL) Checkpoint(context.Context) error { return errWALDisabled }
 
 type walWrapper struct {
 	cfg        WALConfig
@@ -71,6 +80,8 @@ type walWrapper struct {
 	metrics    *ingesterMetrics
 	seriesIter SeriesIter
 
+	checkpointRequests chan chan error
+
 	wait sync.WaitGroup
 	quit chan struct{}
 }
@@ -87,11 +98,12 @@ func newWAL(cfg WALConfig, registerer prometheus.Registerer, metrics *ingesterMe
 	}
 
 	w := &walWrapper{
-		cfg:        cfg,
-		quit:       make(chan struct{}),
-		wal:        tsdbWAL,
-		metrics:    metrics,
-		seriesIter: seriesIter,
+		cfg:                cfg,
+		quit:               make(chan struct{}),
+		wal:                tsdbWAL,
+		metrics:            metrics,
+		seriesIter:         seriesIter,
+		checkpointRequests: make(chan chan error),
 	}
 
 	return w, nil
@@ -145,6 +157,26 @@ func (w *walWrapper) Stop() error {
 	return err
 }
 
+// Checkpoint asks the checkpointer to write a checkpoint without pacing the writes, which also
+// serialises it with the periodic checkpoints. It waits for the WAL to be started.
+func (w *walWrapper) Checkpoint(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case w.checkpointRequests <- done:
+	case <-w.quit:
+		return errWALStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (w *walWrapper) checkpointWriter() *WALCheckpointWriter {
 	return &WALCheckpointWriter{
 		metrics:    w.metrics,
@@ -161,6 +193,7 @@ func (w *walWrapper) run() {
 		w.seriesIter,
 		w.checkpointWriter(),
 		w.metrics,
+		w.checkpointRequests,
 		w.quit,
 	)
 	checkpointer.Run()
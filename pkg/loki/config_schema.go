@@ -0,0 +1,218 @@
+package loki
+
+import (
+	"encoding/json"
+	"flag"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+var (
+	yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+	modelDurationType   = reflect.TypeOf(model.Duration(0))
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// GenerateJSONSchema returns a JSON Schema document describing the Loki YAML configuration.
+// Descriptions and default values are taken from the flags registered by RegisterFlags.
+func (c *Config) GenerateJSONSchema() ([]byte, error) {
+	defaults := &Config{}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	defaults.RegisterFlags(fs)
+
+	g := &schemaGenerator{
+		flags:    map[uintptr][]*flag.Flag{},
+		visiting: map[reflect.Type]bool{},
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		v := reflect.ValueOf(f.Value)
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return
+		}
+		g.flags[v.Pointer()] = append(g.flags[v.Pointer()], f)
+	})
+
+	schema := g.schemaFor(reflect.ValueOf(defaults).Elem())
+	schema["$schema"] = jsonSchemaDraft
+	schema["title"] = "Loki configuration"
+
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+type schemaGenerator struct {
+	// flags keyed by the address of the config field they write to.
+	flags map[uintptr][]*flag.Flag
+	// struct types currently being walked, used to stop on recursive types.
+	visiting map[reflect.Type]bool
+}
+
+// schemaFor returns the schema of the given value. Flags are only matched for
+// addressable values reachable from the root config.
+func (g *schemaGenerator) schemaFor(v reflect.Value) map[string]interface{} {
+	schema := map[string]interface{}{}
+	t := v.Type()
+
+	if f := g.flagFor(v); f != nil {
+		if f.Usage != "" {
+			schema["description"] = f.Usage
+		}
+		if def, ok := defaultValue(t, f.DefValue); ok {
+			schema["default"] = def
+		}
+	}
+
+	// Types with custom YAML unmarshalling can accept any shape, so we can't constrain them.
+	if t.Implements(yamlUnmarshalerType) || reflect.PtrTo(t).Implements(yamlUnmarshalerType) {
+		return schema
+	}
+
+	switch t {
+	case durationType, modelDurationType:
+		schema["type"] = []string{"string", "integer"}
+		return schema
+	case timeType:
+		schema["type"] = "string"
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema["type"] = "integer"
+	case reflect.Float32, reflect.Float64:
+		schema["type"] = "number"
+	case reflect.String:
+		schema["type"] = "string"
+	case reflect.Slice, reflect.Array:
+		schema["type"] = "array"
+		schema["items"] = g.schemaFor(reflect.New(t.Elem()).Elem())
+	case reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = g.schemaFor(reflect.New(t.Elem()).Elem())
+	case reflect.Ptr:
+		elem := reflect.New(t.Elem()).Elem()
+		if !v.IsNil() {
+			elem = v.Elem()
+		}
+		for k, val := range g.schemaFor(elem) {
+			if _, ok := schema[k]; !ok {
+				schema[k] = val
+			}
+		}
+	case reflect.Struct:
+		if g.visiting[t] {
+			return schema
+		}
+		g.visiting[t] = true
+		defer delete(g.visiting, t)
+
+		properties := map[string]interface{}{}
+		g.structProperties(v, properties)
+		schema["type"] = "object"
+		schema["properties"] = properties
+		// Loki unmarshals its config strictly, so unknown keys are rejected.
+		schema["additionalProperties"] = false
+	}
+
+	return schema
+}
+
+// structProperties adds the schema of each YAML visible field of v to properties,
+// flattening inlined structs.
+func (g *schemaGenerator) structProperties(v reflect.Value, properties map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		name, opts := parseYAMLTag(field)
+		if name == "-" {
+			continue
+		}
+		if opts["inline"] {
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				g.structProperties(fv, properties)
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		properties[name] = g.schemaFor(v.Field(i))
+	}
+}
+
+// flagFor returns the flag writing to v. A struct and its first field share the same
+// address, so the flag value type must also match the type of v. Standard library
+// flag values are distinct types converting to the field type (e.g. flag.intValue).
+func (g *schemaGenerator) flagFor(v reflect.Value) *flag.Flag {
+	if !v.CanAddr() {
+		return nil
+	}
+	for _, f := range g.flags[v.Addr().Pointer()] {
+		if reflect.TypeOf(f.Value).Elem().ConvertibleTo(v.Type()) {
+			return f
+		}
+	}
+	return nil
+}
+
+// parseYAMLTag returns the key and options yaml.v2 uses for the field.
+func parseYAMLTag(field reflect.StructField) (string, map[string]bool) {
+	parts := strings.Split(field.Tag.Get("yaml"), ",")
+	opts := map[string]bool{}
+	for _, o := range parts[1:] {
+		opts[o] = true
+	}
+	name := parts[0]
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, opts
+}
+
+// defaultValue converts a flag default into a JSON value matching the field type.
+func defaultValue(t reflect.Type, def string) (interface{}, bool) {
+	switch t {
+	case durationType, modelDurationType:
+		return def, true
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(def)
+		return b, err == nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(def, 10, 64)
+		return i, err == nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(def, 10, 64)
+		return u, err == nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(def, 64)
+		return f, err == nil
+	case reflect.String:
+		return def, true
+	}
+	return nil, false
+}
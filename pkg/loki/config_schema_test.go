@@ -0,0 +1,75 @@
+package loki
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+const schemaTestConfig = `target: querier
+auth_enabled: false
+server:
+  http_listen_port: 3100
+  grpc_listen_port: 9095
+common:
+  path_prefix: /tmp/loki
+  replication_factor: 1
+  ring:
+    kvstore:
+      store: inmemory
+ingester:
+  chunk_idle_period: 1h
+  concurrent_flushes: 16
+  wal:
+    enabled: true
+schema_config:
+  configs:
+    - from: 2020-10-24
+      store: boltdb-shipper
+      object_store: filesystem
+      schema: v11
+      index:
+        prefix: index_
+        period: 24h
+limits_config:
+  ingestion_rate_mb: 10
+`
+
+func TestGenerateJSONSchema(t *testing.T) {
+	c := Config{}
+	raw, err := c.GenerateJSONSchema()
+	require.NoError(t, err)
+
+	var schema spec.Schema
+	require.NoError(t, json.Unmarshal(raw, &schema))
+
+	ingester := schema.Properties["ingester"].Properties["concurrent_flushes"]
+	require.Equal(t, spec.StringOrArray{"integer"}, ingester.Type)
+	require.EqualValues(t, 32, ingester.Default)
+
+	validateYAML := func(cfg string) *validate.Result {
+		doc, err := yaml.YAMLToJSON([]byte(cfg))
+		require.NoError(t, err)
+		var obj interface{}
+		require.NoError(t, json.Unmarshal(doc, &obj))
+		return validate.NewSchemaValidator(&schema, nil, "", strfmt.Default).Validate(obj)
+	}
+
+	t.Run("known good config", func(t *testing.T) {
+		res := validateYAML(schemaTestConfig)
+		require.True(t, res.IsValid(), "%v", res.Errors)
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		require.False(t, validateYAML("ingester:\n  not_a_field: 1\n").IsValid())
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		require.False(t, validateYAML("ingester:\n  concurrent_flushes: lots\n").IsValid())
+	})
+}
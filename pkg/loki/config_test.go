@@ -1,7 +1,9 @@
 package loki
 
 import (
+	"errors"
 	"flag"
+	"strings"
 	"testing"
 	"time"
 
@@ -75,3 +77,65 @@ func TestCrossComponentValidation(t *testing.T) {
 		}
 	}
 }
+
+func TestCrossComponentValidationReportsAllIncompatiblePeriodConfigs(t *testing.T) {
+	newConfig := func(reportAll bool) *Config {
+		cfg := &Config{}
+		cfg.RegisterFlags(flag.NewFlagSet("test", 0))
+		cfg.ReportAllIncompatiblePeriodConfigs = reportAll
+		cfg.SchemaConfig.Configs = []config.PeriodConfig{
+			{RowShards: 17, Schema: "v11", From: config.DayTime{Time: model.Now().Add(-96 * time.Hour)}},
+			{RowShards: 16, Schema: "v11", From: config.DayTime{Time: model.Now().Add(-48 * time.Hour)}},
+			{RowShards: 18, Schema: "v11", From: config.DayTime{Time: model.Now()}},
+		}
+		return cfg
+	}
+
+	// Only the first incompatible period config is reported by default.
+	err := newConfig(false).Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "period config at index (0)")
+	require.NotContains(t, err.Error(), "period config at index (2)")
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	require.Equal(t, "schema_config", validationErr.Field)
+
+	err = newConfig(true).Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "period config at index (0)")
+	require.NotContains(t, err.Error(), "period config at index (1)")
+	require.Contains(t, err.Error(), "period config at index (2)")
+	require.True(t, errors.As(err, &validationErr))
+	require.Equal(t, "schema_config", validationErr.Field)
+}
+
+func TestConfigFlagString(t *testing.T) {
+	cfg := newDefaultConfig()
+	require.Empty(t, cfg.FlagString())
+
+	cfg.AuthEnabled = false
+	cfg.Ingester.ConcurrentFlushes = 4
+	cfg.Ingester.WAL.Dir = "/loki/wal"
+	cfg.Ingester.FlushCheckPeriod = 90 * time.Second
+
+	require.Equal(t, `-auth.enabled=false
+-ingester.concurrent-flushes=4
+-ingester.flush-check-period=1m30s
+-ingester.wal-dir=/loki/wal
+`, cfg.FlagString())
+}
+
+func TestValidationErrorFieldPath(t *testing.T) {
+	cfg := &Config{}
+	cfg.RegisterFlags(flag.NewFlagSet("test", 0))
+	cfg.Ingester.ConcurrentFlushes = 0
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "invalid ingester config: "))
+
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	require.Equal(t, "ingester", validationErr.Field)
+	require.Contains(t, validationErr.Err.Error(), "concurrent flushes")
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/flagext"
 	"github.com/pkg/errors"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/grafana/loki/pkg/storage/config"
 	"github.com/grafana/loki/pkg/util"
 	"github.com/grafana/loki/pkg/util/cfg"
+	util_log "github.com/grafana/loki/pkg/util/log"
 
 	"github.com/grafana/loki/pkg/ruler/rulestore/local"
 	loki_net "github.com/grafana/loki/pkg/util/net"
@@ -29,21 +31,25 @@ type ConfigWrapper struct {
 	PrintVersion    bool
 	VerifyConfig    bool
 	PrintConfig     bool
+	PrintSchema     bool
 	ListTargets     bool
 	LogConfig       bool
 	ConfigFile      string
 	ConfigExpandEnv bool
+	ConfigStrictEnv bool
 }
 
 func (c *ConfigWrapper) RegisterFlags(f *flag.FlagSet) {
 	f.BoolVar(&c.PrintVersion, "version", false, "Print this builds version information")
 	f.BoolVar(&c.VerifyConfig, "verify-config", false, "Verify config file and exits")
 	f.BoolVar(&c.PrintConfig, "print-config-stderr", false, "Dump the entire Loki config object to stderr")
+	f.BoolVar(&c.PrintSchema, "print-config-schema", false, "Print the JSON Schema of the config file to stdout and exits")
 	f.BoolVar(&c.ListTargets, "list-targets", false, "List available targets")
 	f.BoolVar(&c.LogConfig, "log-config-reverse-order", false, "Dump the entire Loki config object at Info log "+
 		"level with the order reversed, reversing the order makes viewing the entries easier in Grafana.")
 	f.StringVar(&c.ConfigFile, "config.file", "", "yaml file to load")
 	f.BoolVar(&c.ConfigExpandEnv, "config.expand-env", false, "Expands ${var} in config according to the values of the environment variables.")
+	f.BoolVar(&c.ConfigStrictEnv, "config.expand-env-strict", false, "Fail to load the config when it references undefined environment variables without a default value, instead of expanding them to empty strings. Requires -config.expand-env.")
 	c.Config.RegisterFlags(f)
 }
 
@@ -93,6 +99,10 @@ func (c *ConfigWrapper) ApplyDynamicConfig() cfg.Source {
 			return err
 		}
 
+		for _, conflict := range commonStorageConflicts(r, &defaults) {
+			level.Warn(util_log.Logger).Log("msg", "explicit storage config overrides the common storage config", "conflict", conflict)
+		}
+
 		if err := applyStorageConfig(r, &defaults); err != nil {
 			return err
 		}
@@ -440,6 +450,45 @@ func applyStorageConfig(cfg, defaults *ConfigWrapper) error {
 	return nil
 }
 
+// commonStorageConflicts lists the explicit storage config sections which set values different from
+// the common storage config, silently taking precedence over it, e.g. a bucket name set both in
+// common.storage.gcs and in storage_config.gcs.
+func commonStorageConflicts(r, defaults *ConfigWrapper) []string {
+	type section struct {
+		name                string
+		value, defaultValue interface{}
+	}
+	var conflicts []string
+	check := func(commonName string, common, commonDefault interface{}, sections ...section) {
+		if reflect.DeepEqual(common, commonDefault) {
+			return
+		}
+		for _, s := range sections {
+			if !reflect.DeepEqual(s.value, s.defaultValue) && !reflect.DeepEqual(s.value, common) {
+				conflicts = append(conflicts, fmt.Sprintf("%s overrides common.storage.%s", s.name, commonName))
+			}
+		}
+	}
+
+	check("s3", r.Common.Storage.S3, defaults.Common.Storage.S3,
+		section{"storage_config.aws", r.StorageConfig.AWSStorageConfig.S3Config, defaults.StorageConfig.AWSStorageConfig.S3Config},
+		section{"ruler.storage.s3", r.Ruler.StoreConfig.S3, defaults.Ruler.StoreConfig.S3})
+	check("gcs", r.Common.Storage.GCS, defaults.Common.Storage.GCS,
+		section{"storage_config.gcs", r.StorageConfig.GCSConfig, defaults.StorageConfig.GCSConfig},
+		section{"ruler.storage.gcs", r.Ruler.StoreConfig.GCS, defaults.Ruler.StoreConfig.GCS})
+	check("azure", r.Common.Storage.Azure, defaults.Common.Storage.Azure,
+		section{"storage_config.azure", r.StorageConfig.AzureStorageConfig, defaults.StorageConfig.AzureStorageConfig},
+		section{"ruler.storage.azure", r.Ruler.StoreConfig.Azure, defaults.Ruler.StoreConfig.Azure})
+	check("swift", r.Common.Storage.Swift, defaults.Common.Storage.Swift,
+		section{"storage_config.swift", r.StorageConfig.Swift, defaults.StorageConfig.Swift},
+		section{"ruler.storage.swift", r.Ruler.StoreConfig.Swift, defaults.Ruler.StoreConfig.Swift})
+	check("filesystem.chunks_directory", r.Common.Storage.FSConfig.ChunksDirectory, defaults.Common.Storage.FSConfig.ChunksDirectory,
+		section{"storage_config.filesystem.directory", r.StorageConfig.FSConfig.Directory, defaults.StorageConfig.FSConfig.Directory})
+	check("filesystem.rules_directory", r.Common.Storage.FSConfig.RulesDirectory, defaults.Common.Storage.FSConfig.RulesDirectory,
+		section{"ruler.storage.local.directory", r.Ruler.StoreConfig.Local.Directory, defaults.Ruler.StoreConfig.Local.Directory})
+	return conflicts
+}
+
 func betterBoltdbShipperDefaults(cfg, defaults *ConfigWrapper) {
 	currentSchemaIdx := config.ActivePeriodConfig(cfg.SchemaConfig.Configs)
 	currentSchema := cfg.SchemaConfig.Configs[currentSchemaIdx]
@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/netutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -572,6 +573,33 @@ storage_config:
 			assert.EqualValues(t, 5*time.Minute, config.StorageConfig.GCSConfig.RequestTimeout)
 		})
 
+		t.Run("explicit storage config overriding the common one is reported", func(t *testing.T) {
+			conflictingConfig := `common:
+  storage:
+    gcs:
+      bucket_name: foobar
+storage_config:
+  gcs:
+    bucket_name: chunks
+ruler:
+  storage:
+    gcs:
+      bucket_name: foobar`
+
+			// The defaults returned by testContext include the config file.
+			defaults := ConfigWrapper{}
+			flagext.DefaultValues(&defaults)
+
+			config, _ := testContext(conflictingConfig, nil)
+			assert.Equal(t, []string{"storage_config.gcs overrides common.storage.gcs"}, commonStorageConflicts(&config, &defaults))
+
+			config, _ = testContext(`common:
+  storage:
+    gcs:
+      bucket_name: foobar`, nil)
+			assert.Empty(t, commonStorageConflicts(&config, &defaults))
+		})
+
 		t.Run("when common object store config is provided, compactor shared store is defaulted to use it", func(t *testing.T) {
 			for _, tt := range []struct {
 				configString string
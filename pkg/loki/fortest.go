@@ -0,0 +1,115 @@
+package loki
+
+import (
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/util/cfg"
+)
+
+// TestOption tweaks the config of a Loki created by NewForTest.
+type TestOption func(*Config)
+
+// WithTestTargets sets the modules run by a Loki created by NewForTest, all of them by default.
+func WithTestTargets(targets ...string) TestOption {
+	return func(c *Config) {
+		c.Target = targets
+	}
+}
+
+// WithTestDirectory sets the directory holding the WAL and the other local files of a Loki created
+// by NewForTest, e.g. to t.TempDir() so that it is removed after the test. Defaults to a new
+// temporary directory left to the caller to remove.
+func WithTestDirectory(dir string) TestOption {
+	return func(c *Config) {
+		c.Common.PathPrefix = dir
+	}
+}
+
+// WithTestConfig applies any change to the config of a Loki created by NewForTest.
+func WithTestConfig(f func(*Config)) TestOption {
+	return TestOption(f)
+}
+
+// NewForTest returns a Loki for integration tests, not meant for production: its rings and stores
+// are in memory, its WAL and other local files are written to a temporary directory and its
+// servers listen on free local ports. It is run like any Loki, stop it with RunOpts.Stop.
+// Like New, it registers metrics with prometheus.DefaultRegisterer, which tests creating several
+// Lokis must replace in between.
+func NewForTest(opts ...TestOption) (*Loki, error) {
+	var c ConfigWrapper
+	fs := flag.NewFlagSet("loki-test", flag.ContinueOnError)
+	err := cfg.Unmarshal(&c, cfg.Defaults(fs), func(dst cfg.Cloneable) error {
+		return applyTestDefaults(&dst.(*ConfigWrapper).Config, opts)
+	}, c.ApplyDynamicConfig())
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return New(c.Config)
+}
+
+func applyTestDefaults(c *Config, opts []TestOption) error {
+	c.Target = []string{All}
+	c.AuthEnabled = false
+	c.UsageReport.Enabled = false
+
+	c.Common.ReplicationFactor = 1
+	c.Common.Ring.KVStore.Store = "inmemory"
+	c.Common.InstanceAddr = "127.0.0.1"
+	// A single ingester needn't wait for ring updates to propagate.
+	c.Ingester.LifecyclerConfig.MinReadyDuration = 0
+	c.Ingester.LifecyclerConfig.FinalSleep = 0
+	// Discover the query scheduler quickly, the frontend isn't ready before.
+	c.Frontend.FrontendV2.DNSLookupPeriod = 100 * time.Millisecond
+	c.Worker.DNSLookupPeriod = 100 * time.Millisecond
+	c.SchemaConfig.Configs = []config.PeriodConfig{{
+		From:       config.DayTime{Time: model.Time(0)},
+		IndexType:  config.StorageTypeInMemory,
+		ObjectType: config.StorageTypeInMemory,
+		Schema:     "v11",
+		RowShards:  16,
+	}}
+
+	ports, err := freeLocalPorts(2)
+	if err != nil {
+		return err
+	}
+	c.Server.HTTPListenAddress, c.Server.HTTPListenPort = "127.0.0.1", ports[0]
+	c.Server.GRPCListenAddress, c.Server.GRPCListenPort = "127.0.0.1", ports[1]
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.Common.PathPrefix == "" {
+		if c.Common.PathPrefix, err = os.MkdirTemp("", "loki-test"); err != nil {
+			return err
+		}
+	}
+	c.Common.Storage.FSConfig.ChunksDirectory = filepath.Join(c.Common.PathPrefix, "chunks")
+	c.Common.Storage.FSConfig.RulesDirectory = filepath.Join(c.Common.PathPrefix, "rules")
+	return nil
+}
+
+// freeLocalPorts returns n ports which were free on the loopback interface.
+func freeLocalPorts(n int) ([]int, error) {
+	ports := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
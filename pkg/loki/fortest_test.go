@@ -0,0 +1,44 @@
+package loki
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewForTest(t *testing.T) {
+	// Don't clash with the metrics of the other Lokis created by the tests.
+	defaultRegisterer := prometheus.DefaultRegisterer
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+	defer func() { prometheus.DefaultRegisterer = defaultRegisterer }()
+
+	loki, err := NewForTest(WithTestDirectory(t.TempDir()))
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- loki.Run(RunOpts{Stop: stop})
+	}()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/ready", loki.Cfg.Server.HTTPListenPort))
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 30*time.Second, 100*time.Millisecond)
+
+	close(stop)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("Loki didn't stop")
+	}
+}
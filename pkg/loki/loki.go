@@ -8,6 +8,9 @@ import (
 	"net/http"
 	"os"
 	rt "runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/felixge/fgprof"
@@ -16,6 +19,7 @@ import (
 	"github.com/grafana/dskit/grpcutil"
 	"github.com/grafana/dskit/kv/memberlist"
 	"github.com/grafana/dskit/modules"
+	"github.com/grafana/dskit/multierror"
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/runtimeconfig"
 	"github.com/grafana/dskit/services"
@@ -24,6 +28,7 @@ import (
 	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/common/signals"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 
 	"github.com/grafana/loki/pkg/distributor"
 	"github.com/grafana/loki/pkg/ingester"
@@ -52,12 +57,27 @@ import (
 	"github.com/grafana/loki/pkg/validation"
 )
 
+// DefaultTargetEnvVar is the environment variable used to override the default target,
+// so that container images can ship different defaults without CLI args.
+const DefaultTargetEnvVar = "LOKI_DEFAULT_TARGET"
+
 // Config is the root config for Loki.
 type Config struct {
-	Target       flagext.StringSliceCSV `yaml:"target,omitempty"`
-	AuthEnabled  bool                   `yaml:"auth_enabled,omitempty"`
-	HTTPPrefix   string                 `yaml:"http_prefix"`
-	BallastBytes int                    `yaml:"ballast_bytes"`
+	Target            flagext.StringSliceCSV `yaml:"target,omitempty"`
+	AuthEnabled       bool                   `yaml:"auth_enabled,omitempty"`
+	AuthExemptMethods flagext.StringSliceCSV `yaml:"auth_exempt_methods,omitempty"`
+	HTTPPrefix        string                 `yaml:"http_prefix"`
+	BallastBytes      int                    `yaml:"ballast_bytes"`
+
+	ModuleStartPriority map[string]int `yaml:"module_start_priority,omitempty"`
+	ModuleInitTimeout   time.Duration  `yaml:"module_init_timeout"`
+	MinReadyDuration    time.Duration  `yaml:"min_ready_duration"`
+
+	GRPCReflectionEnabled bool `yaml:"grpc_reflection_enabled"`
+
+	MemberlistOptional bool `yaml:"memberlist_optional"`
+
+	ReportAllIncompatiblePeriodConfigs bool `yaml:"report_all_incompatible_period_configs"`
 
 	Common           common.Config            `yaml:"common,omitempty"`
 	Server           server.Config            `yaml:"server,omitempty"`
@@ -87,15 +107,26 @@ func (c *Config) RegisterFlags(f *flag.FlagSet) {
 	c.Server.MetricsNamespace = "loki"
 	c.Server.ExcludeRequestInLog = true
 
-	// Set the default module list to 'all'
-	c.Target = []string{All}
+	// Set the default module list to 'all', unless overridden through the environment.
+	c.Target = defaultTarget()
 	f.Var(&c.Target, "target", "Comma-separated list of Loki modules to load. "+
 		"The alias 'all' can be used in the list to load a number of core modules and will enable single-binary mode. "+
 		"The aliases 'read' and 'write' can be used to only run components related to the read path or write path, respectively.")
 	f.BoolVar(&c.AuthEnabled, "auth.enabled", true, "Set to false to disable auth.")
+	f.Var(&c.AuthExemptMethods, "auth.exempt-methods", "Comma-separated list of gRPC methods which don't require a tenant ID when auth is enabled. "+
+		"When set, it replaces the default list and must include "+healthCheckMethod+".")
 	f.IntVar(&c.BallastBytes, "config.ballast-bytes", 0, "The amount of virtual memory to reserve as a ballast in order to optimise "+
 		"garbage collection. Larger ballasts result in fewer garbage collection passes, reducing compute overhead at the cost of memory usage.")
 
+	f.DurationVar(&c.ModuleInitTimeout, "module-init-timeout", 0, "How long the initialisation of each module may take before Loki fails to start, naming the module, instead of hanging e.g. on a store connection. 0 to disable.")
+	f.DurationVar(&c.MinReadyDuration, "min-ready-duration", 0, "Minimum time since Loki started before /ready reports it as ready, even if all its services are running, e.g. to let the caches warm up before receiving traffic. 0 to disable.")
+
+	f.BoolVar(&c.GRPCReflectionEnabled, "grpc-reflection-enabled", false, "Register the gRPC server reflection service, so that tools like grpcurl can list and call the gRPC services for debugging. It exposes the whole gRPC API, so it is disabled by default.")
+
+	f.BoolVar(&c.MemberlistOptional, "memberlist-optional", false, "Fall back to a local-only KV store for the rings configured to use memberlist when memberlist fails to start, instead of failing. Only suitable for single-binary deployments, as the rings aren't shared with other instances anymore.")
+
+	f.BoolVar(&c.ReportAllIncompatiblePeriodConfigs, "config.report-all-incompatible-period-configs", false, "Report all the period configs whose row shard factor doesn't evenly divide the ingester index shards at once, instead of only the first one, to fix them in one pass.")
+
 	c.registerServerFlagsWithChangedDefaultValues(f)
 	c.Common.RegisterFlags(f)
 	c.Distributor.RegisterFlags(f)
@@ -119,6 +150,25 @@ func (c *Config) RegisterFlags(f *flag.FlagSet) {
 	c.UsageReport.RegisterFlags(f)
 }
 
+// defaultTarget returns the target set in DefaultTargetEnvVar, falling back to 'all'
+// when it is unset or references an unknown module.
+func defaultTarget() flagext.StringSliceCSV {
+	v := os.Getenv(DefaultTargetEnvVar)
+	if v == "" {
+		return []string{All}
+	}
+
+	var target flagext.StringSliceCSV
+	_ = target.Set(v)
+	for _, m := range target {
+		if !util.StringsContain(knownModules, m) {
+			level.Warn(util_log.Logger).Log("msg", "ignoring invalid default target", "env", DefaultTargetEnvVar, "target", v, "module", m)
+			return []string{All}
+		}
+	}
+	return target
+}
+
 func (c *Config) registerServerFlagsWithChangedDefaultValues(fs *flag.FlagSet) {
 	throwaway := flag.NewFlagSet("throwaway", flag.PanicOnError)
 
@@ -148,62 +198,98 @@ func (c *Config) Clone() flagext.Registerer {
 	}(*c)
 }
 
+// ValidationError is returned by Config.Validate, locating the invalid config for tooling.
+type ValidationError struct {
+	// YAML path of the invalid config, e.g. ruler or storage_config.boltdb_shipper.
+	Field string
+	// Human readable name of the invalid config, e.g. ruler config.
+	Desc string
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Desc, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
 // Validate the config and returns an error if the validation
 // doesn't pass
 func (c *Config) Validate() error {
-	if err := c.SchemaConfig.Validate(); err != nil {
-		return errors.Wrap(err, "invalid schema config")
+	if len(c.AuthExemptMethods) > 0 && !util.StringsContain(c.AuthExemptMethods, healthCheckMethod) {
+		return &ValidationError{Field: "auth_exempt_methods", Desc: "auth exempt methods", Err: fmt.Errorf("%s must stay exempt from auth", healthCheckMethod)}
+	}
+	for m := range c.ModuleStartPriority {
+		if !util.StringsContain(knownModules, m) {
+			return &ValidationError{Field: "module_start_priority", Desc: "module start priority", Err: fmt.Errorf("unknown module %s", m)}
+		}
+	}
+	// An empty schema config is only rejected when a module needs it, see validateSchemaConfigured.
+	if len(c.SchemaConfig.Configs) > 0 {
+		if err := c.SchemaConfig.Validate(); err != nil {
+			return &ValidationError{Field: "schema_config", Desc: "schema config", Err: err}
+		}
 	}
 	if err := c.StorageConfig.Validate(); err != nil {
-		return errors.Wrap(err, "invalid storage config")
+		return &ValidationError{Field: "storage_config", Desc: "storage config", Err: err}
 	}
 	if err := c.QueryRange.Validate(); err != nil {
-		return errors.Wrap(err, "invalid queryrange config")
+		return &ValidationError{Field: "query_range", Desc: "queryrange config", Err: err}
 	}
 	if err := c.Querier.Validate(); err != nil {
-		return errors.Wrap(err, "invalid querier config")
+		return &ValidationError{Field: "querier", Desc: "querier config", Err: err}
 	}
 	if err := c.TableManager.Validate(); err != nil {
-		return errors.Wrap(err, "invalid tablemanager config")
+		return &ValidationError{Field: "table_manager", Desc: "tablemanager config", Err: err}
 	}
 	if err := c.Ruler.Validate(); err != nil {
-		return errors.Wrap(err, "invalid ruler config")
+		return &ValidationError{Field: "ruler", Desc: "ruler config", Err: err}
 	}
 	if err := c.Ingester.Validate(); err != nil {
-		return errors.Wrap(err, "invalid ingester config")
+		return &ValidationError{Field: "ingester", Desc: "ingester config", Err: err}
 	}
 	if err := c.LimitsConfig.Validate(); err != nil {
-		return errors.Wrap(err, "invalid limits config")
+		return &ValidationError{Field: "limits_config", Desc: "limits config", Err: err}
 	}
 	if err := c.Worker.Validate(util_log.Logger); err != nil {
-		return errors.Wrap(err, "invalid frontend-worker config")
+		return &ValidationError{Field: "frontend_worker", Desc: "frontend-worker config", Err: err}
 	}
 	if err := c.StorageConfig.BoltDBShipperConfig.Validate(); err != nil {
-		return errors.Wrap(err, "invalid boltdb-shipper config")
+		return &ValidationError{Field: "storage_config.boltdb_shipper", Desc: "boltdb-shipper config", Err: err}
 	}
 	if err := c.CompactorConfig.Validate(); err != nil {
-		return errors.Wrap(err, "invalid compactor config")
+		return &ValidationError{Field: "compactor", Desc: "compactor config", Err: err}
 	}
 	if err := c.ChunkStoreConfig.Validate(util_log.Logger); err != nil {
-		return errors.Wrap(err, "invalid chunk store config")
+		return &ValidationError{Field: "chunk_store_config", Desc: "chunk store config", Err: err}
 	}
 	// TODO(cyriltovena): remove when MaxLookBackPeriod in the storage will be fully deprecated.
 	if c.ChunkStoreConfig.MaxLookBackPeriod > 0 {
 		c.LimitsConfig.MaxQueryLookback = c.ChunkStoreConfig.MaxLookBackPeriod
 	}
 
+	var shardErrs multierror.MultiError
 	for i, sc := range c.SchemaConfig.Configs {
 		if sc.RowShards > 0 && c.Ingester.IndexShards%int(sc.RowShards) > 0 {
-			return fmt.Errorf(
+			err := fmt.Errorf(
 				"incompatible ingester index shards (%d) and period config row shard factor (%d) for period config at index (%d). The ingester factor must be evenly divisible by all period config factors",
 				c.Ingester.IndexShards,
 				sc.RowShards,
 				i,
 			)
+			if !c.ReportAllIncompatiblePeriodConfigs {
+				return &ValidationError{Field: "schema_config", Desc: "schema config", Err: err}
+			}
+			shardErrs.Add(err)
 		}
 	}
+	if err := shardErrs.Err(); err != nil {
+		return &ValidationError{Field: "schema_config", Desc: "schema config", Err: err}
+	}
 	if err := c.QueryRange.Validate(); err != nil {
-		return errors.Wrap(err, "invalid query_range config")
+		return &ValidationError{Field: "query_range", Desc: "query_range config", Err: err}
 	}
 	return nil
 }
@@ -225,6 +311,7 @@ type Loki struct {
 	ModuleManager *modules.Manager
 	serviceMap    map[string]services.Service
 	deps          map[string][]string
+	extraModules  []ModuleRegistration
 
 	Server                   *server.Server
 	ring                     *ring.Ring
@@ -253,13 +340,30 @@ type Loki struct {
 	clientMetrics storage.ClientMetrics
 
 	HTTPAuthMiddleware middleware.Interface
+
+	// When Loki was created, see MinReadyDuration.
+	startTime time.Time
+}
+
+// ModuleRegistration describes a module registered in addition to the built-in ones, e.g. by a
+// downstream distribution of Loki.
+type ModuleRegistration struct {
+	Name string
+	// Init creates the service of the module. Modules only grouping other modules have none.
+	Init func(t *Loki) (services.Service, error)
+	// Deps are the modules, built-in or extra ones, initialized before this one.
+	Deps []string
+	// UserInvisible modules can't be used as a target.
+	UserInvisible bool
 }
 
-// New makes a new Loki.
-func New(cfg Config) (*Loki, error) {
+// New makes a new Loki. The extra modules are registered alongside the built-in ones.
+func New(cfg Config, extraModules ...ModuleRegistration) (*Loki, error) {
 	loki := &Loki{
 		Cfg:           cfg,
 		clientMetrics: storage.NewClientMetrics(),
+		extraModules:  extraModules,
+		startTime:     time.Now(),
 	}
 	usagestats.Edition("oss")
 	loki.setupAuthMiddleware()
@@ -267,24 +371,52 @@ func New(cfg Config) (*Loki, error) {
 	if err := loki.setupModuleManager(); err != nil {
 		return nil, err
 	}
+	if err := loki.validateSchemaConfigured(); err != nil {
+		return nil, err
+	}
 
 	return loki, nil
 }
 
+// schemaModules are the modules which can't run without a schema config.
+var schemaModules = []string{Store, Compactor, TableManager, IndexGateway}
+
+// validateSchemaConfigured returns a clear error when no schema is configured but an
+// active module needs one, rather than letting the module fail later on.
+func (t *Loki) validateSchemaConfigured() error {
+	if len(t.Cfg.SchemaConfig.Configs) > 0 {
+		return nil
+	}
+	for _, m := range schemaModules {
+		if t.isModuleActive(m) {
+			return fmt.Errorf("no schema configured: the %s module requires at least one period config in schema_config", m)
+		}
+	}
+	return nil
+}
+
+const healthCheckMethod = "/grpc.health.v1.Health/Check"
+
+// defaultAuthExemptMethods are the gRPC methods on which auth isn't checked by default.
+// Don't check auth header on TransferChunks, as we weren't originally
+// sending it and this could cause transfers to fail on update.
+// Also don't check auth for the other gRPC methods, since single call is used for multiple users (or no user like health check).
+var defaultAuthExemptMethods = []string{
+	healthCheckMethod,
+	"/logproto.Ingester/TransferChunks",
+	"/frontend.Frontend/Process",
+	"/frontend.Frontend/NotifyClientShutdown",
+	"/schedulerpb.SchedulerForFrontend/FrontendLoop",
+	"/schedulerpb.SchedulerForQuerier/QuerierLoop",
+	"/schedulerpb.SchedulerForQuerier/NotifyQuerierShutdown",
+}
+
 func (t *Loki) setupAuthMiddleware() {
-	// Don't check auth header on TransferChunks, as we weren't originally
-	// sending it and this could cause transfers to fail on update.
-	t.HTTPAuthMiddleware = fakeauth.SetupAuthMiddleware(&t.Cfg.Server, t.Cfg.AuthEnabled,
-		// Also don't check auth for these gRPC methods, since single call is used for multiple users (or no user like health check).
-		[]string{
-			"/grpc.health.v1.Health/Check",
-			"/logproto.Ingester/TransferChunks",
-			"/frontend.Frontend/Process",
-			"/frontend.Frontend/NotifyClientShutdown",
-			"/schedulerpb.SchedulerForFrontend/FrontendLoop",
-			"/schedulerpb.SchedulerForQuerier/QuerierLoop",
-			"/schedulerpb.SchedulerForQuerier/NotifyQuerierShutdown",
-		})
+	exemptMethods := defaultAuthExemptMethods
+	if len(t.Cfg.AuthExemptMethods) > 0 {
+		exemptMethods = t.Cfg.AuthExemptMethods
+	}
+	t.HTTPAuthMiddleware = fakeauth.SetupAuthMiddleware(&t.Cfg.Server, t.Cfg.AuthEnabled, exemptMethods)
 }
 
 func (t *Loki) setupGRPCRecoveryMiddleware() {
@@ -299,11 +431,66 @@ func newDefaultConfig() *Config {
 	return defaultConfig
 }
 
+// FlagString returns the command-line flags equivalent to the non-default values of the config,
+// one "-flag=value" per line, e.g. to move from a YAML config to flags. Values of config fields
+// without a flag are left out. Secrets are printed in clear.
+func (c *Config) FlagString() string {
+	fs := flag.NewFlagSet("", flag.PanicOnError)
+	cfg := &Config{}
+	cfg.RegisterFlags(fs)
+
+	// The flags are bound to the fields of cfg, so that they read the values it is set to.
+	*cfg = *newDefaultConfig()
+	defaults := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		defaults[f.Name] = f.Value.String()
+	})
+
+	*cfg = *c
+	var sb strings.Builder
+	fs.VisitAll(func(f *flag.Flag) {
+		if v := f.Value.String(); v != defaults[f.Name] {
+			fmt.Fprintf(&sb, "-%s=%s\n", f.Name, v)
+		}
+	})
+	return sb.String()
+}
+
+const defaultConfigEndpointPath = "/config"
+
+// reservedEndpointPaths are the paths of the endpoints registered by Run, which the config endpoint can't be moved to.
+var reservedEndpointPaths = []string{"/ready", "/services", "/config/dependencies", "/metrics", "/loki/api/v1/status/buildinfo", "/debug/fgprof"}
+
 // RunOpts configures custom behavior for running Loki.
 type RunOpts struct {
 	// CustomConfigEndpointHandlerFn is the handlerFunc to be used by the /config endpoint.
 	// If empty, default handlerFunc will be used.
 	CustomConfigEndpointHandlerFn func(http.ResponseWriter, *http.Request)
+
+	// ConfigEndpointPath is the path the config endpoint is served on, e.g. to avoid
+	// colliding with other paths behind a reverse proxy. Defaults to /config.
+	ConfigEndpointPath string
+
+	// Stop, when closed, stops Loki like a termination signal, e.g. in tests.
+	Stop <-chan struct{}
+}
+
+func (opts RunOpts) configEndpointPath() string {
+	if opts.ConfigEndpointPath == "" {
+		return defaultConfigEndpointPath
+	}
+	return opts.ConfigEndpointPath
+}
+
+func (opts RunOpts) validate() error {
+	path := opts.configEndpointPath()
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid config endpoint path %q: must start with /", path)
+	}
+	if util.StringsContain(reservedEndpointPaths, path) {
+		return fmt.Errorf("invalid config endpoint path %q: already used by another endpoint", path)
+	}
+	return nil
 }
 
 func (t *Loki) bindConfigEndpoint(opts RunOpts) {
@@ -311,7 +498,7 @@ func (t *Loki) bindConfigEndpoint(opts RunOpts) {
 	if opts.CustomConfigEndpointHandlerFn != nil {
 		configEndpointHandlerFn = opts.CustomConfigEndpointHandlerFn
 	}
-	t.Server.HTTP.Path("/config").Methods("GET").HandlerFunc(configEndpointHandlerFn)
+	t.Server.HTTP.Path(opts.configEndpointPath()).Methods("GET").HandlerFunc(configEndpointHandlerFn)
 }
 
 // ListTargets prints a list of available user visible targets and their
@@ -334,6 +521,10 @@ func (t *Loki) ListTargets() {
 
 // Run starts Loki running, and blocks until a Loki stops.
 func (t *Loki) Run(opts RunOpts) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
 	serviceMap, err := t.ModuleManager.InitModuleServices(t.Cfg.Target...)
 	if err != nil {
 		return err
@@ -341,12 +532,18 @@ func (t *Loki) Run(opts RunOpts) error {
 
 	t.serviceMap = serviceMap
 	t.Server.HTTP.Path("/services").Methods("GET").Handler(http.HandlerFunc(t.servicesHandler))
+	t.Server.HTTP.Path("/config/dependencies").Methods("GET").Handler(http.HandlerFunc(t.dependenciesHandler))
 
 	// get all services, create service manager and tell it to start
 	var servs []services.Service
-	for _, s := range serviceMap {
+	active := make([]string, 0, len(serviceMap))
+	for m, s := range serviceMap {
+		setModuleState(moduleState, m, s.State())
+		s.AddListener(newModuleStateListener(moduleState, m))
 		servs = append(servs, s)
+		active = append(active, m)
 	}
+	setActiveModules(buildTargetInfo, active)
 
 	sm, err := services.NewManager(servs...)
 	if err != nil {
@@ -357,6 +554,7 @@ func (t *Loki) Run(opts RunOpts) error {
 	t.Server.HTTP.Path("/ready").Methods("GET").Handler(t.readyHandler(sm))
 
 	grpc_health_v1.RegisterHealthServer(t.Server.GRPC, grpcutil.NewHealthCheck(sm))
+	t.registerGRPCReflection()
 
 	// Config endpoint adds a way to see the config and the changes compared to the defaults.
 	t.bindConfigEndpoint(opts)
@@ -396,6 +594,12 @@ func (t *Loki) Run(opts RunOpts) error {
 		handler.Loop()
 		sm.StopAsync()
 	}()
+	if opts.Stop != nil {
+		go func() {
+			<-opts.Stop
+			handler.Stop()
+		}()
+	}
 
 	// Start all services. This can really only fail if some service is already
 	// in other state than New, which should not be the case.
@@ -456,6 +660,11 @@ func (t *Loki) readyHandler(sm *services.Manager) http.HandlerFunc {
 			}
 		}
 
+		if uptime := time.Since(t.startTime); uptime < t.Cfg.MinReadyDuration {
+			http.Error(w, fmt.Sprintf("Not ready: up for %v, less than the min ready duration %v", uptime.Truncate(time.Second), t.Cfg.MinReadyDuration), http.StatusServiceUnavailable)
+			return
+		}
+
 		http.Error(w, "ready", http.StatusOK)
 	}
 }
@@ -463,32 +672,36 @@ func (t *Loki) readyHandler(sm *services.Manager) http.HandlerFunc {
 func (t *Loki) setupModuleManager() error {
 	mm := modules.NewManager(util_log.Logger)
 
-	mm.RegisterModule(Server, t.initServer, modules.UserInvisibleModule)
-	mm.RegisterModule(RuntimeConfig, t.initRuntimeConfig, modules.UserInvisibleModule)
-	mm.RegisterModule(MemberlistKV, t.initMemberlistKV, modules.UserInvisibleModule)
-	mm.RegisterModule(Ring, t.initRing, modules.UserInvisibleModule)
-	mm.RegisterModule(Overrides, t.initOverrides, modules.UserInvisibleModule)
-	mm.RegisterModule(OverridesExporter, t.initOverridesExporter)
-	mm.RegisterModule(TenantConfigs, t.initTenantConfigs, modules.UserInvisibleModule)
-	mm.RegisterModule(Distributor, t.initDistributor)
-	mm.RegisterModule(Store, t.initStore, modules.UserInvisibleModule)
-	mm.RegisterModule(Ingester, t.initIngester)
-	mm.RegisterModule(Querier, t.initQuerier)
-	mm.RegisterModule(IngesterQuerier, t.initIngesterQuerier)
-	mm.RegisterModule(QueryFrontendTripperware, t.initQueryFrontendTripperware, modules.UserInvisibleModule)
-	mm.RegisterModule(QueryFrontend, t.initQueryFrontend)
-	mm.RegisterModule(RulerStorage, t.initRulerStorage, modules.UserInvisibleModule)
-	mm.RegisterModule(Ruler, t.initRuler)
-	mm.RegisterModule(TableManager, t.initTableManager)
-	mm.RegisterModule(Compactor, t.initCompactor)
-	mm.RegisterModule(IndexGateway, t.initIndexGateway)
-	mm.RegisterModule(QueryScheduler, t.initQueryScheduler)
-	mm.RegisterModule(UsageReport, t.initUsageReport)
+	mm.RegisterModule(Server, t.initWithTimeout(Server, t.initServer), modules.UserInvisibleModule)
+	mm.RegisterModule(RuntimeConfig, t.initWithTimeout(RuntimeConfig, t.initRuntimeConfig), modules.UserInvisibleModule)
+	mm.RegisterModule(MemberlistKV, t.initWithTimeout(MemberlistKV, t.initMemberlistKV), modules.UserInvisibleModule)
+	mm.RegisterModule(Ring, t.initWithTimeout(Ring, t.initRing), modules.UserInvisibleModule)
+	mm.RegisterModule(Overrides, t.initWithTimeout(Overrides, t.initOverrides), modules.UserInvisibleModule)
+	mm.RegisterModule(OverridesExporter, t.initWithTimeout(OverridesExporter, t.initOverridesExporter))
+	mm.RegisterModule(TenantConfigs, t.initWithTimeout(TenantConfigs, t.initTenantConfigs), modules.UserInvisibleModule)
+	mm.RegisterModule(Distributor, t.initWithTimeout(Distributor, t.initDistributor))
+	mm.RegisterModule(Store, t.initWithTimeout(Store, t.initStore), modules.UserInvisibleModule)
+	mm.RegisterModule(Ingester, t.initWithTimeout(Ingester, t.initIngester))
+	mm.RegisterModule(Querier, t.initWithTimeout(Querier, t.initQuerier))
+	mm.RegisterModule(IngesterQuerier, t.initWithTimeout(IngesterQuerier, t.initIngesterQuerier))
+	mm.RegisterModule(QueryFrontendTripperware, t.initWithTimeout(QueryFrontendTripperware, t.initQueryFrontendTripperware), modules.UserInvisibleModule)
+	mm.RegisterModule(QueryFrontend, t.initWithTimeout(QueryFrontend, t.initQueryFrontend))
+	mm.RegisterModule(RulerStorage, t.initWithTimeout(RulerStorage, t.initRulerStorage), modules.UserInvisibleModule)
+	mm.RegisterModule(Ruler, t.initWithTimeout(Ruler, t.initRuler))
+	mm.RegisterModule(TableManager, t.initWithTimeout(TableManager, t.initTableManager))
+	mm.RegisterModule(Compactor, t.initWithTimeout(Compactor, t.initCompactor))
+	mm.RegisterModule(IndexGateway, t.initWithTimeout(IndexGateway, t.initIndexGateway))
+	mm.RegisterModule(QueryScheduler, t.initWithTimeout(QueryScheduler, t.initQueryScheduler))
+	mm.RegisterModule(UsageReport, t.initWithTimeout(UsageReport, t.initUsageReport))
 
 	mm.RegisterModule(All, nil)
 	mm.RegisterModule(Read, nil)
 	mm.RegisterModule(Write, nil)
 
+	if err := t.registerExtraModules(mm); err != nil {
+		return err
+	}
+
 	// Add dependencies
 	deps := map[string][]string{
 		Ring:                     {RuntimeConfig, Server, MemberlistKV},
@@ -513,6 +726,10 @@ func (t *Loki) setupModuleManager() error {
 		Write:                    {Ingester, Distributor},
 	}
 
+	for _, m := range t.extraModules {
+		deps[m.Name] = m.Deps
+	}
+
 	// Add IngesterQuerier as a dependency for store when target is either querier, ruler, or read.
 	if t.Cfg.isModuleEnabled(Querier) || t.Cfg.isModuleEnabled(Ruler) || t.Cfg.isModuleEnabled(Read) {
 		deps[Store] = append(deps[Store], IngesterQuerier)
@@ -543,8 +760,104 @@ func (t *Loki) setupModuleManager() error {
 		if err := mm.AddDependency(UsageReport, Ring); err != nil {
 			return err
 		}
+		t.deps[UsageReport] = append(t.deps[UsageReport], Ring)
+	}
+
+	return t.applyModuleStartPriority()
+}
+
+// registerExtraModules registers the extra modules passed to New, refusing to replace a built-in module.
+func (t *Loki) registerExtraModules(mm *modules.Manager) error {
+	registered := map[string]bool{}
+	for _, m := range t.extraModules {
+		if m.Name == "" {
+			return errors.New("invalid extra module: missing name")
+		}
+		if util.StringsContain(knownModules, m.Name) || registered[m.Name] {
+			return fmt.Errorf("invalid extra module: module %s is already registered", m.Name)
+		}
+		registered[m.Name] = true
+
+		var initFn func() (services.Service, error)
+		if m.Init != nil {
+			extraInit := m.Init
+			initFn = t.initWithTimeout(m.Name, func() (services.Service, error) { return extraInit(t) })
+		}
+		if m.UserInvisible {
+			mm.RegisterModule(m.Name, initFn, modules.UserInvisibleModule)
+		} else {
+			mm.RegisterModule(m.Name, initFn)
+		}
 	}
+	return nil
+}
+
+// registerGRPCReflection registers the gRPC server reflection service when enabled.
+func (t *Loki) registerGRPCReflection() {
+	if !t.Cfg.GRPCReflectionEnabled {
+		return
+	}
+	reflection.Register(t.Server.GRPC)
+	level.Info(util_log.Logger).Log("msg", "gRPC server reflection enabled")
+}
+
+var errModuleInitTimeout = errors.New("module initialisation timed out")
+
+// initWithTimeout wraps the init function of a module so that it fails once it runs for longer
+// than the module init timeout. As init functions can't be interrupted, a timed out one is left
+// running in the background.
+func (t *Loki) initWithTimeout(name string, initFn func() (services.Service, error)) func() (services.Service, error) {
+	return func() (services.Service, error) {
+		timeout := t.Cfg.ModuleInitTimeout
+		if timeout <= 0 {
+			return initFn()
+		}
 
+		type result struct {
+			svc services.Service
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			svc, err := initFn()
+			done <- result{svc: svc, err: err}
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case r := <-done:
+			return r.svc, r.err
+		case <-timer.C:
+			level.Error(util_log.Logger).Log("msg", "module initialisation timed out", "module", name, "timeout", timeout)
+			return nil, fmt.Errorf("%w after %v", errModuleInitTimeout, timeout)
+		}
+	}
+}
+
+// applyModuleStartPriority makes every active module with a start priority depend on the active
+// modules with a higher priority, so that they start first. The module manager rejects the
+// additional dependencies if they introduce a cycle.
+func (t *Loki) applyModuleStartPriority() error {
+	var prioritized []string
+	for m := range t.Cfg.ModuleStartPriority {
+		if t.isModuleActive(m) {
+			prioritized = append(prioritized, m)
+		}
+	}
+	sort.Strings(prioritized)
+
+	for _, mod := range prioritized {
+		for _, dep := range prioritized {
+			if t.Cfg.ModuleStartPriority[dep] <= t.Cfg.ModuleStartPriority[mod] {
+				continue
+			}
+			if err := t.ModuleManager.AddDependency(mod, dep); err != nil {
+				return errors.Wrap(err, "invalid module start priority")
+			}
+			t.deps[mod] = append(t.deps[mod], dep)
+		}
+	}
 	return nil
 }
 
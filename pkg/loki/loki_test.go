@@ -2,19 +2,27 @@ package loki
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/server"
+	"google.golang.org/grpc"
 )
 
 func TestFlagDefaults(t *testing.T) {
@@ -59,6 +67,60 @@ func TestFlagDefaults(t *testing.T) {
 	require.Contains(t, gotFlags[flagToCheck], "(default true)")
 }
 
+func TestDefaultTargetFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		env    string
+		target flagext.StringSliceCSV
+	}{
+		{name: "unset", env: "", target: flagext.StringSliceCSV{All}},
+		{name: "single module", env: "querier", target: flagext.StringSliceCSV{Querier}},
+		{name: "multiple modules", env: "distributor,ingester", target: flagext.StringSliceCSV{Distributor, Ingester}},
+		{name: "invalid module", env: "querier,foo", target: flagext.StringSliceCSV{All}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(DefaultTargetEnvVar, tc.env)
+
+			c := Config{}
+			f := flag.NewFlagSet("test", flag.PanicOnError)
+			c.RegisterFlags(f)
+			require.NoError(t, f.Parse(nil))
+
+			require.Equal(t, tc.target, c.Target)
+		})
+	}
+}
+
+func TestAuthExemptMethods(t *testing.T) {
+	var exempt flagext.StringSliceCSV
+	for _, m := range defaultAuthExemptMethods {
+		if m != "/frontend.Frontend/Process" {
+			exempt = append(exempt, m)
+		}
+	}
+	l := &Loki{Cfg: Config{AuthEnabled: true, AuthExemptMethods: exempt}}
+	l.setupAuthMiddleware()
+	require.Len(t, l.Cfg.Server.GRPCMiddleware, 1)
+	interceptor := l.Cfg.Server.GRPCMiddleware[0]
+
+	call := func(method string) error {
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+
+	require.NoError(t, call(healthCheckMethod))
+	require.NoError(t, call("/frontend.Frontend/NotifyClientShutdown"))
+	// The removed exemption now requires auth.
+	require.Error(t, call("/frontend.Frontend/Process"))
+
+	t.Run("health check must stay exempt", func(t *testing.T) {
+		cfg := Config{AuthExemptMethods: flagext.StringSliceCSV{"/frontend.Frontend/Process"}}
+		require.Error(t, cfg.Validate())
+	})
+}
+
 func TestLoki_isModuleEnabled(t1 *testing.T) {
 	tests := []struct {
 		name   string
@@ -91,6 +153,39 @@ func TestLoki_isModuleEnabled(t1 *testing.T) {
 	}
 }
 
+func TestLoki_ModuleStartPriority(t *testing.T) {
+	setup := func(priority map[string]int) (*Loki, error) {
+		l := &Loki{
+			Cfg: Config{
+				Target:              flagext.StringSliceCSV{"all"},
+				ModuleStartPriority: priority,
+			},
+		}
+		return l, l.setupModuleManager()
+	}
+
+	l, err := setup(nil)
+	require.NoError(t, err)
+	require.NotContains(t, l.ModuleManager.DependenciesForModule(Querier), Ingester)
+
+	// The querier must now start after the ingester.
+	l, err = setup(map[string]int{Ingester: 2, Querier: 1})
+	require.NoError(t, err)
+	require.Contains(t, l.ModuleManager.DependenciesForModule(Querier), Ingester)
+	require.NotContains(t, l.ModuleManager.DependenciesForModule(Ingester), Querier)
+
+	// Modules which are not loaded are left alone.
+	l, err = setup(map[string]int{TableManager: 2, Querier: 1})
+	require.NoError(t, err)
+	require.False(t, l.isModuleActive(TableManager))
+	require.NotContains(t, l.ModuleManager.DependenciesForModule(Querier), TableManager)
+
+	// The querier already depends on the query scheduler.
+	_, err = setup(map[string]int{Querier: 2, QueryScheduler: 1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "circular dependency")
+}
+
 func getRandomPorts(n int) []int {
 	portListeners := []net.Listener{}
 	for i := 0; i < n; i++ {
@@ -196,3 +291,194 @@ schema_config:
 	require.Equal(t, string(bBytes), "abc")
 	assert.True(t, customHandlerInvoked)
 }
+
+func TestLoki_CustomConfigEndpointPath(t *testing.T) {
+	loki := &Loki{
+		Cfg:    Config{Target: flagext.StringSliceCSV{"querier"}},
+		Server: &server.Server{HTTP: mux.NewRouter()},
+	}
+	loki.bindConfigEndpoint(RunOpts{ConfigEndpointPath: "/loki/config"})
+
+	w := httptest.NewRecorder()
+	loki.Server.HTTP.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/loki/config", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "target: querier")
+
+	w = httptest.NewRecorder()
+	loki.Server.HTTP.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRunOpts_Validate(t *testing.T) {
+	require.NoError(t, RunOpts{}.validate())
+	require.NoError(t, RunOpts{ConfigEndpointPath: "/loki/config"}.validate())
+	require.Error(t, RunOpts{ConfigEndpointPath: "config"}.validate())
+	require.Error(t, RunOpts{ConfigEndpointPath: "/ready"}.validate())
+	require.Error(t, RunOpts{ConfigEndpointPath: "/services"}.validate())
+}
+
+func TestLoki_EmptySchemaConfig(t *testing.T) {
+	validate := func(target string) error {
+		loki := &Loki{Cfg: Config{Target: flagext.StringSliceCSV{target}}}
+		require.NoError(t, loki.setupModuleManager())
+		return loki.validateSchemaConfigured()
+	}
+
+	require.EqualError(t, validate(Ingester), "no schema configured: the store module requires at least one period config in schema_config")
+	require.EqualError(t, validate(Compactor), "no schema configured: the compactor module requires at least one period config in schema_config")
+	// The query frontend doesn't use the schema.
+	require.NoError(t, validate(QueryFrontend))
+}
+
+func TestLoki_EmptySchemaConfigModuleInit(t *testing.T) {
+	// The modules register their metrics globally, and are initialised by other tests too.
+	defer func(reg prometheus.Registerer) { prometheus.DefaultRegisterer = reg }(prometheus.DefaultRegisterer)
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	ports := getRandomPorts(2)
+	cfgWrapper, _, err := configWrapperFromYAML(t, fmt.Sprintf(`target: distributor
+server:
+  http_listen_port: %d
+  grpc_listen_port: %d
+common:
+  path_prefix: /tmp/loki
+  ring:
+    kvstore:
+      store: inmemory`, ports[0], ports[1]), nil)
+	require.NoError(t, err)
+	require.True(t, cfgWrapper.Config.UsageReport.Enabled)
+
+	// The usage report, which every target depends on, doesn't need the schema either.
+	loki, err := New(cfgWrapper.Config)
+	require.NoError(t, err)
+	serviceMap, err := loki.ModuleManager.InitModuleServices(loki.Cfg.Target...)
+	require.NoError(t, err)
+	require.Contains(t, serviceMap, Distributor)
+	require.Nil(t, loki.usageReport)
+}
+
+func TestLoki_ExtraModules(t *testing.T) {
+	var initialized bool
+	loki := &Loki{
+		Cfg: Config{Target: flagext.StringSliceCSV{"custom"}},
+		extraModules: []ModuleRegistration{
+			{Name: "custom-deps", UserInvisible: true},
+			{
+				Name: "custom",
+				Init: func(_ *Loki) (services.Service, error) {
+					initialized = true
+					return services.NewIdleService(nil, nil), nil
+				},
+				Deps: []string{"custom-deps"},
+			},
+		},
+	}
+	require.NoError(t, loki.setupModuleManager())
+	require.True(t, loki.isModuleActive("custom-deps"))
+
+	serviceMap, err := loki.ModuleManager.InitModuleServices(loki.Cfg.Target...)
+	require.NoError(t, err)
+	require.True(t, initialized)
+	require.Contains(t, serviceMap, "custom")
+
+	loki = &Loki{extraModules: []ModuleRegistration{{Name: Querier}}}
+	require.EqualError(t, loki.setupModuleManager(), "invalid extra module: module querier is already registered")
+}
+
+func TestLoki_ModuleInitTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	loki := &Loki{
+		Cfg: Config{Target: flagext.StringSliceCSV{"slow"}, ModuleInitTimeout: 50 * time.Millisecond},
+		extraModules: []ModuleRegistration{{
+			Name: "slow",
+			Init: func(_ *Loki) (services.Service, error) {
+				<-release
+				return services.NewIdleService(nil, nil), nil
+			},
+		}},
+	}
+	require.NoError(t, loki.setupModuleManager())
+
+	_, err := loki.ModuleManager.InitModuleServices(loki.Cfg.Target...)
+	require.ErrorIs(t, err, errModuleInitTimeout)
+	require.Contains(t, err.Error(), "slow")
+}
+
+func TestLoki_GRPCReflection(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		loki := &Loki{
+			Cfg:    Config{GRPCReflectionEnabled: enabled},
+			Server: &server.Server{GRPC: grpc.NewServer()},
+		}
+		loki.registerGRPCReflection()
+		_, registered := loki.Server.GRPC.GetServiceInfo()["grpc.reflection.v1alpha.ServerReflection"]
+		require.Equal(t, enabled, registered)
+	}
+}
+
+func TestLoki_MemberlistOptional(t *testing.T) {
+	// Memberlist fails to start as its port is taken.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// The memberlist module registers its metrics globally, and is initialised by other tests too.
+	defer func(reg prometheus.Registerer) { prometheus.DefaultRegisterer = reg }(prometheus.DefaultRegisterer)
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	var cfg Config
+	flagext.DefaultValues(&cfg)
+	cfg.MemberlistOptional = true
+	cfg.MemberlistKV.TCPTransport.BindAddrs = []string{"127.0.0.1"}
+	cfg.MemberlistKV.TCPTransport.BindPort = l.Addr().(*net.TCPAddr).Port
+	cfg.Ingester.LifecyclerConfig.RingConfig.KVStore.Store = "memberlist"
+	cfg.Distributor.DistributorRing.KVStore.Store = "memberlist"
+	cfg.Ruler.Ring.KVStore.Store = "consul"
+
+	loki := &Loki{Cfg: cfg}
+	svc, err := loki.initMemberlistKV()
+	require.NoError(t, err)
+	require.NotNil(t, svc)
+	require.Equal(t, "inmemory", loki.Cfg.Ingester.LifecyclerConfig.RingConfig.KVStore.Store)
+	require.Equal(t, "inmemory", loki.Cfg.Distributor.DistributorRing.KVStore.Store)
+	require.Equal(t, "consul", loki.Cfg.Ruler.Ring.KVStore.Store)
+
+	// The fallback memberlist service runs without starting memberlist.
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), svc))
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), svc))
+}
+
+func TestLoki_DependenciesHandler(t *testing.T) {
+	loki := &Loki{Cfg: Config{Target: flagext.StringSliceCSV{Querier}}}
+	require.NoError(t, loki.setupModuleManager())
+
+	w := httptest.NewRecorder()
+	loki.dependenciesHandler(w, httptest.NewRequest(http.MethodGet, "/config/dependencies", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var deps map[string][]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deps))
+	require.Contains(t, deps[Store], IngesterQuerier)
+	require.Contains(t, deps[Querier], Store)
+}
+
+func TestLoki_MinReadyDuration(t *testing.T) {
+	sm, err := services.NewManager(services.NewIdleService(nil, nil))
+	require.NoError(t, err)
+	require.NoError(t, services.StartManagerAndAwaitHealthy(context.Background(), sm))
+	defer services.StopManagerAndAwaitStopped(context.Background(), sm) //nolint:errcheck
+
+	loki := &Loki{Cfg: Config{MinReadyDuration: time.Minute}, startTime: time.Now()}
+	ready := func() int {
+		w := httptest.NewRecorder()
+		loki.readyHandler(sm)(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusServiceUnavailable, ready())
+
+	loki.startTime = time.Now().Add(-time.Minute)
+	require.Equal(t, http.StatusOK, ready())
+}
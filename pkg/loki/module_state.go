@@ -0,0 +1,53 @@
+package loki
+
+import (
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	moduleState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "loki",
+		Name:      "module_state",
+		Help:      "Current state of each module: 1 for the state the module is in, 0 for the other states.",
+	}, []string{"module", "state"})
+
+	buildTargetInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "loki",
+		Name:      "build_target_info",
+		Help:      "Modules run by this process, resolved from its targets: 1 for every active module.",
+	}, []string{"target"})
+
+	serviceStates = []services.State{services.New, services.Starting, services.Running, services.Stopping, services.Terminated, services.Failed}
+)
+
+// setModuleState marks state as the current state of the module in the gauge.
+func setModuleState(gauge *prometheus.GaugeVec, module string, state services.State) {
+	for _, s := range serviceStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		gauge.WithLabelValues(module, s.String()).Set(v)
+	}
+}
+
+// newModuleStateListener returns a service listener keeping the state of the module up to date in the gauge.
+func newModuleStateListener(gauge *prometheus.GaugeVec, module string) services.Listener {
+	return services.NewListener(
+		func() { setModuleState(gauge, module, services.Starting) },
+		func() { setModuleState(gauge, module, services.Running) },
+		func(_ services.State) { setModuleState(gauge, module, services.Stopping) },
+		func(_ services.State) { setModuleState(gauge, module, services.Terminated) },
+		func(_ services.State, _ error) { setModuleState(gauge, module, services.Failed) },
+	)
+}
+
+// setActiveModules exposes the active modules in the gauge, with a series per module.
+func setActiveModules(gauge *prometheus.GaugeVec, modules []string) {
+	gauge.Reset()
+	for _, m := range modules {
+		gauge.WithLabelValues(m).Set(1)
+	}
+}
@@ -0,0 +1,61 @@
+package loki
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleStateListener(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_module_state"}, []string{"module", "state"})
+
+	svc := services.NewIdleService(nil, nil)
+	setModuleState(gauge, "stub", svc.State())
+	svc.AddListener(newModuleStateListener(gauge, "stub"))
+
+	requireState := func(expected services.State) {
+		require.Eventually(t, func() bool {
+			for _, s := range serviceStates {
+				want := 0.0
+				if s == expected {
+					want = 1
+				}
+				if testutil.ToFloat64(gauge.WithLabelValues("stub", s.String())) != want {
+					return false
+				}
+			}
+			return true
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	requireState(services.New)
+
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), svc))
+	requireState(services.Running)
+
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), svc))
+	requireState(services.Terminated)
+}
+
+func TestSetActiveModules(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_build_target_info"}, []string{"target"})
+
+	loki := &Loki{Cfg: Config{Target: flagext.StringSliceCSV{Querier}}}
+	require.NoError(t, loki.setupModuleManager())
+	setActiveModules(gauge, append(loki.ModuleManager.DependenciesForModule(Querier), Querier))
+
+	require.Equal(t, float64(1), testutil.ToFloat64(gauge.WithLabelValues(Querier)))
+	require.Equal(t, float64(1), testutil.ToFloat64(gauge.WithLabelValues(Store)))
+	require.Equal(t, float64(1), testutil.ToFloat64(gauge.WithLabelValues(Server)))
+
+	// Only the active modules are exposed.
+	setActiveModules(gauge, []string{Distributor})
+	require.Equal(t, 1, testutil.CollectAndCount(gauge))
+	require.Equal(t, float64(1), testutil.ToFloat64(gauge.WithLabelValues(Distributor)))
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/NYTimes/gziphandler"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/kv"
 	"github.com/grafana/dskit/kv/codec"
 	"github.com/grafana/dskit/kv/memberlist"
 	"github.com/grafana/dskit/ring"
@@ -91,6 +92,13 @@ const (
 	UsageReport              string = "usage-report"
 )
 
+// knownModules lists every module name which can be used as a target.
+var knownModules = []string{
+	Ring, RuntimeConfig, Overrides, OverridesExporter, TenantConfigs, Server, Distributor, Ingester, Querier,
+	IngesterQuerier, QueryFrontend, QueryFrontendTripperware, RulerStorage, Ruler, Store, TableManager,
+	MemberlistKV, Compactor, IndexGateway, QueryScheduler, All, Read, Write, UsageReport,
+}
+
 func (t *Loki) initServer() (services.Service, error) {
 	prometheus.MustRegister(version.NewCollector("loki"))
 
@@ -153,7 +161,7 @@ func (t *Loki) initRuntimeConfig() (services.Service, error) {
 		return nil, nil
 	}
 
-	t.Cfg.RuntimeConfig.Loader = loadRuntimeConfig
+	t.Cfg.RuntimeConfig.Loader = instrumentLoader(runtimeConfigReloads, loadRuntimeConfig)
 
 	// make sure to set default limits before we start loading configuration into memory
 	validation.SetDefaultLimitsForYAMLUnmarshalling(t.Cfg.LimitsConfig)
@@ -328,6 +336,21 @@ func (t *Loki) initIngester() (_ services.Service, err error) {
 	)
 	t.Server.HTTP.Path("/flush").Methods("GET", "POST").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.FlushHandler)))
 	t.Server.HTTP.Methods("POST").Path("/ingester/flush_shutdown").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.ShutdownHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/chunks/close-all").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.CloseAllChunksHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/chunks/evict-flushed").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.EvictFlushedChunksHandler)))
+	t.Server.HTTP.Methods("GET").Path("/ingester/flush/stats").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.FlushStatsHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/flush/pause").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.FlushPauseHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/flush/resume").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.FlushResumeHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/flush/concurrency").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.FlushConcurrencyHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/flush/rebalance").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.FlushRebalanceHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/flush/before").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.FlushBeforeHandler)))
+	t.Server.HTTP.Methods("GET").Path("/ingester/flush/chunk").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.ChunkFlushStatusHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/flush/chunk/reset").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.ResetChunkFlushStatusHandler)))
+	t.Server.HTTP.Methods("GET").Path("/ingester/chunks/export").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.ExportChunksHandler)))
+	t.Server.HTTP.Methods("GET").Path("/ingester/tenants").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.TenantsHandler)))
+	t.Server.HTTP.Methods("GET").Path("/ingester/unflushed").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.UnflushedDataHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/drain").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.DrainHandler)))
+	t.Server.HTTP.Methods("POST").Path("/ingester/wal/checkpoint").Handler(httpMiddleware.Wrap(http.HandlerFunc(t.Ingester.CheckpointHandler)))
 
 	return t.Ingester, nil
 }
@@ -725,9 +748,42 @@ func (t *Loki) initMemberlistKV() (services.Service, error) {
 	dnsProvider := dns.NewProvider(util_log.Logger, dnsProviderReg, dns.GolangResolverType)
 
 	t.MemberlistKV = memberlist.NewKVInitService(&t.Cfg.MemberlistKV, util_log.Logger, dnsProvider, reg)
+
+	if t.Cfg.MemberlistOptional && len(t.memberlistKVStores()) > 0 {
+		// Start memberlist right away, rather than on first use by a ring, to fall back before
+		// any ring depends on it.
+		kvClient, err := t.MemberlistKV.GetMemberlistKV()
+		if err == nil {
+			err = kvClient.AwaitRunning(context.Background())
+		}
+		if err != nil {
+			level.Warn(util_log.Logger).Log("msg", "MEMBERLIST FAILED TO START, FALLING BACK TO A LOCAL-ONLY KV STORE: the rings aren't shared with other instances", "err", err)
+			for _, kvStore := range t.memberlistKVStores() {
+				kvStore.Store = "inmemory"
+			}
+			t.MemberlistKV = memberlist.NewKVInitService(&t.Cfg.MemberlistKV, util_log.Logger, dnsProvider, reg)
+		}
+	}
 	return t.MemberlistKV, nil
 }
 
+// memberlistKVStores returns the KV store configs of the rings using memberlist.
+func (t *Loki) memberlistKVStores() []*kv.Config {
+	var stores []*kv.Config
+	for _, kvStore := range []*kv.Config{
+		&t.Cfg.Ingester.LifecyclerConfig.RingConfig.KVStore,
+		&t.Cfg.Distributor.DistributorRing.KVStore,
+		&t.Cfg.Ruler.Ring.KVStore,
+		&t.Cfg.CompactorConfig.CompactorRing.KVStore,
+		&t.Cfg.QueryScheduler.SchedulerRing.KVStore,
+	} {
+		if kvStore.Store == "memberlist" {
+			stores = append(stores, kvStore)
+		}
+	}
+	return stores
+}
+
 func (t *Loki) initCompactor() (services.Service, error) {
 	// Set some config sections from other config sections in the config struct
 	t.Cfg.CompactorConfig.CompactorRing.ListenPort = t.Cfg.Server.GRPCListenPort
@@ -803,6 +859,11 @@ func (t *Loki) initUsageReport() (services.Service, error) {
 	}
 
 	usagestats.Target(t.Cfg.Target.String())
+	// The modules needing a schema are checked by validateSchemaConfigured, the others run without.
+	if len(t.Cfg.SchemaConfig.Configs) == 0 {
+		level.Info(util_log.Logger).Log("msg", "usage report disabled as no schema is configured")
+		return nil, nil
+	}
 	period, err := t.Cfg.SchemaConfig.SchemaForTime(model.Now())
 	if err != nil {
 		return nil, err
@@ -7,6 +7,8 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/kv"
 	"github.com/grafana/dskit/runtimeconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"gopkg.in/yaml.v2"
 
 	"github.com/grafana/loki/pkg/runtime"
@@ -14,6 +16,17 @@ import (
 	"github.com/grafana/loki/pkg/validation"
 )
 
+const (
+	reloadOutcomeSuccess = "success"
+	reloadOutcomeFailure = "failure"
+)
+
+var runtimeConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "loki",
+	Name:      "runtime_config_reload_total",
+	Help:      "Total number of runtime config reloads, by outcome.",
+}, []string{"outcome"})
+
 // runtimeConfigValues are values that can be reloaded from configuration file while Loki is running.
 // Reloading is done by runtimeconfig.Manager, which also keeps the currently loaded config.
 // These values are then pushed to the components that are interested in them.
@@ -52,6 +65,21 @@ func loadRuntimeConfig(r io.Reader) (interface{}, error) {
 	return overrides, nil
 }
 
+// instrumentLoader counts the outcome of every load done by loader in reloads.
+// The runtime config manager only notifies its listeners about successful reloads,
+// so failures can only be observed from the loader.
+func instrumentLoader(reloads *prometheus.CounterVec, loader runtimeconfig.Loader) runtimeconfig.Loader {
+	return func(r io.Reader) (interface{}, error) {
+		cfg, err := loader(r)
+		if err != nil {
+			reloads.WithLabelValues(reloadOutcomeFailure).Inc()
+			return nil, err
+		}
+		reloads.WithLabelValues(reloadOutcomeSuccess).Inc()
+		return cfg, nil
+	}
+}
+
 type tenantLimitsFromRuntimeConfig struct {
 	c *runtimeconfig.Manager
 }
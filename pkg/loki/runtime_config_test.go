@@ -11,7 +11,9 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/grafana/dskit/runtimeconfig"
+	"github.com/grafana/dskit/services"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/require"
@@ -129,3 +131,30 @@ func Test_NoOverrides(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, time.Duration(defaults.QuerySplitDuration), overrides.QuerySplitDuration("foo"))
 }
+
+func Test_RuntimeConfigReloadMetric(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "runtime-config")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("overrides: {}\n"), 0o600))
+
+	reloads := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "reloads"}, []string{"outcome"})
+	cfg := runtimeconfig.Config{
+		ReloadPeriod: 10 * time.Millisecond,
+		Loader:       instrumentLoader(reloads, loadRuntimeConfig),
+		LoadPath:     f.Name(),
+	}
+	runtimeConfig, err := runtimeconfig.New(cfg, nil, log.NewNopLogger())
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), runtimeConfig))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), runtimeConfig))
+	}()
+	require.GreaterOrEqual(t, testutil.ToFloat64(reloads.WithLabelValues(reloadOutcomeSuccess)), float64(1))
+	require.Equal(t, float64(0), testutil.ToFloat64(reloads.WithLabelValues(reloadOutcomeFailure)))
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("not_a_field: true\n"), 0o600))
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(reloads.WithLabelValues(reloadOutcomeFailure)) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -3,6 +3,8 @@ package loki
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/grafana/loki/pkg/util"
 )
 
 func (t *Loki) servicesHandler(w http.ResponseWriter, r *http.Request) {
@@ -16,3 +18,9 @@ func (t *Loki) servicesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// dependenciesHandler returns the direct dependencies of every module as JSON, including the
+// ones which only apply to the configured targets.
+func (t *Loki) dependenciesHandler(w http.ResponseWriter, _ *http.Request) {
+	util.WriteJSONResponse(w, t.deps)
+}
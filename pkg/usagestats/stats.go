@@ -46,7 +46,7 @@ type Report struct {
 
 // sendReport sends the report to the stats server
 func sendReport(ctx context.Context, seed *ClusterSeed, interval time.Time) error {
-	report := buildReport(seed, interval)
+	report := BuildReport(seed, interval)
 	out, err := jsoniter.MarshalIndent(report, "", " ")
 	if err != nil {
 		return err
@@ -71,8 +71,8 @@ func sendReport(ctx context.Context, seed *ClusterSeed, interval time.Time) erro
 	return nil
 }
 
-// buildReport builds the report to be sent to the stats server
-func buildReport(seed *ClusterSeed, interval time.Time) Report {
+// BuildReport builds the report to be sent to the stats server, from the statistics registered so far.
+func BuildReport(seed *ClusterSeed, interval time.Time) Report {
 	var (
 		targetName  string
 		editionName string
@@ -43,7 +43,7 @@ func Test_BuildReport(t *testing.T) {
 	w.Add("bar")
 	w.Add("foo")
 
-	r := buildReport(seed, now.Add(time.Hour))
+	r := BuildReport(seed, now.Add(time.Hour))
 	require.Equal(t, r.Arch, runtime.GOARCH)
 	require.Equal(t, r.Os, runtime.GOOS)
 	require.Equal(t, r.PrometheusVersion, build.GetVersion())
@@ -7,8 +7,10 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/drone/envsubst"
+	"github.com/drone/envsubst/parse"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
@@ -41,15 +43,21 @@ func dJSON(y []byte) Source {
 // When expandEnvVars is true, variables in the supplied '.yaml\ file are expanded
 // using https://pkg.go.dev/github.com/drone/envsubst?tab=overview
 func YAML(f string, expandEnvVars bool) Source {
+	return yamlFile(f, expandEnvVars, false)
+}
+
+// yamlFile is YAML, optionally failing on references to undefined environment variables
+// which have no default value.
+func yamlFile(f string, expandEnvVars, strictEnvVars bool) Source {
 	return func(dst Cloneable) error {
 		y, err := ioutil.ReadFile(f)
 		if err != nil {
 			return err
 		}
 		if expandEnvVars {
-			s, err := envsubst.EvalEnv(string(y))
+			s, err := expandEnv(string(y), strictEnvVars)
 			if err != nil {
-				return err
+				return errors.Wrap(err, f)
 			}
 			y = []byte(s)
 		}
@@ -58,6 +66,47 @@ func YAML(f string, expandEnvVars bool) Source {
 	}
 }
 
+// expandEnv replaces ${var} in s according to the values of the environment variables.
+// In strict mode, references to undefined variables without a default value are an error
+// instead of being replaced by the empty string.
+func expandEnv(s string, strict bool) (string, error) {
+	if strict {
+		tree, err := parse.Parse(s)
+		if err != nil {
+			return s, err
+		}
+		var undefined []string
+		undefinedEnvVars(tree.Root, &undefined)
+		if len(undefined) > 0 {
+			return s, fmt.Errorf("undefined environment variables: %s", strings.Join(undefined, ", "))
+		}
+	}
+	return envsubst.EvalEnv(s)
+}
+
+// undefinedEnvVars appends the undefined environment variables referenced by node
+// without a default value to undefined.
+func undefinedEnvVars(node parse.Node, undefined *[]string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		for _, c := range n.Nodes {
+			undefinedEnvVars(c, undefined)
+		}
+	case *parse.FuncNode:
+		for _, c := range n.Args {
+			undefinedEnvVars(c, undefined)
+		}
+		switch n.Name {
+		case "-", ":-", "=", ":=":
+			// The default value is used instead.
+			return
+		}
+		if _, ok := os.LookupEnv(n.Param); !ok {
+			*undefined = append(*undefined, n.Param)
+		}
+	}
+}
+
 // dYAML returns a YAML source and allows dependency injection
 func dYAML(y []byte) Source {
 	return func(dst Cloneable) error {
@@ -97,8 +146,13 @@ func YAMLFlag(args []string, name string) Source {
 		if expandEnvFlag != nil {
 			expandEnv, _ = strconv.ParseBool(expandEnvFlag.Value.String()) // Can ignore error as false returned
 		}
+		strictEnv := false
+		strictEnvFlag := freshFlags.Lookup("config.expand-env-strict")
+		if strictEnvFlag != nil {
+			strictEnv, _ = strconv.ParseBool(strictEnvFlag.Value.String()) // Can ignore error as false returned
+		}
 
-		return YAML(f.Value.String(), expandEnv)(dst)
+		return yamlFile(f.Value.String(), expandEnv, strictEnv)(dst)
 
 	}
 }
@@ -31,3 +31,32 @@ func TestYAMLFlagDoesNotMutate(t *testing.T) {
 	cfg.RegisterFlags(nil)
 	require.Equal(t, 1, cfg.v)
 }
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("LOKI_TEST_DEFINED", "defined")
+
+	for _, tc := range []struct {
+		name, in string
+		strict   bool
+		expected string
+		err      string
+	}{
+		{name: "defined", in: "key: ${LOKI_TEST_DEFINED}", expected: "key: defined"},
+		{name: "defined strict", in: "key: ${LOKI_TEST_DEFINED}", strict: true, expected: "key: defined"},
+		{name: "undefined", in: "key: ${LOKI_TEST_UNDEFINED}", expected: "key: "},
+		{name: "undefined strict", in: "key: ${LOKI_TEST_UNDEFINED}\nother: ${LOKI_TEST_OTHER}", strict: true, err: "undefined environment variables: LOKI_TEST_UNDEFINED, LOKI_TEST_OTHER"},
+		{name: "default value", in: "key: ${LOKI_TEST_UNDEFINED:-default}", strict: true, expected: "key: default"},
+		{name: "defined over default value", in: "key: ${LOKI_TEST_DEFINED:-default}", strict: true, expected: "key: defined"},
+		{name: "undefined in default value", in: "key: ${LOKI_TEST_UNDEFINED:-${LOKI_TEST_OTHER}}", strict: true, err: "undefined environment variables: LOKI_TEST_OTHER"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := expandEnv(tc.in, tc.strict)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, out)
+		})
+	}
+}
@@ -81,6 +81,23 @@ func (pq *PriorityQueue) DiscardAndClose() {
 	pq.cond.Broadcast()
 }
 
+// Drain removes all the items from the queue and returns them in priority order, leaving the
+// queue open.
+func (pq *PriorityQueue) Drain() []Op {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	ops := make([]Op, 0, len(pq.queue))
+	for len(pq.queue) > 0 {
+		ops = append(ops, heap.Pop(&pq.queue).(Op))
+	}
+	pq.hit = map[string]struct{}{}
+	if pq.lengthGauge != nil {
+		pq.lengthGauge.Sub(float64(len(ops)))
+	}
+	return ops
+}
+
 // Enqueue adds an operation to the queue in priority order. Returns
 // true if added; false if the operation was already on the queue.
 func (pq *PriorityQueue) Enqueue(op Op) bool {
@@ -58,6 +58,20 @@ func TestPriorityQueuePriorities2(t *testing.T) {
 	assert.Nil(t, queue.Dequeue(), "Expect nil dequeue")
 }
 
+func TestPriorityQueueDrain(t *testing.T) {
+	queue := NewPriorityQueue(nil)
+	for _, i := range []simpleItem{2, 3, 1} {
+		queue.Enqueue(i)
+	}
+
+	assert.Equal(t, []Op{simpleItem(3), simpleItem(2), simpleItem(1)}, queue.Drain())
+	assert.Equal(t, 0, queue.Length(), "Expected length = 0")
+
+	// The queue is still open, and the drained items can be enqueued again.
+	assert.True(t, queue.Enqueue(simpleItem(1)))
+	assert.Equal(t, simpleItem(1), queue.Dequeue())
+}
+
 func TestPriorityQueueWait(t *testing.T) {
 	queue := NewPriorityQueue(nil)
 
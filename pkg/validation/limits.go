@@ -38,6 +38,11 @@ const (
 
 	defaultPerStreamRateLimit  = 3 << 20 // 3MB
 	defaultPerStreamBurstLimit = 5 * defaultPerStreamRateLimit
+
+	// MaxFlushPriorityClass is the highest flush priority class a tenant can be assigned.
+	MaxFlushPriorityClass = 1000
+	// MaxFlushWeight is the highest flush weight a tenant can be assigned.
+	MaxFlushWeight = 1000
 )
 
 // Limits describe all the limits for users; can be used to describe global default
@@ -65,6 +70,13 @@ type Limits struct {
 	UnorderedWrites         bool             `yaml:"unordered_writes" json:"unordered_writes"`
 	PerStreamRateLimit      flagext.ByteSize `yaml:"per_stream_rate_limit" json:"per_stream_rate_limit"`
 	PerStreamRateLimitBurst flagext.ByteSize `yaml:"per_stream_rate_limit_burst" json:"per_stream_rate_limit_burst"`
+	SkipFlushMetrics        bool             `yaml:"skip_flush_metrics" json:"skip_flush_metrics"`
+	ChunkIdlePeriod         model.Duration   `yaml:"chunk_idle_period" json:"chunk_idle_period"`
+	MaxChunkAge             model.Duration   `yaml:"max_chunk_age" json:"max_chunk_age"`
+	ChunkRetainPeriod       model.Duration   `yaml:"chunk_retain_period" json:"chunk_retain_period"`
+	FlushPriorityClass      int              `yaml:"flush_priority_class" json:"flush_priority_class"`
+	MaxTenantMemoryBytes    flagext.ByteSize `yaml:"max_tenant_memory_bytes" json:"max_tenant_memory_bytes"`
+	FlushWeight             int              `yaml:"flush_weight" json:"flush_weight"`
 
 	// Querier enforced limits.
 	MaxChunksPerQuery          int            `yaml:"max_chunks_per_query" json:"max_chunks_per_query"`
@@ -151,6 +163,13 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 	f.Var(&l.PerStreamRateLimit, "ingester.per-stream-rate-limit", "Maximum byte rate per second per stream, also expressible in human readable forms (1MB, 256KB, etc).")
 	_ = l.PerStreamRateLimitBurst.Set(strconv.Itoa(defaultPerStreamBurstLimit))
 	f.Var(&l.PerStreamRateLimitBurst, "ingester.per-stream-rate-limit-burst", "Maximum burst bytes per stream, also expressible in human readable forms (1MB, 256KB, etc).")
+	f.BoolVar(&l.SkipFlushMetrics, "ingester.skip-flush-metrics", false, "Skip recording the per tenant flush metrics, e.g. for synthetic load-test tenants. Chunks are still flushed.")
+	f.Var(&l.ChunkIdlePeriod, "ingester.tenant-chunks-idle-period", "Per tenant override of how long chunks may stay idle before being flushed. 0 to use the ingester chunk_idle_period.")
+	f.Var(&l.MaxChunkAge, "ingester.tenant-max-chunk-age", "Per tenant override of the maximum chunk age before flushing. 0 to use the ingester max_chunk_age.")
+	f.Var(&l.ChunkRetainPeriod, "ingester.tenant-chunks-retain-period", "Per tenant override of how long flushed chunks are kept in memory. 0 to use the ingester chunk_retain_period.")
+	f.IntVar(&l.FlushPriorityClass, "ingester.flush-priority-class", 0, fmt.Sprintf("Priority class of the tenant when flushing all the in-memory chunks, e.g. on shutdown. The chunks of tenants in a higher class are flushed first, to minimize their data loss window if the ingester is killed before the flush completes. Between 0 and %d.", MaxFlushPriorityClass))
+	f.Var(&l.MaxTenantMemoryBytes, "ingester.max-tenant-memory-bytes", "Maximum uncompressed bytes of unflushed chunks the tenant may hold in memory, per ingester, before all its streams are flushed regardless of their age and idleness, also expressible in human readable forms (1MB, 256KB, etc). 0 to disable.")
+	f.IntVar(&l.FlushWeight, "ingester.flush-weight", 1, fmt.Sprintf("Weight of the tenant when the flush loops are shared between the tenants with ingester.flush-fair-queueing. Under contention, the streams of the tenant are flushed in proportion to its weight relative to the other tenants. Between 1 and %d.", MaxFlushWeight))
 
 	f.IntVar(&l.MaxChunksPerQuery, "store.query-chunk-limit", 2e6, "Maximum number of chunks that can be fetched in a single query.")
 
@@ -213,6 +232,12 @@ func (l *Limits) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // Validate validates that this limits config is valid.
 func (l *Limits) Validate() error {
+	if l.FlushPriorityClass < 0 || l.FlushPriorityClass > MaxFlushPriorityClass {
+		return fmt.Errorf("flush priority class must be between 0 and %d was %d", MaxFlushPriorityClass, l.FlushPriorityClass)
+	}
+	if l.FlushWeight < 1 || l.FlushWeight > MaxFlushWeight {
+		return fmt.Errorf("flush weight must be between 1 and %d was %d", MaxFlushWeight, l.FlushWeight)
+	}
 	if l.StreamRetention != nil {
 		for i, rule := range l.StreamRetention {
 			matchers, err := syntax.ParseMatchers(rule.Selector)
@@ -524,6 +549,41 @@ func (o *Overrides) UnorderedWrites(userID string) bool {
 	return o.getOverridesForUser(userID).UnorderedWrites
 }
 
+// SkipFlushMetrics returns whether the per tenant flush metrics are not recorded for the user.
+func (o *Overrides) SkipFlushMetrics(userID string) bool {
+	return o.getOverridesForUser(userID).SkipFlushMetrics
+}
+
+// ChunkIdlePeriod returns how long the chunks of the user may stay idle before being flushed, 0 if not overridden.
+func (o *Overrides) ChunkIdlePeriod(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).ChunkIdlePeriod)
+}
+
+// MaxChunkAge returns the maximum age of the chunks of the user before being flushed, 0 if not overridden.
+func (o *Overrides) MaxChunkAge(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).MaxChunkAge)
+}
+
+// ChunkRetainPeriod returns how long the flushed chunks of the user are kept in memory, 0 if not overridden.
+func (o *Overrides) ChunkRetainPeriod(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).ChunkRetainPeriod)
+}
+
+// FlushPriorityClass returns the priority class of the user when flushing all the in-memory chunks.
+func (o *Overrides) FlushPriorityClass(userID string) int {
+	return o.getOverridesForUser(userID).FlushPriorityClass
+}
+
+// MaxTenantMemoryBytes returns the maximum bytes of unflushed chunks the user may hold in memory before being flushed, 0 if unlimited.
+func (o *Overrides) MaxTenantMemoryBytes(userID string) int64 {
+	return int64(o.getOverridesForUser(userID).MaxTenantMemoryBytes)
+}
+
+// FlushWeight returns the weight of the user when sharing the flush loops between the users.
+func (o *Overrides) FlushWeight(userID string) int {
+	return o.getOverridesForUser(userID).FlushWeight
+}
+
 func (o *Overrides) DefaultLimits() *Limits {
 	return o.defaultLimits
 }